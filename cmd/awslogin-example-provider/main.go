@@ -0,0 +1,102 @@
+// awslogin-example-provider is the reference implementation of the external provider protocol. It answers the
+// requests of awslogin from the accounts in a JSON file, given as its only argument, shaped like
+//
+//	{"accounts":[{"id":"1","title":"AWS alpha","fields":{"ACCOUNT_ALIAS":"alpha"},"otp_secret":"otpauth://..."}]}
+//
+// The one-time password secrets stay with the provider, so the accounts are described without them and the
+// codes are generated for the totp request.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/deptofdefense/awslogin/pkg/external"
+	"github.com/deptofdefense/awslogin/pkg/totp"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: awslogin-example-provider <accounts.json>")
+		os.Exit(2)
+	}
+	response, errAnswer := answer(os.Args[1])
+	if errAnswer != nil {
+		fmt.Fprintln(os.Stderr, errAnswer)
+		os.Exit(1)
+	}
+	errEncode := json.NewEncoder(os.Stdout).Encode(response)
+	if errEncode != nil {
+		fmt.Fprintln(os.Stderr, errEncode)
+		os.Exit(1)
+	}
+}
+
+// answer reads the request from stdin and returns the response. Failures the protocol has no error code for are
+// returned as errors, which exit with a failure and the message on stderr.
+func answer(filename string) (*external.Response, error) {
+	var request external.Request
+	errDecode := json.NewDecoder(os.Stdin).Decode(&request)
+	if errDecode != nil {
+		return nil, fmt.Errorf("Unable to read the request: %w", errDecode)
+	}
+	if request.Version != external.ProtocolVersion {
+		return errorResponse(external.ErrorCodeUnsupported, fmt.Sprintf("version %d of the protocol is not supported", request.Version)), nil
+	}
+
+	content, errReadFile := ioutil.ReadFile(filename)
+	if errReadFile != nil {
+		return nil, errReadFile
+	}
+	var file struct {
+		Accounts []external.Account `json:"accounts"`
+	}
+	errUnmarshal := json.Unmarshal(content, &file)
+	if errUnmarshal != nil {
+		return nil, fmt.Errorf("Unable to read the accounts in %s: %w", filename, errUnmarshal)
+	}
+
+	switch request.Request {
+	case external.RequestList:
+		accounts := []external.Account{}
+		for _, account := range file.Accounts {
+			accounts = append(accounts, external.Account{ID: account.ID, Title: account.Title, UpdatedAt: account.UpdatedAt})
+		}
+		return &external.Response{Accounts: accounts}, nil
+	case external.RequestDescribe, external.RequestTotp:
+		matches := []external.Account{}
+		for _, account := range file.Accounts {
+			if account.ID == request.Name || account.Title == request.Name {
+				matches = append(matches, account)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return errorResponse(external.ErrorCodeNotFound, fmt.Sprintf("no account has the ID or title %q", request.Name)), nil
+		case 1:
+		default:
+			return errorResponse(external.ErrorCodeAmbiguous, fmt.Sprintf("%d accounts are titled %q", len(matches), request.Name)), nil
+		}
+		account := matches[0]
+		if request.Request == external.RequestDescribe {
+			account.OTPSecret = ""
+			return &external.Response{Account: &account}, nil
+		}
+		if len(account.OTPSecret) == 0 {
+			return errorResponse("no_otp", fmt.Sprintf("the account %q has no one-time password secret", account.ID)), nil
+		}
+		key, errParse := totp.Parse(account.OTPSecret)
+		if errParse != nil {
+			return nil, fmt.Errorf("Unable to use the one-time password secret of the account %q: %w", account.ID, errParse)
+		}
+		return &external.Response{Code: key.Generate(time.Now())}, nil
+	}
+	return errorResponse(external.ErrorCodeUnsupported, fmt.Sprintf("the request %q is not supported", request.Request)), nil
+}
+
+func errorResponse(code, message string) *external.Response {
+	return &external.Response{Error: &external.Error{Code: code, Message: message}}
+}
@@ -2,38 +2,94 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
-	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/99designs/aws-vault/v6/cli"
+	"github.com/99designs/aws-vault/v6/vault"
+	"github.com/99designs/keyring"
 	"github.com/deptofdefense/awslogin/pkg/awsvault"
+	"github.com/deptofdefense/awslogin/pkg/external"
+	"github.com/deptofdefense/awslogin/pkg/hcvault"
+	"github.com/deptofdefense/awslogin/pkg/keepass"
 	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/pass"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+	"github.com/deptofdefense/awslogin/pkg/totp"
 	"github.com/deptofdefense/awslogin/pkg/version"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"golang.org/x/mod/semver"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
+	flagLoginAccounts         = "accounts"
 	flagLoginBrowser          = "browser"
+	flagLoginBwCollection     = "bw-collection"
+	flagLoginBwFolder         = "bw-folder"
+	flagLoginConnectHost      = "connect-host"
+	flagLoginConnectToken     = "connect-token"
+	flagLoginConnectVaults    = "connect-vaults"
+	flagLoginExternalArgs     = "external-args"
+	flagLoginExternalCommand  = "external-command"
+	flagLoginExternalTimeout  = "external-timeout"
 	flagLoginFieldTitle       = "field-title"
+	flagLoginHCVaultAddr      = "hcvault-addr"
+	flagLoginHCVaultAppRole   = "hcvault-approle-mount"
+	flagLoginHCVaultKVMount   = "hcvault-kv-mount"
+	flagLoginHCVaultKVPath    = "hcvault-kv-path"
+	flagLoginHCVaultNamespace = "hcvault-namespace"
+	flagLoginHCVaultRoleID    = "hcvault-role-id"
+	flagLoginHCVaultSecretID  = "hcvault-secret-id"
+	flagLoginHCVaultToken     = "hcvault-token"
+	flagLoginHCVaultTOTPMount = "hcvault-totp-mount"
+	flagLoginKeePassFile      = "keepass-file"
+	flagLoginKeePassGroup     = "keepass-group"
+	flagLoginKeePassKeyFile   = "keepass-key-file"
+	flagLoginKeePassNoPass    = "keepass-no-password"
+	flagLoginKeePassOTP       = "keepass-otp-attribute"
+	flagLoginKeePassTag       = "keepass-tag"
+	flagLoginKeyringVault     = "keyring-vault"
+	flagLoginPassDir          = "pass-dir"
+	flagLoginPassSubtree      = "pass-subtree"
+	flagLoginPasswordFD       = "password-fd"
+	flagLoginPasswordStdin    = "password-stdin"
+	flagLoginProvider         = "provider"
+	flagLoginRefresh          = "refresh"
+	flagLoginSchemaFile       = "schema-file"
 	flagLoginSectionName      = "section-name"
 	flagLoginSessionDirectory = "session-directory"
 	flagLoginSessionFilename  = "session-filename"
+	flagLoginSessionIdle      = "session-idle-timeout"
+	flagLoginSessionKeyring   = "session-keyring"
+	flagLoginSessionStore     = "session-store"
+	flagLoginSigninAttempts   = "signin-attempts"
+	flagLoginVault            = "vault"
 	flagLoginVerbose          = "verbose"
 	flagLoginVersion          = "version"
 
+	// itemTag is the 1Password tag of the items holding AWS accounts
+	itemTag = "aws"
+
+	sessionStoreFile    = "file"
+	sessionStoreKeyring = "keyring"
+
 	browserChrome          = "chrome"
 	browserChromeIncognito = "chrome-incognito"
 	browserChromeCanary    = "chrome-canary"
@@ -41,6 +97,11 @@ const (
 	browserFirefox         = "firefox"
 
 	minVersionOP = "1.11.4"
+
+	// totpPeriod is the time window assumed for codes op generates
+	totpPeriod = 30 * time.Second
+	// totpMinRemaining is the least time a code may have left before waiting for the next window
+	totpMinRemaining = 5 * time.Second
 )
 
 var (
@@ -59,11 +120,48 @@ var (
 )
 
 func initLoginFlags(flag *pflag.FlagSet) {
+	flag.StringSlice(flagLoginAccounts, []string{}, "The shorthands of the 1Password accounts to search, each with its own session file")
 	flag.String(flagLoginBrowser, browserChrome, "The browser to open the Login URL")
+	flag.String(flagLoginProvider, provider.NameOnePassword, fmt.Sprintf("Where the AWS accounts and MFA seeds are kept: %s", strings.Join(provider.Names, ", ")))
+	flag.String(flagLoginPassDir, "", "The password store of the pass provider, defaults to PASSWORD_STORE_DIR or ~/.password-store")
+	flag.String(flagLoginPassSubtree, pass.DefaultSubtree, "The directory of the password store holding the AWS entries")
+	flag.String(flagLoginKeePassFile, "", "The KeePass database of the keepass provider")
+	flag.String(flagLoginKeePassKeyFile, "", "The key file the KeePass database is locked with")
+	flag.Bool(flagLoginKeePassNoPass, false, "Open the KeePass database with the key file alone")
+	flag.String(flagLoginKeePassGroup, "", "The path of the KeePass group holding the AWS entries, e.g. AWS/GovCloud, defaults to every group")
+	flag.String(flagLoginKeePassTag, "", "The tag of the KeePass entries holding AWS accounts, defaults to every entry")
+	flag.String(flagLoginKeePassOTP, keepass.DefaultOTPAttribute, "The KeePass attribute holding the one-time password seed")
+	flag.String(flagLoginBwFolder, "", "The name or ID of the Bitwarden folder holding the AWS items of the bw provider")
+	flag.String(flagLoginBwCollection, "", "The name or ID of the Bitwarden collection holding the AWS items, defaults with no folder to every item with an alias field")
+	flag.String(flagLoginHCVaultAddr, "", "The URL of the HashiCorp Vault server of the vault provider, also read from VAULT_ADDR")
+	flag.String(flagLoginHCVaultToken, "", "The Vault token, also read from VAULT_TOKEN or ~/.vault-token")
+	flag.String(flagLoginHCVaultRoleID, "", "The AppRole role ID to log in to Vault with when there is no token")
+	flag.String(flagLoginHCVaultSecretID, "", "The AppRole secret ID to log in to Vault with when there is no token")
+	flag.String(flagLoginHCVaultAppRole, hcvault.DefaultAppRoleAuth, "The mount of the Vault AppRole auth method")
+	flag.String(flagLoginHCVaultNamespace, "", "The Vault Enterprise namespace, also read from VAULT_NAMESPACE")
+	flag.String(flagLoginHCVaultKVMount, hcvault.DefaultKVMount, "The mount of the Vault KV version 2 engine holding the AWS accounts")
+	flag.String(flagLoginHCVaultKVPath, hcvault.DefaultPath, "The path of the Vault KV engine holding the AWS accounts")
+	flag.String(flagLoginHCVaultTOTPMount, hcvault.DefaultTOTPMount, "The mount of the Vault TOTP engine generating the one-time passwords")
+	flag.String(flagLoginExternalCommand, "", "The executable answering the requests of the external provider")
+	flag.StringSlice(flagLoginExternalArgs, []string{}, "The arguments of the external provider executable")
+	flag.Duration(flagLoginExternalTimeout, external.DefaultTimeout, "How long the external provider may take to answer a request")
+	flag.String(flagLoginKeyringVault, "", "The 1Password vault to keep the aws-vault credentials and sessions in instead of the aws-vault keyring")
+	flag.String(flagLoginConnectHost, "", "The URL of a 1Password Connect server to use instead of the op command")
+	flag.String(flagLoginConnectToken, "", "The 1Password Connect token, also read from OP_CONNECT_TOKEN")
+	flag.StringSlice(flagLoginConnectVaults, []string{}, "The 1Password Connect vault IDs to search, defaults to all vaults the token can read")
+	flag.String(flagLoginSchemaFile, "", "A YAML, JSON or TOML file naming the 1Password fields that hold each account setting")
 	flag.String(flagLoginSectionName, "ACCOUNT_INFO", "The 1Password section name used to identify AWS Account Info")
 	flag.String(flagLoginFieldTitle, "ACCOUNT_ALIAS", "The 1Password field title used to identify AWS Account Alias")
+	flag.Bool(flagLoginPasswordStdin, false, "Read the 1Password password from stdin, one line per account")
+	flag.Int(flagLoginPasswordFD, -1, "Read the 1Password password from this file descriptor, one line per account")
+	flag.Int(flagLoginSigninAttempts, op.DefaultSigninAttempts, "How many times to ask for the 1Password password before giving up")
+	flag.Bool(flagLoginRefresh, false, "List the 1Password items again instead of starting from the cached list")
 	flag.String(flagLoginSessionDirectory, HOMEDIR, "The path of the directory to hold the session information")
 	flag.String(flagLoginSessionFilename, SESSION_FILE, "The name of the file to retain session information")
+	flag.Duration(flagLoginSessionIdle, op.DefaultIdleTimeout, "How long after its last use the 1Password session is trusted without checking it, 0 always checks")
+	flag.String(flagLoginSessionStore, sessionStoreKeyring, fmt.Sprintf("Where to keep the 1Password session: %q or %q", sessionStoreKeyring, sessionStoreFile))
+	flag.String(flagLoginSessionKeyring, "", "The keyring backend holding the 1Password session, e.g. keychain, secret-service or file (defaults to the first available)")
+	flag.StringSlice(flagLoginVault, []string{}, "The 1Password vault names or UUIDs to search, defaults to all vaults")
 	flag.Bool(flagLoginVersion, false, "Display the version information and exit")
 	flag.Bool(flagLoginVerbose, false, "Use verbose output")
 }
@@ -73,6 +171,30 @@ func checkLoginConfig(v *viper.Viper) error {
 	if _, ok := browserToPath[browser]; !ok {
 		return fmt.Errorf("Given browser %q is not an option\n", browser)
 	}
+	if !isProvider(v.GetString(flagLoginProvider)) {
+		return fmt.Errorf("Given provider %q is not an option\n", v.GetString(flagLoginProvider))
+	}
+	if v.GetString(flagLoginProvider) == provider.NameKeePass && len(v.GetString(flagLoginKeePassFile)) == 0 {
+		return errors.New("The keepass provider needs the database given with --keepass-file")
+	}
+	if v.GetBool(flagLoginKeePassNoPass) && len(v.GetString(flagLoginKeePassKeyFile)) == 0 {
+		return errors.New("A KeePass database without a password needs the key file given with --keepass-key-file")
+	}
+	if v.GetString(flagLoginProvider) == provider.NameVault && len(v.GetString(flagLoginHCVaultAddr)) == 0 {
+		return errors.New("The vault provider needs the server given with --hcvault-addr or VAULT_ADDR")
+	}
+	if v.GetString(flagLoginProvider) == provider.NameExternal && len(v.GetString(flagLoginExternalCommand)) == 0 {
+		return errors.New("The external provider needs the executable given with --external-command")
+	}
+	if len(v.GetString(flagLoginHCVaultRoleID)) > 0 && len(v.GetString(flagLoginHCVaultSecretID)) == 0 {
+		return errors.New("Logging in to Vault with AppRole needs the secret ID given with --hcvault-secret-id")
+	}
+	if len(v.GetString(flagLoginKeyringVault)) > 0 && (v.GetString(flagLoginProvider) != provider.NameOnePassword || len(v.GetString(flagLoginConnectHost)) > 0) {
+		return errors.New("The 1Password keyring given with --keyring-vault needs the op provider without a Connect server")
+	}
+	if len(v.GetString(flagLoginConnectHost)) > 0 && len(v.GetString(flagLoginConnectToken)) == 0 {
+		return fmt.Errorf("A token is required when using the 1Password Connect server %q\n", v.GetString(flagLoginConnectHost))
+	}
 	sessionDirectory := v.GetString(flagLoginSessionDirectory)
 	if sessionDirectory == HOMEDIR {
 		homedir, errUserHomeDir := os.UserHomeDir()
@@ -88,24 +210,27 @@ func checkLoginConfig(v *viper.Viper) error {
 	if len(sessionFilename) == 0 {
 		return errors.New("The session filename should not be empty")
 	}
+	sessionStore := v.GetString(flagLoginSessionStore)
+	if sessionStore != sessionStoreKeyring && sessionStore != sessionStoreFile {
+		return fmt.Errorf("Given session store %q is not an option\n", sessionStore)
+	}
+	if v.GetInt(flagLoginSigninAttempts) < 1 {
+		return errors.New("At least one signin attempt is needed")
+	}
+	if v.GetDuration(flagLoginSessionIdle) < 0 {
+		return errors.New("The session idle timeout should not be negative")
+	}
+	if v.GetBool(flagLoginPasswordStdin) && v.GetInt(flagLoginPasswordFD) >= 0 {
+		return errors.New("The password can be read from stdin or a file descriptor but not both")
+	}
 	return nil
 }
 
-// preCheck will return an error if prerequisites are not met
-func preCheck(commandName string, commandArgs []string, expected string) error {
-
-	commandPath, errEvalSymlinks := filepath.EvalSymlinks(commandName)
-	if errEvalSymlinks != nil {
-		return errEvalSymlinks
-	}
-	versionCommand := exec.Command(commandPath, commandArgs...)
-	actual, errOutput := versionCommand.CombinedOutput()
-	if errOutput != nil {
-		return fmt.Errorf("Unable to call version command for %q with args %v: %w", commandName, commandArgs, errOutput)
-	}
-	actualStr := strings.TrimSpace(string(actual))
+// preCheck will return an error if the version reported by the command is older than expected
+func preCheck(commandName string, actual string, expected string) error {
+	actualStr := strings.TrimSpace(actual)
 	if len(actualStr) == 0 {
-		return fmt.Errorf("No output returned for version command for %q with args %v", commandName, commandArgs)
+		return fmt.Errorf("No output returned for version command for %q", commandName)
 	}
 	// Prefix with 'v' for comparison sake
 	if actualStr[0] != 'v' {
@@ -130,6 +255,29 @@ func login(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("error initializing viper: %w\n", errViper)
 	}
 
+	// Allow the standard 1Password Connect env vars to be used
+	errBindEnv := v.BindEnv(flagLoginConnectHost, "AWSLOGIN_CONNECT_HOST", "OP_CONNECT_HOST")
+	if errBindEnv != nil {
+		return errBindEnv
+	}
+	errBindEnv = v.BindEnv(flagLoginConnectToken, "AWSLOGIN_CONNECT_TOKEN", "OP_CONNECT_TOKEN")
+	if errBindEnv != nil {
+		return errBindEnv
+	}
+	// Allow the standard Vault env vars to be used
+	errBindEnv = v.BindEnv(flagLoginHCVaultAddr, "AWSLOGIN_HCVAULT_ADDR", "VAULT_ADDR")
+	if errBindEnv != nil {
+		return errBindEnv
+	}
+	errBindEnv = v.BindEnv(flagLoginHCVaultToken, "AWSLOGIN_HCVAULT_TOKEN", "VAULT_TOKEN")
+	if errBindEnv != nil {
+		return errBindEnv
+	}
+	errBindEnv = v.BindEnv(flagLoginHCVaultNamespace, "AWSLOGIN_HCVAULT_NAMESPACE", "VAULT_NAMESPACE")
+	if errBindEnv != nil {
+		return errBindEnv
+	}
+
 	if v.GetBool(flagLoginVersion) {
 		fmt.Println(version.Full())
 		return nil
@@ -139,10 +287,20 @@ func login(cmd *cobra.Command, args []string) error {
 		return errConfig
 	}
 
+	providerName := v.GetString(flagLoginProvider)
+	connectHost := v.GetString(flagLoginConnectHost)
+
 	// Confirm that the minimum version is met for these tools
-	errPreCheck := preCheck("/usr/local/bin/op", []string{"--version"}, minVersionOP)
-	if errPreCheck != nil {
-		return errPreCheck
+	if providerName == provider.NameOnePassword && len(connectHost) == 0 {
+		// The version is read once and reused to choose the syntax of the op commands
+		opVersion, errGetVersion := op.GetVersion(context.Background())
+		if errGetVersion != nil {
+			return fmt.Errorf("Unable to call version command for %q: %w", "op", errGetVersion)
+		}
+		errPreCheck := preCheck("op", *opVersion, minVersionOP)
+		if errPreCheck != nil {
+			return errPreCheck
+		}
 	}
 
 	// AWS_PROFILE is a special env var which can be used to immediately log in
@@ -162,9 +320,10 @@ func login(cmd *cobra.Command, args []string) error {
 
 	// Handle Flags
 	browser := v.GetString(flagLoginBrowser)
-	browserPath := browserToPath[browser]
-	sectionName := v.GetString(flagLoginSectionName)
-	fieldTitle := v.GetString(flagLoginFieldTitle)
+	schema, errLoadSchema := loadSchema(v.GetString(flagLoginSchemaFile), defaultSchema(v.GetString(flagLoginSectionName), v.GetString(flagLoginFieldTitle)))
+	if errLoadSchema != nil {
+		return errLoadSchema
+	}
 	sessionDirectory := v.GetString(flagLoginSessionDirectory)
 	sessionFilename := v.GetString(flagLoginSessionFilename)
 	verbose := v.GetBool(flagLoginVerbose)
@@ -179,94 +338,575 @@ func login(cmd *cobra.Command, args []string) error {
 	}
 	sessionPath := path.Join(sessionDirectory, sessionFilename)
 
+	// The aws-vault keyring and config are opened while the 1Password client loads its sessions
 	awsVault := &cli.AwsVault{}
-	keyring, err := awsVault.Keyring()
-	if err != nil {
-		return err
+	keyringVault := v.GetString(flagLoginKeyringVault)
+	var awsKeyring keyring.Keyring
+	var awsConfigFile *vault.ConfigFile
+	var group errgroup.Group
+	group.Go(func() error {
+		// The 1Password keyring replaces the aws-vault one, which isn't opened so it never asks for a passphrase
+		if len(keyringVault) == 0 {
+			var errKeyring error
+			awsKeyring, errKeyring = awsVault.Keyring()
+			if errKeyring != nil {
+				return errKeyring
+			}
+		}
+		var errAwsConfigFile error
+		awsConfigFile, errAwsConfigFile = awsVault.AwsConfigFile()
+		return errAwsConfigFile
+	})
+
+	// The password and the menu choice share stdin when the password is read from it
+	stdin := bufio.NewReader(os.Stdin)
+	client, errNewProvider := newProvider(v, sessionPath, stdin, schema)
+	errGroup := group.Wait()
+	if errNewProvider != nil {
+		return errNewProvider
+	}
+	if errGroup != nil {
+		return errGroup
+	}
+	if len(keyringVault) > 0 {
+		keyringConfig, errKeyringConfig := opKeyringConfig(client)
+		if errKeyringConfig != nil {
+			return errKeyringConfig
+		}
+		awsKeyring = op.NewKeyring(keyringConfig, keyringVault)
 	}
 
-	awsConfigFile, err := awsVault.AwsConfigFile()
-	if err != nil {
-		return err
+	flow := &loginFlow{
+		client:      client,
+		sessionPath: sessionPath,
+		schema:      schema,
+		verbose:     verbose,
+		stdin:       stdin,
+		stdout:      os.Stdout,
+		now:         time.Now,
+		sleep:       sleepContext,
+		getSessions: func() (map[string]time.Duration, error) {
+			return awsvault.GetSessions(awsConfigFile, awsKeyring)
+		},
+		getLoginURL: func(settings *accountSettings, mfaToken string) (*string, error) {
+			return awsvault.GetLoginURLWithOptions(settings.Profile, mfaToken, settings.loginOptions(), awsConfigFile, awsKeyring)
+		},
+		getMfaSerial: func(profile string) (string, error) {
+			return awsvault.GetMfaSerial(profile, awsConfigFile)
+		},
+		keyringSignin: len(keyringVault) > 0,
 	}
 
-	// See if an active session exists already
-	profileSessions, err := awsvault.GetSessions(awsConfigFile, keyring)
-	if err != nil {
-		return err
+	// The first Ctrl-C kills any running op command and a second one exits straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	loginURL, settings, errRun := flow.run(ctx, accountAlias, filters)
+	if errRun != nil {
+		if providerName != provider.NameOnePassword {
+			return errRun
+		}
+		return explainError(errRun)
+	}
+
+	// The item may prefer another browser to the one given by the flags
+	if len(settings.Browser) > 0 {
+		browser = settings.Browser
+	}
+	browserPath := browserToPath[browser]
+
+	// Create the commands to use
+	command := exec.Command(browserPath[0], append(browserPath[1:], *loginURL)...)
+
+	errStart := command.Start()
+	if errStart != nil {
+		return errStart
+	}
+
+	// The cached item list refreshed while the menu was shown is saved for the next run
+	if cached, ok := client.(*op.CachedClient); ok {
+		_ = cached.Wait(ctx)
+	}
+
+	return nil
+}
+
+// newClient returns the 1Password client chosen by the flags, loading any saved sessions
+func newClient(v *viper.Viper, sessionPath string, stdin *bufio.Reader) (op.Client, error) {
+	vaults := stringList(v, flagLoginVault)
+	if connectHost := v.GetString(flagLoginConnectHost); len(connectHost) > 0 {
+		connectVaults := append(stringList(v, flagLoginConnectVaults), vaults...)
+		return op.NewConnect(connectHost, v.GetString(flagLoginConnectToken), connectVaults), nil
+	}
+	base := &op.Config{
+		Vaults:         vaults,
+		SigninAttempts: v.GetInt(flagLoginSigninAttempts),
+		IdleTimeout:    v.GetDuration(flagLoginSessionIdle),
+	}
+	if token := os.Getenv(op.EnvServiceAccountToken); len(token) > 0 {
+		config := op.NewServiceAccount(token)
+		config.CopySettings(base)
+		return config, nil
+	}
+
+	password, errPasswordFunc := passwordFunc(v, stdin)
+	if errPasswordFunc != nil {
+		return nil, errPasswordFunc
+	}
+	if password != nil {
+		// A password given by a script won't be any different when asked for again
+		base.Password = password
+		base.SigninAttempts = 1
+	}
+
+	accounts := stringList(v, flagLoginAccounts)
+	store, errOpenSessionStore := openSessionStore(v, sessionPath, accounts)
+	if errOpenSessionStore != nil {
+		return nil, errOpenSessionStore
+	}
+	var client op.Client
+	if len(accounts) > 0 {
+		multi, errNewMultiClient := op.NewMultiClient(store, sessionPath, accounts, base)
+		if errNewMultiClient != nil {
+			return nil, errNewMultiClient
+		}
+		client = multi
+	} else {
+		config, errLoadSession := op.LoadSession(store, sessionPath)
+		if errLoadSession != nil {
+			return nil, errLoadSession
+		}
+		config.CopySettings(base)
+		client = config
+	}
+
+	// The item list is only cached where the session is, so the aliases are kept as safe as the session
+	if catalogStore, ok := store.(op.CatalogStore); ok {
+		return op.NewCachedClient(client, catalogStore, sessionPath, accounts, vaults, v.GetBool(flagLoginRefresh)), nil
+	}
+	return client, nil
+}
+
+// stringList returns the comma separated values of a list flag. Viper splits the value of an environment
+// variable on whitespace instead, which breaks up names holding spaces, so it is split on commas here.
+func stringList(v *viper.Viper, key string) []string {
+	value, ok := v.Get(key).(string)
+	if !ok {
+		return v.GetStringSlice(key)
+	}
+	values := []string{}
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); len(part) > 0 {
+			values = append(values, part)
+		}
+	}
+	return values
+}
+
+// passwordFunc returns how the 1Password password is read when it comes from stdin or a file descriptor
+// instead of the terminal, reading one line each time it is asked for
+func passwordFunc(v *viper.Viper, stdin *bufio.Reader) (func(string) (string, error), error) {
+	var reader *bufio.Reader
+	if v.GetBool(flagLoginPasswordStdin) {
+		reader = stdin
+	} else if fd := v.GetInt(flagLoginPasswordFD); fd >= 0 {
+		file := os.NewFile(uintptr(fd), "password")
+		if file == nil {
+			return nil, fmt.Errorf("The password file descriptor %d is not valid", fd)
+		}
+		reader = bufio.NewReader(file)
+	} else {
+		return nil, nil
+	}
+
+	return func(string) (string, error) {
+		line, errReadString := reader.ReadString('\n')
+		if errReadString != nil && (errReadString != io.EOF || len(line) == 0) {
+			return "", fmt.Errorf("Unable to read the 1Password password: %w", errReadString)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}, nil
+}
+
+// openSessionStore opens the session store and moves any plaintext session files into it
+func openSessionStore(v *viper.Viper, sessionPath string, accounts []string) (op.SessionStore, error) {
+	if v.GetString(flagLoginSessionStore) == sessionStoreFile {
+		return op.FileStore{}, nil
+	}
+	store, errOpenKeyringStore := op.OpenKeyringStore(v.GetString(flagLoginSessionKeyring))
+	if errOpenKeyringStore != nil {
+		return nil, errOpenKeyringStore
+	}
+
+	sessionFilenames := []string{sessionPath}
+	for _, account := range accounts {
+		sessionFilenames = append(sessionFilenames, op.SessionFilename(sessionPath, account))
+	}
+	for _, sessionFilename := range sessionFilenames {
+		migrated, errMigrate := op.MigrateSessionFile(sessionFilename, store)
+		if errMigrate != nil {
+			return nil, fmt.Errorf("Unable to move the session file %q into the keyring: %w", sessionFilename, errMigrate)
+		}
+		if migrated {
+			fmt.Printf("1Password session file %s moved to: %s\n", sessionFilename, store.Location(sessionFilename))
+		}
+	}
+	return store, nil
+}
+
+// loginFlow holds the dependencies of the login flow so it can run without 1Password, AWS or a terminal
+type loginFlow struct {
+	client      provider.Provider
+	sessionPath string
+	schema      itemSchema
+	verbose     bool
+	// stdin is shared with the password read by a scripted sign-in, so every line is read from its buffer
+	stdin       *bufio.Reader
+	stdout      io.Writer
+	now         func() time.Time
+	sleep       func(context.Context, time.Duration) error
+	getSessions func() (map[string]time.Duration, error)
+	getLoginURL func(settings *accountSettings, mfaToken string) (*string, error)
+	// getMfaSerial returns the MFA device of the profile, and is nil when the profiles aren't known
+	getMfaSerial func(profile string) (string, error)
+	// keyringSignin is set when the aws-vault keyring is kept in 1Password, so reading the sessions needs the
+	// 1Password session too
+	keyringSignin bool
+
+	// sessionSource is where the 1Password session was last found
+	sessionSource string
+	// prefetched is a one-time password fetched alongside the item details
+	prefetched *fetchedTotp
+}
+
+// run chooses the account and returns the AWS console login URL for it
+func (flow *loginFlow) run(ctx context.Context, accountAlias string, filters []string) (*string, *accountSettings, error) {
+	// The aws-vault sessions are read in the background and a failure there stops the 1Password steps
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Reading the sessions from a keyring kept in 1Password would ask for the password at the same time as
+	// the steps below, so the 1Password session is ensured before they start
+	if flow.keyringSignin {
+		errEnsureSession := flow.ensureSession(ctx)
+		if errEnsureSession != nil {
+			return nil, nil, errEnsureSession
+		}
 	}
+	sessions := flow.loadSessions(cancel)
 
-	var loginURL *string
-	var errGetLoginURL error
-	var title string
+	// The chosen item is carried through so the TOTP comes from exactly the item that was shown
+	var item *op.Item
+	var settings *accountSettings
+	// totpItem is the item holding the one-time password, which is usually the chosen item
+	var totpItem *op.Item
 
 	if len(accountAlias) == 0 {
-		config, errCheckSession := op.CheckSession(sessionPath)
-		if errCheckSession != nil {
-			return errCheckSession
+		errEnsureSession := flow.ensureSession(ctx)
+		if errEnsureSession != nil {
+			return nil, nil, sessions.explain(errEnsureSession)
 		}
 
 		var errChooseAccountAlias error
-		title, accountAlias, errChooseAccountAlias = chooseAccountAlias(config, sectionName, fieldTitle, filters)
+		item, settings, errChooseAccountAlias = flow.chooseAccountAlias(ctx, filters, sessions)
 		if errChooseAccountAlias != nil {
-			return errChooseAccountAlias
+			return nil, nil, sessions.explain(errChooseAccountAlias)
 		}
+	} else {
+		settings = aliasSettings(accountAlias)
 	}
 
-	sessionDuration, ok := profileSessions[accountAlias]
+	// A given account alias waits for the sessions before using 1Password, which may ask for a password
+	// that an active session makes unnecessary
+	profileSessions, err := sessions.wait(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// If no active session or the session duration is negative then get the OTP again
-	if ok && sessionDuration > 0 {
-		loginURL, errGetLoginURL = awsvault.GetLoginURL(accountAlias, "", awsConfigFile, keyring)
-		if errGetLoginURL != nil {
-			return errGetLoginURL
+	var oneTimePassword string
+	if !hasActiveSession(profileSessions, settings.Profile) {
+		errEnsureSession := flow.ensureSession(ctx)
+		if errEnsureSession != nil {
+			return nil, nil, errEnsureSession
 		}
-	} else {
-		config, errCheckSession := op.CheckSession(sessionPath)
-		if errCheckSession != nil {
-			return errCheckSession
+		// The one-time password belongs to the MFA device of the profile, which for a chained role may be
+		// held by another item than the chosen one
+		var errFindMfaItem error
+		totpItem, errFindMfaItem = flow.findMfaItem(ctx, settings.Profile, item)
+		if errFindMfaItem != nil {
+			return nil, nil, errFindMfaItem
 		}
-		// A safety switch to ensure a title exists
-		if len(title) == 0 && len(accountAlias) > 0 {
-			title = fmt.Sprintf("AWS %s", accountAlias)
+		// The settings of a given alias come from the matching item only when it is the item of the alias
+		if alias, _ := flow.itemField(totpItem, flow.schema.Fields.Alias); item == nil && len(alias) > 0 && alias == accountAlias {
+			var errItemSettings error
+			settings, errItemSettings = flow.aliasItemSettings(totpItem, accountAlias)
+			if errItemSettings != nil {
+				return nil, nil, errItemSettings
+			}
 		}
-		totp, errGetTotp := config.GetTotp(title)
-		if errGetTotp != nil {
-			return errGetTotp
+		// Without a matching MFA device a given alias falls back to the item titled after it
+		if totpItem == nil && item == nil && len(accountAlias) > 0 {
+			listed, errFindItem := flow.findItem(ctx, flow.aliasTitle(accountAlias))
+			if errFindItem != nil {
+				return nil, nil, errFindItem
+			}
+			var errFetchItem error
+			item, errFetchItem = flow.fetchItem(ctx, listed, alwaysTotp)
+			if errFetchItem != nil {
+				return nil, nil, errFetchItem
+			}
+			var errItemSettings error
+			settings, errItemSettings = flow.aliasItemSettings(item, accountAlias)
+			if errItemSettings != nil {
+				return nil, nil, errItemSettings
+			}
 		}
+		if totpItem == nil {
+			totpItem = item
+		}
+		if flow.verbose && totpItem != item {
+			fmt.Fprintf(flow.stdout, "MFA Device: %s\n", totpItem.Overview.Title)
+		}
+		var errOneTimePassword error
+		oneTimePassword, errOneTimePassword = flow.oneTimePassword(ctx, totpItem, false)
+		if errOneTimePassword != nil {
+			return nil, nil, errOneTimePassword
+		}
+		if flow.verbose {
+			fmt.Fprintf(flow.stdout, "MFA Token: %s\n", oneTimePassword)
+		}
+	}
 
-		oneTimePassword := strings.TrimSpace(*totp)
-		if verbose {
-			fmt.Printf("MFA Token: %s\n", oneTimePassword)
+	loginURL, errGetLoginURL := flow.getLoginURL(settings, oneTimePassword)
+	if errGetLoginURL != nil && len(oneTimePassword) > 0 && isTotpReused(errGetLoginURL) {
+		// AWS rejects a code that was used moments ago, so retry once with the code of the next window
+		fmt.Fprintln(flow.stdout, "The one-time password was already used, retrying with the next one")
+		var errOneTimePassword error
+		oneTimePassword, errOneTimePassword = flow.oneTimePassword(ctx, totpItem, true)
+		if errOneTimePassword != nil {
+			return nil, nil, errOneTimePassword
+		}
+		if flow.verbose {
+			fmt.Fprintf(flow.stdout, "MFA Token: %s\n", oneTimePassword)
 		}
+		loginURL, errGetLoginURL = flow.getLoginURL(settings, oneTimePassword)
+	}
+	if errGetLoginURL != nil {
+		return nil, nil, errGetLoginURL
+	}
 
-		loginURL, errGetLoginURL = awsvault.GetLoginURL(accountAlias, oneTimePassword, awsConfigFile, keyring)
-		if errGetLoginURL != nil {
-			return errGetLoginURL
+	if flow.verbose {
+		fmt.Fprintf(flow.stdout, "Account Alias: %s\n", settings.Alias)
+		if settings.Profile != settings.Alias {
+			fmt.Fprintf(flow.stdout, "AWS Profile: %s\n", settings.Profile)
 		}
 	}
 
-	if verbose {
-		fmt.Printf("Account Alias: %s\n", accountAlias)
+	return loginURL, settings, nil
+}
+
+// aliasItemSettings returns the settings of the item fetched for an account alias given up front, which
+// only has the alias when the item doesn't carry the settings section
+func (flow *loginFlow) aliasItemSettings(item *op.Item, accountAlias string) (*accountSettings, error) {
+	hasSection := false
+	for _, section := range item.Details.Sections {
+		hasSection = hasSection || section.Title == flow.schema.Section
+	}
+	if !hasSection {
+		return aliasSettings(accountAlias), nil
 	}
+	settings, errParse := parseSettings(item, flow.schema)
+	if errParse != nil {
+		return nil, errParse
+	}
+	// The alias was given as the aws-vault profile so it is kept
+	settings.Alias, settings.Profile = accountAlias, accountAlias
+	return settings, nil
+}
 
-	// Create the commands to use
-	command := exec.Command(browserPath[0], append(browserPath[1:], *loginURL)...)
+// ensureSession confirms the 1Password session is active once per run, reporting where it came from in
+// verbose mode. A session that expires later in the run is signed in again by the command that finds out.
+// Providers other than 1Password have no session to check.
+func (flow *loginFlow) ensureSession(ctx context.Context) error {
+	client, ok := flow.client.(op.Client)
+	if !ok || len(flow.sessionSource) > 0 {
+		return nil
+	}
+	source, errEnsureSession := op.EnsureSession(ctx, client, flow.sessionPath)
+	if errEnsureSession != nil {
+		return errEnsureSession
+	}
+	if flow.verbose {
+		fmt.Fprintf(flow.stdout, "1Password session from the %s\n", source)
+	}
+	flow.sessionSource = source
+	return nil
+}
 
-	errStart := command.Start()
-	if errStart != nil {
-		return errStart
+// oneTimePassword generates the code from the otpauth seed of a fetched item, asking 1Password for it
+// when the item has no usable seed. It waits for the next time window when the current code is about
+// to expire or when nextWindow is set.
+func (flow *loginFlow) oneTimePassword(ctx context.Context, item *op.Item, nextWindow bool) (string, error) {
+	var key *totp.Key
+	if secret, ok := item.OTPSecret(); ok {
+		var errParse error
+		key, errParse = totp.Parse(secret)
+		if errParse != nil && flow.verbose {
+			fmt.Fprintf(flow.stdout, "Unable to use the one-time password seed of %q: %v\n", item.Overview.Title, errParse)
+		}
+	}
+
+	period := totpPeriod
+	if key != nil {
+		period = key.Period
+	}
+	now := flow.now()
+	remaining := period - time.Duration(now.UnixNano()%int64(period))
+	if nextWindow || remaining < totpMinRemaining {
+		errCountdown := flow.countdown(ctx, remaining)
+		if errCountdown != nil {
+			return "", errCountdown
+		}
+		now = now.Add(remaining)
 	}
+	if key != nil {
+		return key.Generate(now), nil
+	}
+
+	prefetched := flow.prefetched
+	flow.prefetched = nil
+	if prefetched != nil && prefetched.ref == itemRef(item) && prefetched.window == totpWindow(now, period) {
+		return prefetched.code, nil
+	}
+
+	code, errGetTotp := flow.client.GetTotp(ctx, itemRef(item))
+	if errGetTotp != nil {
+		return "", errGetTotp
+	}
+	return strings.TrimSpace(*code), nil
+}
 
+// countdown waits for the given time while showing the seconds left
+func (flow *loginFlow) countdown(ctx context.Context, wait time.Duration) error {
+	for wait > 0 {
+		fmt.Fprintf(flow.stdout, "\rWaiting %ds for the next one-time password ", int(math.Ceil(wait.Seconds())))
+		step := time.Second
+		if wait < step {
+			step = wait
+		}
+		if errSleep := flow.sleep(ctx, step); errSleep != nil {
+			fmt.Fprintln(flow.stdout)
+			return errSleep
+		}
+		wait -= step
+	}
+	fmt.Fprintln(flow.stdout)
 	return nil
 }
 
-func chooseAccountAlias(config *op.Config, sectionName, fieldTitle string, filters []string) (string, string, error) {
+// sleepContext waits for the duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
 
-	tags := "aws"
-	items, errListItems := config.ListItems(tags)
+// readLine reads a line from r, giving up once the context is done. The line is read from r itself so the
+// lines after it stay buffered for the next read, such as a password given on stdin after the menu choice.
+// A read that is given up on is left blocked until a line arrives, which is only done when the run is
+// cancelled and stdin isn't read again.
+func readLine(ctx context.Context, r *bufio.Reader) (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	lines := make(chan result, 1)
+	go func() {
+		line, err := r.ReadString('\n')
+		lines <- result{line: line, err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case read := <-lines:
+		return read.line, read.err
+	}
+}
+
+// explainError adds what the user can do next to the 1Password failures that have a known fix
+func explainError(err error) error {
+	var hint string
+	switch {
+	case errors.Is(err, op.ErrNotSignedIn):
+		hint = "Sign in with `op signin` or check the session token and try again"
+	case errors.Is(err, op.ErrAmbiguousItem):
+		hint = "Use a more specific filter or limit the search with --vault"
+	case errors.Is(err, op.ErrItemNotFound):
+		hint = fmt.Sprintf("Check the item is tagged %q and titled \"AWS <account alias>\"", itemTag)
+	case errors.Is(err, op.ErrAccountNotFound):
+		hint = "Check the shorthands given with --accounts or add the account with `op account add`"
+	default:
+		return err
+	}
+	return fmt.Errorf("%w\n%s", err, hint)
+}
+
+// isTotpReused reports whether AWS rejected the one-time password because it was used already
+func isTotpReused(err error) bool {
+	return strings.Contains(err.Error(), "MultiFactorAuthentication failed") && strings.Contains(err.Error(), "already used")
+}
+
+// findItem returns the item with exactly the given title so it can be fetched by UUID.
+// Titles that aren't listed are still looked up by title and titles shared by several items are an error.
+func (flow *loginFlow) findItem(ctx context.Context, title string) (*op.Item, error) {
+	items, errListItems := flow.client.ListItems(ctx, itemTag)
 	if errListItems != nil {
-		return "", "", errListItems
+		return nil, errListItems
+	}
+
+	matches := []op.Item{}
+	for _, item := range items {
+		if item.Overview.Title == title {
+			matches = append(matches, item)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return &op.Item{Overview: op.Overview{Title: title}}, nil
+	case 1:
+		return &matches[0], nil
+	}
+
+	duplicates := []string{}
+	for i, label := range menuLabels(matches) {
+		duplicates = append(duplicates, fmt.Sprintf("  %s %s", matches[i].Uuid, label))
+	}
+	return nil, fmt.Errorf("More than one item is titled %q:\n%s\nChoose one of them with a filter instead of the account alias", title, strings.Join(duplicates, "\n"))
+}
+
+// itemRef returns the UUID used to fetch the item, falling back to the title for items that weren't listed
+func itemRef(item *op.Item) string {
+	if len(item.Uuid) > 0 {
+		return item.Uuid
+	}
+	return item.Overview.Title
+}
+
+// chooseAccountAlias lets the user choose an item and returns it along with the account settings it holds
+func (flow *loginFlow) chooseAccountAlias(ctx context.Context, filters []string, sessions *backgroundSessions) (*op.Item, *accountSettings, error) {
+
+	items, errListItems := flow.client.ListItems(ctx, itemTag)
+	if errListItems != nil {
+		return nil, nil, errListItems
 	}
 
 	// Filter the items first
@@ -289,48 +929,105 @@ func chooseAccountAlias(config *op.Config, sectionName, fieldTitle string, filte
 		return newItemList[i].Overview.Title < newItemList[j].Overview.Title
 	})
 
-	var title string
+	var chosen op.Item
 	if len(newItemList) > 1 {
-		for num, item := range newItemList {
-			fmt.Println(num, item.Overview.Title)
+		for num, label := range menuLabels(newItemList) {
+			fmt.Fprintln(flow.stdout, num, label)
 		}
 
-		fmt.Printf("\nChoose the account number: ")
-		reader := bufio.NewReader(os.Stdin)
-		choice, errReadString := reader.ReadString('\n')
+		fmt.Fprintf(flow.stdout, "\nChoose the account number: ")
+		choice, errReadString := readLine(ctx, flow.stdin)
 		if errReadString != nil {
-			return "", "", errReadString
+			return nil, nil, errReadString
 		}
 		numChoice, errAtoi := strconv.Atoi(strings.TrimSpace(choice))
 		if errAtoi != nil {
-			return "", "", errAtoi
+			return nil, nil, errAtoi
+		}
+		if numChoice < 0 || numChoice >= len(newItemList) {
+			return nil, nil, fmt.Errorf("The choice %d isn't one of the listed accounts", numChoice)
 		}
-		title = newItemList[numChoice].Overview.Title
-		fmt.Printf("\nChosen account: %s\n\n", title)
+		chosen = newItemList[numChoice]
+		fmt.Fprintf(flow.stdout, "\nChosen account: %s\n\n", chosen.Overview.Title)
 	} else if len(newItemList) == 1 {
-		title = newItemList[0].Overview.Title
+		chosen = newItemList[0]
 	} else {
-		return "", "", fmt.Errorf("No entries were found using filters %v\n", filters)
+		return nil, nil, fmt.Errorf("No entries were found using filters %v\n", filters)
 	}
 
-	item, errGetItem := config.GetItem(title)
-	if errGetItem != nil {
-		return "", "", errGetItem
+	// The details are fetched right away while the one-time password waits on the sessions and on the
+	// profile the details resolve, as it is only needed without an active session of that profile
+	var needsTotp totpCheck
+	if sessions != nil {
+		needsTotp = func(ctx context.Context, details func(context.Context) (*op.Item, error)) (bool, error) {
+			profileSessions, errWait := sessions.wait(ctx)
+			if errWait != nil {
+				return false, errWait
+			}
+			item, errDetails := details(ctx)
+			if errDetails != nil {
+				return false, errDetails
+			}
+			settings, errParseSettings := parseSettings(item, flow.schema)
+			if errParseSettings != nil {
+				// The settings are parsed again below, which reports the problem
+				return false, nil
+			}
+			return !hasActiveSession(profileSessions, settings.Profile), nil
+		}
 	}
 
-	var accountAlias string
-	for _, section := range item.Details.Sections {
-		if section.Title == sectionName {
-			for _, field := range section.Fields {
-				if field.T == fieldTitle {
-					accountAlias = field.V
-				}
+	item, errFetchItem := flow.fetchItem(ctx, &chosen, needsTotp)
+	if errFetchItem != nil {
+		return nil, nil, errFetchItem
+	}
+
+	settings, errParseSettings := parseSettings(item, flow.schema)
+	if errParseSettings != nil {
+		return nil, nil, errParseSettings
+	}
+	return item, settings, nil
+}
+
+// menuLabels returns the title of each item, adding the account and vault it came from when the
+// listed items span more than one of them and the UUID of items that still can't be told apart
+func menuLabels(items []op.Item) []string {
+	multipleAccounts, multipleVaults := false, false
+	for _, item := range items {
+		multipleAccounts = multipleAccounts || item.Account != items[0].Account
+		multipleVaults = multipleVaults || item.VaultUuid != items[0].VaultUuid
+	}
+
+	labels := make([]string, 0, len(items))
+	for _, item := range items {
+		source := []string{}
+		if multipleAccounts {
+			source = append(source, item.Account)
+		}
+		if multipleVaults {
+			vault := item.VaultName
+			if len(vault) == 0 {
+				vault = item.VaultUuid
+			}
+			if len(vault) > 0 {
+				source = append(source, vault)
 			}
 		}
+		if len(source) == 0 {
+			labels = append(labels, item.Overview.Title)
+			continue
+		}
+		labels = append(labels, fmt.Sprintf("%s (%s)", item.Overview.Title, strings.Join(source, ", ")))
 	}
 
-	if len(strings.TrimSpace(accountAlias)) == 0 {
-		return "", "", fmt.Errorf("There is no account alias defined for the choice %q\n", title)
+	counts := map[string]int{}
+	for _, label := range labels {
+		counts[label]++
+	}
+	for i, label := range labels {
+		if counts[label] > 1 {
+			labels[i] = fmt.Sprintf("%s [%s]", label, items[i].Uuid)
+		}
 	}
-	return title, accountAlias, nil
+	return labels
 }
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/op/optest"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+)
+
+const (
+	testSectionName = "ACCOUNT_INFO"
+	testFieldTitle  = "ACCOUNT_ALIAS"
+)
+
+type loginURLCall struct {
+	profile  string
+	mfaToken string
+}
+
+func newTestFlow(client provider.Provider, stdin string, sessions map[string]time.Duration) (*loginFlow, *[]loginURLCall, *bytes.Buffer) {
+	calls := []loginURLCall{}
+	stdout := &bytes.Buffer{}
+	flow := &loginFlow{
+		client:      client,
+		sessionPath: "/tmp/.op_session",
+		schema:      defaultSchema(testSectionName, testFieldTitle),
+		stdin:       bufio.NewReader(strings.NewReader(stdin)),
+		stdout:      stdout,
+		now: func() time.Time {
+			return time.Unix(45, 0)
+		},
+		sleep: func(context.Context, time.Duration) error {
+			return nil
+		},
+		getSessions: func() (map[string]time.Duration, error) {
+			return sessions, nil
+		},
+		getLoginURL: func(settings *accountSettings, mfaToken string) (*string, error) {
+			calls = append(calls, loginURLCall{profile: settings.Profile, mfaToken: mfaToken})
+			loginURL := "https://signin.aws.amazon.com/federation?Action=login&account=" + settings.Profile
+			return &loginURL, nil
+		},
+	}
+	return flow, &calls, stdout
+}
+
+func newTestClient() *optest.Client {
+	client := optest.New(
+		optest.NewItem("uuid-2", "AWS beta", testSectionName, testFieldTitle, "beta"),
+		optest.NewItem("uuid-1", "AWS alpha", testSectionName, testFieldTitle, "alpha"),
+		optest.NewItem("uuid-3", "AWS gamma", "OTHER", testFieldTitle, "gamma"),
+	)
+	client.Totps["AWS alpha"] = "111111"
+	client.Totps["AWS beta"] = "222222"
+	client.Totps["AWS delta"] = "444444"
+	return client
+}
+
+func TestChooseAccountAliasSingleMatch(t *testing.T) {
+	client := newTestClient()
+	flow, _, stdout := newTestFlow(client, "", nil)
+
+	item, settings, err := flow.chooseAccountAlias(context.Background(), []string{"beta"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "uuid-2", item.Uuid)
+	assert.Equal(t, "beta", settings.Alias)
+	assert.Empty(t, stdout.String())
+	assert.Equal(t, 1, client.CallCount(optest.MethodGetItem))
+	assert.Equal(t, []string{"uuid-2"}, client.Calls[len(client.Calls)-1].Args)
+}
+
+func TestChooseAccountAliasMenu(t *testing.T) {
+	client := newTestClient()
+	flow, _, stdout := newTestFlow(client, "1\n", nil)
+
+	item, settings, err := flow.chooseAccountAlias(context.Background(), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "AWS beta", item.Overview.Title)
+	assert.Equal(t, "beta", settings.Alias)
+	assert.Contains(t, stdout.String(), "0 AWS alpha\n1 AWS beta\n2 AWS gamma\n")
+	assert.Contains(t, stdout.String(), "Chosen account: AWS beta")
+}
+
+func TestChooseAccountAliasMenuLeavesPassword(t *testing.T) {
+	client := newTestClient()
+	flow, _, _ := newTestFlow(client, "1\nsecret\n", nil)
+
+	// The password given after the menu choice is still there for the sign-in to read
+	_, settings, err := flow.chooseAccountAlias(context.Background(), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "beta", settings.Alias)
+	line, err := flow.stdin.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "secret\n", line)
+}
+
+func TestChooseAccountAliasErrors(t *testing.T) {
+	client := newTestClient()
+
+	flow, _, _ := newTestFlow(client, "", nil)
+	_, _, err := flow.chooseAccountAlias(context.Background(), []string{"missing"}, nil)
+	assert.Error(t, err)
+
+	// The gamma item stores the alias in a different section
+	flow, _, _ = newTestFlow(client, "", nil)
+	_, _, err = flow.chooseAccountAlias(context.Background(), []string{"gamma"}, nil)
+	assert.Error(t, err)
+
+	flow, _, _ = newTestFlow(client, "not-a-number\n", nil)
+	_, _, err = flow.chooseAccountAlias(context.Background(), nil, nil)
+	assert.Error(t, err)
+
+	flow, _, _ = newTestFlow(client, "3\n", nil)
+	_, _, err = flow.chooseAccountAlias(context.Background(), nil, nil)
+	assert.Error(t, err)
+
+	errList := errors.New("list failed")
+	client.Errors[optest.MethodListItems] = errList
+	flow, _, _ = newTestFlow(client, "", nil)
+	_, _, err = flow.chooseAccountAlias(context.Background(), nil, nil)
+	assert.Equal(t, errList, err)
+}
+
+func TestChooseAccountAliasCancelled(t *testing.T) {
+	client := newTestClient()
+	flow, _, _ := newTestFlow(client, "", nil)
+	stdin, _ := io.Pipe()
+	flow.stdin = bufio.NewReader(stdin)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := flow.chooseAccountAlias(ctx, nil, nil)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestRunUsesTotpWithoutActiveSession(t *testing.T) {
+	client := newTestClient()
+	client.SignedIn = false
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{})
+
+	loginURL, _, err := flow.run(context.Background(), "", []string{"alpha"})
+	require.NoError(t, err)
+	assert.Contains(t, *loginURL, "alpha")
+	assert.Equal(t, []loginURLCall{{profile: "alpha", mfaToken: "111111"}}, *calls)
+	assert.Equal(t, 1, client.CallCount(optest.MethodSignin))
+	// The session is checked before and after signing in, but not again before the TOTP
+	assert.Equal(t, 2, client.CallCount(optest.MethodGetAccount))
+	assert.Equal(t, 1, client.CallCount(optest.MethodGetTotp))
+	assert.Equal(t, []string{"uuid-1"}, client.Calls[len(client.Calls)-1].Args)
+}
+
+func TestRunFetchesTotpAgainInNextWindow(t *testing.T) {
+	client := newTestClient()
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{})
+	flow.now = func() time.Time {
+		return time.Unix(58, 0)
+	}
+
+	_, _, err := flow.run(context.Background(), "", []string{"alpha"})
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "alpha", mfaToken: "111111"}}, *calls)
+	// The code fetched alongside the details belongs to the window that was waited out
+	assert.Equal(t, 2, client.CallCount(optest.MethodGetTotp))
+}
+
+func TestRunStopsWhenSessionsFail(t *testing.T) {
+	client := newTestClient()
+	// The menu waits for a choice that never comes
+	stdin, _ := io.Pipe()
+	flow, calls, _ := newTestFlow(client, "", nil)
+	flow.stdin = bufio.NewReader(stdin)
+	errKeyring := errors.New("The keyring is locked")
+	flow.getSessions = func() (map[string]time.Duration, error) {
+		return nil, errKeyring
+	}
+
+	_, _, err := flow.run(context.Background(), "", nil)
+	assert.Equal(t, errKeyring, err)
+	assert.Empty(t, *calls)
+}
+
+func TestRunGeneratesTotpFromSeed(t *testing.T) {
+	client := newSeedClient()
+	// op is asked for a code alongside the details but the seed is preferred once they arrive
+	client.Totps["AWS epsilon"] = "999999"
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{})
+
+	_, _, err := flow.run(context.Background(), "", []string{"epsilon"})
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "epsilon", mfaToken: "287082"}}, *calls)
+}
+
+func newSeedClient() *optest.Client {
+	item := optest.NewItem("uuid-5", "AWS epsilon", testSectionName, testFieldTitle, "epsilon")
+	item.Details.Sections[0].Fields = append(item.Details.Sections[0].Fields, op.SectionField{
+		K: "concealed",
+		N: "TOTP_abc",
+		T: "one-time password",
+		V: "otpauth://totp/AWS?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+	})
+	return optest.New(item)
+}
+
+func TestRunWaitsForFreshTotpWindow(t *testing.T) {
+	client := newSeedClient()
+	flow, calls, stdout := newTestFlow(client, "", map[string]time.Duration{})
+	flow.now = func() time.Time {
+		return time.Unix(57, 500000000)
+	}
+	slept := time.Duration(0)
+	flow.sleep = func(ctx context.Context, d time.Duration) error {
+		slept += d
+		return nil
+	}
+
+	_, _, err := flow.run(context.Background(), "", []string{"epsilon"})
+	require.NoError(t, err)
+	assert.Equal(t, 2500*time.Millisecond, slept)
+	assert.Contains(t, stdout.String(), "Waiting 3s for the next one-time password")
+	// The code of the window starting at 60 seconds
+	assert.Equal(t, []loginURLCall{{profile: "epsilon", mfaToken: "359152"}}, *calls)
+}
+
+func TestRunRetriesReusedTotp(t *testing.T) {
+	client := newSeedClient()
+	flow, calls, stdout := newTestFlow(client, "", map[string]time.Duration{})
+	getLoginURL := flow.getLoginURL
+	flow.getLoginURL = func(settings *accountSettings, mfaToken string) (*string, error) {
+		loginURL, _ := getLoginURL(settings, mfaToken)
+		if len(*calls) == 1 {
+			return nil, errors.New("AccessDenied: MultiFactorAuthentication failed with invalid MFA one time pass code, already used")
+		}
+		return loginURL, nil
+	}
+
+	_, _, err := flow.run(context.Background(), "", []string{"epsilon"})
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{
+		{profile: "epsilon", mfaToken: "287082"},
+		{profile: "epsilon", mfaToken: "359152"},
+	}, *calls)
+	assert.Contains(t, stdout.String(), "already used")
+	assert.Contains(t, stdout.String(), "Waiting 15s for the next one-time password")
+
+	// Other errors and a second reuse are not retried
+	flow, calls, _ = newTestFlow(client, "", map[string]time.Duration{})
+	flow.getLoginURL = func(settings *accountSettings, mfaToken string) (*string, error) {
+		*calls = append(*calls, loginURLCall{profile: settings.Profile, mfaToken: mfaToken})
+		return nil, errors.New("MultiFactorAuthentication failed, already used")
+	}
+	_, _, err = flow.run(context.Background(), "", []string{"epsilon"})
+	assert.Error(t, err)
+	assert.Len(t, *calls, 2)
+}
+
+func TestRunSkipsTotpWithActiveSession(t *testing.T) {
+	client := newTestClient()
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{"alpha": time.Hour})
+
+	_, _, err := flow.run(context.Background(), "", []string{"alpha"})
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "alpha", mfaToken: ""}}, *calls)
+	assert.Equal(t, 0, client.CallCount(optest.MethodGetTotp))
+}
+
+func TestRunSkipsTotpWithActiveSessionOfAlias(t *testing.T) {
+	// The title of the item says nothing of the profile, which comes from its alias
+	client := optest.New(optest.NewItem("uuid-1", "Production", testSectionName, testFieldTitle, "alpha"))
+	client.Totps["Production"] = "111111"
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{"alpha": time.Hour})
+
+	_, _, err := flow.run(context.Background(), "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "alpha", mfaToken: ""}}, *calls)
+	assert.Equal(t, 0, client.CallCount(optest.MethodGetTotp))
+}
+
+func TestChooseAccountAliasFetchesBeforeSessions(t *testing.T) {
+	client := newTestClient()
+	flow, _, _ := newTestFlow(client, "", nil)
+	sessions := &backgroundSessions{done: make(chan struct{})}
+
+	type result struct {
+		settings *accountSettings
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		_, settings, err := flow.chooseAccountAlias(context.Background(), []string{"alpha"}, sessions)
+		results <- result{settings: settings, err: err}
+	}()
+
+	// The details are fetched while the sessions are still being read
+	require.Eventually(t, func() bool {
+		return client.CallCount(optest.MethodGetItem) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0, client.CallCount(optest.MethodGetTotp))
+
+	sessions.sessions = map[string]time.Duration{}
+	close(sessions.done)
+	chosen := <-results
+	require.NoError(t, chosen.err)
+	assert.Equal(t, "alpha", chosen.settings.Profile)
+	assert.Equal(t, 1, client.CallCount(optest.MethodGetTotp))
+	assert.Equal(t, "111111", flow.prefetched.code)
+}
+
+func TestRunWithAccountAlias(t *testing.T) {
+	client := newTestClient()
+	flow, calls, stdout := newTestFlow(client, "", map[string]time.Duration{"delta": -time.Minute})
+	flow.verbose = true
+
+	_, _, err := flow.run(context.Background(), "delta", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "delta", mfaToken: "444444"}}, *calls)
+	assert.Equal(t, []string{"AWS delta"}, client.Calls[len(client.Calls)-1].Args)
+	assert.Contains(t, stdout.String(), "1Password session from the session store\n")
+	assert.Contains(t, stdout.String(), "MFA Token: 444444\n")
+	assert.Contains(t, stdout.String(), "Account Alias: delta\n")
+}
+
+func TestRunWithAccountAliasUsesUUID(t *testing.T) {
+	client := newTestClient()
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{})
+
+	_, _, err := flow.run(context.Background(), "beta", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "beta", mfaToken: "222222"}}, *calls)
+	assert.Equal(t, []string{"uuid-2"}, client.Calls[len(client.Calls)-1].Args)
+}
+
+func TestRunWithAmbiguousAccountAlias(t *testing.T) {
+	client := newTestClient()
+	duplicate := optest.NewItem("uuid-4", "AWS beta", testSectionName, testFieldTitle, "beta")
+	duplicate.VaultUuid = "vault-shared"
+	client.Items = append(client.Items, duplicate)
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{})
+
+	_, _, err := flow.run(context.Background(), "beta", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `More than one item is titled "AWS beta"`)
+	assert.Contains(t, err.Error(), "uuid-2")
+	assert.Contains(t, err.Error(), "vault-shared")
+	assert.Empty(t, *calls)
+	assert.Equal(t, 0, client.CallCount(optest.MethodGetTotp))
+}
+
+func TestRunSignsInBeforeKeyringSessions(t *testing.T) {
+	client := newTestClient()
+	client.SignedIn = false
+	flow, calls, _ := newTestFlow(client, "", nil)
+	flow.keyringSignin = true
+	flow.getSessions = func() (map[string]time.Duration, error) {
+		// The keyring in 1Password finds the session signed in instead of asking for the password again
+		assert.Equal(t, 1, client.CallCount(optest.MethodSignin))
+		return map[string]time.Duration{"beta": time.Hour}, nil
+	}
+
+	_, _, err := flow.run(context.Background(), "beta", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "beta"}}, *calls)
+	assert.Equal(t, 1, client.CallCount(optest.MethodSignin))
+}
+
+func TestRunSigninError(t *testing.T) {
+	client := newTestClient()
+	client.SignedIn = false
+	errSignin := errors.New("signin failed")
+	client.Errors[optest.MethodSignin] = errSignin
+	flow, calls, _ := newTestFlow(client, "", nil)
+
+	_, _, err := flow.run(context.Background(), "", nil)
+	assert.Equal(t, errSignin, err)
+	assert.Empty(t, *calls)
+}
+
+func TestRunDoesNotSigninOnOtherErrors(t *testing.T) {
+	client := newTestClient()
+	errNetwork := errors.New("connection refused")
+	client.Errors[optest.MethodGetAccount] = errNetwork
+	flow, calls, _ := newTestFlow(client, "", nil)
+
+	_, _, err := flow.run(context.Background(), "", nil)
+	assert.Equal(t, errNetwork, err)
+	assert.Equal(t, 0, client.CallCount(optest.MethodSignin))
+	assert.Empty(t, *calls)
+}
+
+func TestExplainError(t *testing.T) {
+	errNetwork := errors.New("connection refused")
+	assert.Equal(t, errNetwork, explainError(errNetwork))
+
+	err := explainError(fmt.Errorf("%w: \"AWS beta\" isn't an item in any vault", op.ErrItemNotFound))
+	assert.True(t, errors.Is(err, op.ErrItemNotFound))
+	assert.Contains(t, err.Error(), `tagged "aws"`)
+
+	err = explainError(op.ErrNotSignedIn)
+	assert.Contains(t, err.Error(), "op signin")
+}
+
+func TestChooseAccountAliasMenuShowsAccount(t *testing.T) {
+	agency := optest.New(optest.NewItem("uuid-a", "AWS alpha", testSectionName, testFieldTitle, "alpha"))
+	contractor := optest.New(optest.NewItem("uuid-b", "AWS beta", testSectionName, testFieldTitle, "beta"))
+	multi := &op.MultiClient{
+		Shorthands: []string{"agency", "contractor"},
+		Clients:    map[string]op.Client{"agency": agency, "contractor": contractor},
+	}
+	flow, _, stdout := newTestFlow(multi, "1\n", nil)
+
+	_, settings, err := flow.chooseAccountAlias(context.Background(), nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "beta", settings.Alias)
+	assert.Contains(t, stdout.String(), "0 AWS alpha (agency)\n1 AWS beta (contractor)\n")
+}
+
+func TestPasswordFunc(t *testing.T) {
+	v := viper.New()
+	v.Set(flagLoginPasswordFD, -1)
+	password, err := passwordFunc(v, nil)
+	require.NoError(t, err)
+	assert.Nil(t, password)
+
+	v.Set(flagLoginPasswordStdin, true)
+	password, err = passwordFunc(v, bufio.NewReader(strings.NewReader("first\r\nsecond")))
+	require.NoError(t, err)
+	for _, expected := range []string{"first", "second"} {
+		actual, err := password("Enter your 1Password password: ")
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	_, err = password("Enter your 1Password password: ")
+	assert.Error(t, err)
+}
+
+func TestMenuLabels(t *testing.T) {
+	items := []op.Item{
+		{Overview: op.Overview{Title: "AWS alpha"}, VaultUuid: "v1", VaultName: "Private", Account: "agency"},
+		{Overview: op.Overview{Title: "AWS alpha"}, VaultUuid: "v2", VaultName: "Shared", Account: "agency"},
+		{Overview: op.Overview{Title: "AWS beta"}, VaultUuid: "v3", Account: "agency"},
+	}
+	assert.Equal(t, []string{"AWS alpha (Private)", "AWS alpha (Shared)", "AWS beta (v3)"}, menuLabels(items))
+
+	items[2].Account = "contractor"
+	assert.Equal(t, "AWS beta (contractor, v3)", menuLabels(items)[2])
+
+	assert.Equal(t, []string{"AWS alpha"}, menuLabels(items[:1]))
+
+	duplicates := []op.Item{
+		{Uuid: "uuid-1", Overview: op.Overview{Title: "AWS alpha"}, VaultUuid: "v1"},
+		{Uuid: "uuid-2", Overview: op.Overview{Title: "AWS alpha"}, VaultUuid: "v1"},
+	}
+	assert.Equal(t, []string{"AWS alpha [uuid-1]", "AWS alpha [uuid-2]"}, menuLabels(duplicates))
+}
+
+func TestStringList(t *testing.T) {
+	cmd := &cobra.Command{}
+	initLoginFlags(cmd.Flags())
+	require.NoError(t, cmd.Flags().Parse([]string{"--connect-vaults", "Shared Team,Infra"}))
+	v, err := initViper(cmd)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Shared Team", "Infra"}, stringList(v, flagLoginConnectVaults))
+
+	// Environment variables are split on commas, not whitespace
+	t.Setenv("AWSLOGIN_CONNECT_VAULTS", "Shared Team, Infra,")
+	assert.Equal(t, []string{"Shared Team", "Infra"}, stringList(v, flagLoginConnectVaults))
+}
+
+func TestStringListAccounts(t *testing.T) {
+	cmd := &cobra.Command{}
+	initLoginFlags(cmd.Flags())
+	v, err := initViper(cmd)
+	require.NoError(t, err)
+	assert.Empty(t, stringList(v, flagLoginAccounts))
+
+	t.Setenv("AWSLOGIN_ACCOUNTS", "agency,my team")
+	assert.Equal(t, []string{"agency", "my team"}, stringList(v, flagLoginAccounts))
+}
+
+func TestStringListVaults(t *testing.T) {
+	cmd := &cobra.Command{}
+	initLoginFlags(cmd.Flags())
+	v, err := initViper(cmd)
+	require.NoError(t, err)
+
+	// Vault names may hold spaces
+	t.Setenv("AWSLOGIN_VAULT", "Shared Team,Infra")
+	assert.Equal(t, []string{"Shared Team", "Infra"}, stringList(v, flagLoginVault))
+}
+
+func TestHCVaultFlagsLeaveVault(t *testing.T) {
+	cmd := &cobra.Command{}
+	initLoginFlags(cmd.Flags())
+	v, err := initViper(cmd)
+	require.NoError(t, err)
+
+	// The HashiCorp Vault settings don't share the prefix of the 1Password vaults
+	t.Setenv("AWSLOGIN_VAULT", "Shared")
+	t.Setenv("AWSLOGIN_HCVAULT_KV_PATH", "aws/breakglass")
+	assert.Equal(t, []string{"Shared"}, stringList(v, flagLoginVault))
+	assert.Equal(t, "aws/breakglass", v.GetString(flagLoginHCVaultKVPath))
+	assert.Nil(t, cmd.Flags().Lookup("vault-kv-path"))
+}
+
+func TestStringListExternalArgs(t *testing.T) {
+	cmd := &cobra.Command{}
+	initLoginFlags(cmd.Flags())
+	v, err := initViper(cmd)
+	require.NoError(t, err)
+
+	t.Setenv("AWSLOGIN_EXTERNAL_ARGS", "--store,/home/me/My Accounts.json")
+	assert.Equal(t, []string{"--store", "/home/me/My Accounts.json"}, stringList(v, flagLoginExternalArgs))
+}
+
+func TestPreCheck(t *testing.T) {
+	assert.NoError(t, preCheck("op", "2.7.1\n", minVersionOP))
+	assert.NoError(t, preCheck("op", "1.11.4", minVersionOP))
+	assert.EqualError(t, preCheck("op", "1.8.0", minVersionOP), `Expected version of "op" to be greater or equal to "v1.11.4"`)
+	assert.Error(t, preCheck("op", "", minVersionOP))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// maxItemFetches limits how many items are fetched at once while searching for an MFA device
+const maxItemFetches = 4
+
+// itemField returns the value of the field in the settings section of the item, and whether the item
+// has the section at all since a listed item may be missing its details
+func (flow *loginFlow) itemField(item *op.Item, title string) (string, bool) {
+	if item == nil {
+		return "", false
+	}
+	for _, section := range item.Details.Sections {
+		if section.Title != flow.schema.Section {
+			continue
+		}
+		for _, field := range section.Fields {
+			if len(title) > 0 && field.T == title {
+				return strings.TrimSpace(field.V), true
+			}
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// findMfaItem returns the item holding the one-time password of the MFA device aws-vault logs into the
+// profile with, which for a role chained from a source_profile may not be the chosen item. The chosen item
+// is used when it names the device or when the profile doesn't use one. It returns nil when no item names
+// the device, leaving the caller to the chosen item or its title rule.
+func (flow *loginFlow) findMfaItem(ctx context.Context, profile string, chosen *op.Item) (*op.Item, error) {
+	if flow.getMfaSerial == nil {
+		return chosen, nil
+	}
+	serial, errGetMfaSerial := flow.getMfaSerial(profile)
+	if errGetMfaSerial != nil {
+		return nil, errGetMfaSerial
+	}
+	if len(serial) == 0 {
+		return chosen, nil
+	}
+	if chosenSerial, _ := flow.itemField(chosen, flow.schema.Fields.MfaSerial); chosen != nil && chosenSerial == serial {
+		return chosen, nil
+	}
+
+	items, errListItems := flow.client.ListItems(ctx, itemTag)
+	if errListItems != nil {
+		return nil, errListItems
+	}
+	// Items listed with their details, as the item cache has them, are only fetched when they name the
+	// device since the listing leaves out the one-time password seed. The listings of op have no details
+	// so the other items are fetched to read theirs.
+	candidates := []op.Item{}
+	for i := range items {
+		listed := &items[i]
+		if chosen != nil && itemRef(listed) == itemRef(chosen) {
+			continue
+		}
+		if listedSerial, detailed := flow.itemField(listed, flow.schema.Fields.MfaSerial); detailed && listedSerial != serial {
+			continue
+		}
+		candidates = append(candidates, *listed)
+	}
+
+	fetched, errFetchItems := flow.fetchItems(ctx, candidates)
+	if errFetchItems != nil {
+		return nil, errFetchItems
+	}
+	// An item holding the seed is preferred over one that can only ask op for the one-time password
+	var found *op.Item
+	for _, item := range fetched {
+		if itemSerial, _ := flow.itemField(item, flow.schema.Fields.MfaSerial); item == nil || itemSerial != serial {
+			continue
+		}
+		if _, ok := item.OTPSecret(); ok {
+			return item, nil
+		}
+		if found == nil {
+			found = item
+		}
+	}
+	return found, nil
+}
+
+// fetchItems fetches the details of the listed items a few at a time, in the order they were listed. An
+// item that can't be fetched is left nil since the search it is part of has the title rule to fall back on.
+func (flow *loginFlow) fetchItems(ctx context.Context, listed []op.Item) ([]*op.Item, error) {
+	fetched := make([]*op.Item, len(listed))
+	limit := make(chan struct{}, maxItemFetches)
+	var wg sync.WaitGroup
+	for i := range listed {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case limit <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-limit }()
+			item, errGetItem := flow.client.GetItem(ctx, itemRef(&listed[i]))
+			if errGetItem == nil {
+				fetched[i] = item
+			}
+		}(i)
+	}
+	wg.Wait()
+	if errCtx := ctx.Err(); errCtx != nil {
+		return nil, errCtx
+	}
+	return fetched, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/op/optest"
+)
+
+const (
+	testMfaSerial = "arn:aws:iam::123456789012:mfa/user"
+	// testMfaSeed generates 287082 at the time of the test flow
+	testMfaSeed = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+)
+
+// newMfaClient returns items where the MFA device of the zeta role, which names no device of its own, lives
+// on the item of its source profile
+func newMfaClient() *optest.Client {
+	source := optest.NewItem("uuid-8", "Identity account", testSectionName, testFieldTitle, "identity")
+	source.Details.Sections[0].Fields = append(source.Details.Sections[0].Fields,
+		op.SectionField{K: "string", T: "MFA_SERIAL", V: testMfaSerial},
+		op.SectionField{K: "concealed", N: "TOTP_identity", V: testMfaSeed},
+	)
+	role := newSettingsItem(nil)
+	client := optest.New(role, source, optest.NewItem("uuid-1", "AWS alpha", testSectionName, testFieldTitle, "alpha"))
+	client.Totps["uuid-7"] = "777777"
+	client.Totps["AWS alpha"] = "111111"
+	return client
+}
+
+func TestRunUsesMfaItemOfSourceProfile(t *testing.T) {
+	client := newMfaClient()
+	flow, calls, stdout := newTestFlow(client, "", map[string]time.Duration{})
+	flow.verbose = true
+	flow.getMfaSerial = func(profile string) (string, error) {
+		return testMfaSerial, nil
+	}
+
+	_, settings, err := flow.run(context.Background(), "", []string{"zeta"})
+	require.NoError(t, err)
+	assert.Equal(t, "zeta", settings.Alias)
+	assert.Equal(t, []loginURLCall{{profile: "zeta", mfaToken: "287082"}}, *calls)
+	assert.Contains(t, stdout.String(), "MFA Device: Identity account\n")
+}
+
+func TestRunWithAccountAliasFindsMfaItem(t *testing.T) {
+	client := newMfaClient()
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{})
+	flow.getMfaSerial = func(profile string) (string, error) {
+		return testMfaSerial, nil
+	}
+
+	// No item is titled "AWS identity" so only the MFA device finds it
+	_, settings, err := flow.run(context.Background(), "identity", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "identity", settings.Alias)
+	assert.Equal(t, []loginURLCall{{profile: "identity", mfaToken: "287082"}}, *calls)
+}
+
+func TestRunFallsBackToTitleWithoutMfaMatch(t *testing.T) {
+	client := newMfaClient()
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{})
+	flow.getMfaSerial = func(profile string) (string, error) {
+		return "arn:aws:iam::123456789012:mfa/other", nil
+	}
+
+	_, _, err := flow.run(context.Background(), "alpha", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "alpha", mfaToken: "111111"}}, *calls)
+}
+
+func TestFindMfaItemUsesChosenItem(t *testing.T) {
+	client := newMfaClient()
+	flow, _, _ := newTestFlow(client, "", nil)
+	flow.getMfaSerial = func(profile string) (string, error) {
+		if profile == "zeta" {
+			return testMfaSerial, nil
+		}
+		return "", nil
+	}
+
+	// A profile without an MFA device keeps the chosen item
+	alpha := client.Items[2]
+	item, err := flow.findMfaItem(context.Background(), "alpha", &alpha)
+	require.NoError(t, err)
+	assert.Equal(t, &alpha, item)
+
+	// So does an item naming the device of the profile
+	role := newSettingsItem(map[string]string{"MFA_SERIAL": testMfaSerial})
+	item, err = flow.findMfaItem(context.Background(), "zeta", &role)
+	require.NoError(t, err)
+	assert.Equal(t, &role, item)
+	assert.Equal(t, 0, client.CallCount(optest.MethodListItems))
+	assert.Equal(t, 0, client.CallCount(optest.MethodGetItem))
+}
+
+func TestFindMfaItemComparesChosenSerial(t *testing.T) {
+	client := newMfaClient()
+	flow, _, _ := newTestFlow(client, "", nil)
+	flow.getMfaSerial = func(profile string) (string, error) {
+		return testMfaSerial, nil
+	}
+
+	// The seed of the chosen item belongs to another device than the one the chained profile uses
+	role := newSettingsItem(map[string]string{"MFA_SERIAL": "arn:aws:iam::123456789012:mfa/other"})
+	role.Details.Sections[0].Fields = append(role.Details.Sections[0].Fields, op.SectionField{K: "concealed", N: "TOTP_zeta", V: testMfaSeed})
+	item, err := flow.findMfaItem(context.Background(), "zeta", &role)
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	assert.Equal(t, "uuid-8", item.Uuid)
+}
+
+func TestFindMfaItemFetchesUnlistedDetails(t *testing.T) {
+	client := newMfaClient()
+	flow, _, _ := newTestFlow(client, "", nil)
+	flow.getMfaSerial = func(profile string) (string, error) {
+		return testMfaSerial, nil
+	}
+
+	// op lists the items without their details, so every other item is fetched to read its MFA device
+	role := client.Items[0]
+	item, err := flow.findMfaItem(context.Background(), "zeta", &role)
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	assert.Equal(t, "uuid-8", item.Uuid)
+	_, ok := item.OTPSecret()
+	assert.True(t, ok)
+	assert.Equal(t, 2, client.CallCount(optest.MethodGetItem))
+}
+
+func TestFindMfaItemUsesListedDetails(t *testing.T) {
+	client := newMfaClient()
+	flow, _, _ := newTestFlow(client, "", nil)
+	flow.getMfaSerial = func(profile string) (string, error) {
+		return testMfaSerial, nil
+	}
+	// The item cache lists the items with the details fetched before, leaving out the seed
+	listed := append([]op.Item{}, client.Items...)
+	source := listed[1].Details.Sections[0]
+	listed[1].Details.Sections = []op.Section{{Title: source.Title, Fields: source.Fields[:2]}}
+	flow.client = &listingClient{Client: client, listed: listed}
+
+	role := client.Items[0]
+	item, err := flow.findMfaItem(context.Background(), "zeta", &role)
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	assert.Equal(t, "uuid-8", item.Uuid)
+	// Only the item naming the device is fetched, for its seed
+	assert.Equal(t, []string{"uuid-8"}, client.Calls[len(client.Calls)-1].Args)
+	assert.Equal(t, 1, client.CallCount(optest.MethodGetItem))
+}
+
+// listingClient lists the given items, such as ones carrying details the way the item cache does
+type listingClient struct {
+	*optest.Client
+	listed []op.Item
+}
+
+func (client *listingClient) ListItems(ctx context.Context, tags string) ([]op.Item, error) {
+	return client.listed, nil
+}
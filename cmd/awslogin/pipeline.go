@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// backgroundSessions reads the aws-vault sessions while 1Password is being queried
+type backgroundSessions struct {
+	done     chan struct{}
+	sessions map[string]time.Duration
+	err      error
+}
+
+// loadSessions starts reading the aws-vault sessions, calling cancel to stop the other steps when it fails
+func (flow *loginFlow) loadSessions(cancel context.CancelFunc) *backgroundSessions {
+	background := &backgroundSessions{done: make(chan struct{})}
+	go func() {
+		background.sessions, background.err = flow.getSessions()
+		close(background.done)
+		if background.err != nil {
+			cancel()
+		}
+	}()
+	return background
+}
+
+// wait returns the sessions once they have been read or the error of ctx when it is done first
+func (background *backgroundSessions) wait(ctx context.Context) (map[string]time.Duration, error) {
+	select {
+	case <-background.done:
+		return background.sessions, background.err
+	case <-ctx.Done():
+		if err := background.failed(); err != nil {
+			return nil, err
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// explain returns the error reading the sessions in place of err when that is what cancelled the step
+func (background *backgroundSessions) explain(err error) error {
+	if errSessions := background.failed(); errSessions != nil && errors.Is(err, context.Canceled) {
+		return errSessions
+	}
+	return err
+}
+
+// failed returns the error reading the sessions if it has already happened, which explains why the
+// other steps were cancelled better than the cancellation does
+func (background *backgroundSessions) failed() error {
+	select {
+	case <-background.done:
+		return background.err
+	default:
+		return nil
+	}
+}
+
+// hasActiveSession reports whether aws-vault holds a session for the profile that hasn't expired
+func hasActiveSession(sessions map[string]time.Duration, profile string) bool {
+	duration, ok := sessions[profile]
+	return ok && duration > 0
+}
+
+// fetchedTotp is a one-time password fetched from op before it was needed
+type fetchedTotp struct {
+	// ref is the item the code was fetched for
+	ref  string
+	code string
+	// window is the TOTP window the code was fetched in
+	window int64
+}
+
+// totpWindow returns the number of the TOTP window at the time
+func totpWindow(at time.Time, period time.Duration) int64 {
+	return at.UnixNano() / int64(period)
+}
+
+// totpCheck tells whether the one-time password of an item will be needed, given a way to wait for
+// the details of the item
+type totpCheck func(ctx context.Context, details func(context.Context) (*op.Item, error)) (bool, error)
+
+// alwaysTotp is the totpCheck of an item whose one-time password is needed regardless of its details
+func alwaysTotp(context.Context, func(context.Context) (*op.Item, error)) (bool, error) {
+	return true, nil
+}
+
+// fetchItem gets the details of the listed item and, when needsTotp says a one-time password will be
+// needed, fetches one from op at the same time in case the item has no seed to generate it from. A
+// failure of the details cancels the one-time password while a failed one-time password is fetched
+// again later. A nil needsTotp leaves the one-time password out.
+func (flow *loginFlow) fetchItem(ctx context.Context, listed *op.Item, needsTotp totpCheck) (*op.Item, error) {
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	// fetched is closed once the details have been read, letting the one-time password wait on them
+	fetched := make(chan struct{})
+	item := listed
+	group.Go(func() error {
+		defer close(fetched)
+		details, errGetItem := flow.client.GetItem(groupCtx, itemRef(listed))
+		if errors.Is(errGetItem, op.ErrItemNotFound) && len(listed.Uuid) == 0 {
+			// An item that wasn't listed is looked up by title and only has a one-time password to offer
+			return nil
+		}
+		if errGetItem != nil {
+			return errGetItem
+		}
+		item = details
+		return nil
+	})
+
+	var prefetched *fetchedTotp
+	if needsTotp != nil {
+		group.Go(func() error {
+			withTotp, errCheck := needsTotp(groupCtx, func(ctx context.Context) (*op.Item, error) {
+				// Listed details spare the wait, though the listings of op leave them out
+				if len(listed.Details.Sections) > 0 {
+					return listed, nil
+				}
+				select {
+				case <-fetched:
+					return item, nil
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			})
+			if errCheck != nil || !withTotp {
+				return errCheck
+			}
+			before := totpWindow(flow.now(), totpPeriod)
+			code, errGetTotp := flow.client.GetTotp(groupCtx, itemRef(listed))
+			if errGetTotp != nil || before != totpWindow(flow.now(), totpPeriod) {
+				return nil
+			}
+			prefetched = &fetchedTotp{ref: itemRef(listed), code: strings.TrimSpace(*code), window: before}
+			return nil
+		})
+	}
+
+	errWait := group.Wait()
+	if errWait != nil {
+		return nil, errWait
+	}
+	flow.prefetched = prefetched
+	return item, nil
+}
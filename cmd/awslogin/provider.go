@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"github.com/deptofdefense/awslogin/pkg/bw"
+	"github.com/deptofdefense/awslogin/pkg/external"
+	"github.com/deptofdefense/awslogin/pkg/hcvault"
+	"github.com/deptofdefense/awslogin/pkg/keepass"
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/pass"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+)
+
+// isProvider reports whether the name is one of the providers
+func isProvider(name string) bool {
+	for _, known := range provider.Names {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// newProvider returns the provider chosen by the flags, which reads the settings of each account with the schema
+func newProvider(v *viper.Viper, sessionPath string, stdin *bufio.Reader, schema itemSchema) (provider.Provider, error) {
+	switch name := v.GetString(flagLoginProvider); name {
+	case provider.NameOnePassword:
+		return newClient(v, sessionPath, stdin)
+	case provider.NamePass:
+		dir := v.GetString(flagLoginPassDir)
+		if len(dir) == 0 {
+			var errDefaultDir error
+			dir, errDefaultDir = pass.DefaultDir()
+			if errDefaultDir != nil {
+				return nil, errDefaultDir
+			}
+		}
+		return pass.New(dir, v.GetString(flagLoginPassSubtree), schema.Section, schema.Fields.Alias), nil
+	case provider.NameKeePass:
+		db := keepass.New(v.GetString(flagLoginKeePassFile), v.GetString(flagLoginKeePassKeyFile), v.GetString(flagLoginKeePassGroup), v.GetString(flagLoginKeePassTag), schema.Section)
+		db.NoPassword = v.GetBool(flagLoginKeePassNoPass)
+		db.OTPAttribute = v.GetString(flagLoginKeePassOTP)
+		db.Attempts = v.GetInt(flagLoginSigninAttempts)
+		password, errPasswordFunc := passwordFunc(v, stdin)
+		if errPasswordFunc != nil {
+			return nil, errPasswordFunc
+		}
+		if password != nil {
+			db.Password = password
+			db.Attempts = 1
+		}
+		return db, nil
+	case provider.NameBitwarden:
+		client := bw.New(v.GetString(flagLoginBwFolder), v.GetString(flagLoginBwCollection), schema.Section, schema.Fields.Alias)
+		client.Attempts = v.GetInt(flagLoginSigninAttempts)
+		password, errPasswordFunc := passwordFunc(v, stdin)
+		if errPasswordFunc != nil {
+			return nil, errPasswordFunc
+		}
+		if password != nil {
+			client.Password = password
+			client.Attempts = 1
+		}
+		return client, nil
+	case provider.NameVault:
+		client := hcvault.New(v.GetString(flagLoginHCVaultAddr), schema.Section, schema.Fields.Alias)
+		client.Namespace = v.GetString(flagLoginHCVaultNamespace)
+		client.Token = v.GetString(flagLoginHCVaultToken)
+		client.RoleID = v.GetString(flagLoginHCVaultRoleID)
+		client.SecretID = v.GetString(flagLoginHCVaultSecretID)
+		if len(client.Token) == 0 && len(client.RoleID) == 0 {
+			client.Token = hcvault.HelperToken()
+		}
+		client.AppRoleAuth = v.GetString(flagLoginHCVaultAppRole)
+		client.KVMount = v.GetString(flagLoginHCVaultKVMount)
+		client.Path = v.GetString(flagLoginHCVaultKVPath)
+		client.TOTPMount = v.GetString(flagLoginHCVaultTOTPMount)
+		return client, nil
+	case provider.NameExternal:
+		command := external.New(v.GetString(flagLoginExternalCommand), stringList(v, flagLoginExternalArgs), schema.Section)
+		command.Timeout = v.GetDuration(flagLoginExternalTimeout)
+		return command, nil
+	default:
+		return nil, fmt.Errorf("Given provider %q is not an option\n", name)
+	}
+}
+
+// opKeyringConfig returns the 1Password session the keyring of aws-vault is kept with, which is the first account
+// given with --accounts when there are several
+func opKeyringConfig(client provider.Provider) (*op.Config, error) {
+	switch c := client.(type) {
+	case *op.Config:
+		return c, nil
+	case *op.CachedClient:
+		return opKeyringConfig(c.Client)
+	case *op.MultiClient:
+		if len(c.Shorthands) > 0 {
+			return opKeyringConfig(c.Clients[c.Shorthands[0]])
+		}
+	}
+	return nil, fmt.Errorf("The 1Password keyring can't be kept with a %T", client)
+}
+
+// aliasTitle returns the title of the item named after the account alias, which is "AWS <alias>" in 1Password
+func (flow *loginFlow) aliasTitle(accountAlias string) string {
+	if titler, ok := flow.client.(provider.AliasTitler); ok {
+		return titler.AliasTitle(accountAlias)
+	}
+	return fmt.Sprintf("AWS %s", accountAlias)
+}
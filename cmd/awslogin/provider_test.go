@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/bw"
+	"github.com/deptofdefense/awslogin/pkg/external"
+	"github.com/deptofdefense/awslogin/pkg/hcvault"
+	"github.com/deptofdefense/awslogin/pkg/keepass"
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/op/optest"
+	"github.com/deptofdefense/awslogin/pkg/pass"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+)
+
+// pathTitledClient titles items by the alias alone the way the pass provider does, and has no session
+type pathTitledClient struct {
+	provider.Provider
+}
+
+func (client *pathTitledClient) AliasTitle(alias string) string {
+	return alias
+}
+
+func TestNewProvider(t *testing.T) {
+	flags := pflag.NewFlagSet("awslogin", pflag.ContinueOnError)
+	initLoginFlags(flags)
+	v := viper.New()
+	require.NoError(t, v.BindPFlags(flags))
+	schema := defaultSchema(testSectionName, testFieldTitle)
+
+	v.Set(flagLoginProvider, provider.NamePass)
+	v.Set(flagLoginPassDir, "/tmp/store")
+	client, err := newProvider(v, "/tmp/.op_session", bufio.NewReader(strings.NewReader("")), schema)
+	require.NoError(t, err)
+	assert.Equal(t, pass.New("/tmp/store", pass.DefaultSubtree, testSectionName, testFieldTitle), client)
+
+	v.Set(flagLoginProvider, provider.NameKeePass)
+	assert.EqualError(t, checkLoginConfig(v), "The keepass provider needs the database given with --keepass-file")
+	v.Set(flagLoginKeePassFile, "/tmp/accounts.kdbx")
+	v.Set(flagLoginKeePassGroup, "AWS")
+	client, err = newProvider(v, "/tmp/.op_session", bufio.NewReader(strings.NewReader("")), schema)
+	require.NoError(t, err)
+	db, ok := client.(*keepass.Database)
+	require.True(t, ok)
+	assert.Equal(t, "AWS", db.Group)
+	assert.Equal(t, testSectionName, db.Section)
+
+	v.Set(flagLoginProvider, provider.NameBitwarden)
+	v.Set(flagLoginBwCollection, "Engineering")
+	client, err = newProvider(v, "/tmp/.op_session", bufio.NewReader(strings.NewReader("")), schema)
+	require.NoError(t, err)
+	vault, ok := client.(*bw.Client)
+	require.True(t, ok)
+	assert.Equal(t, "Engineering", vault.Collection)
+	assert.Equal(t, testFieldTitle, vault.AliasField)
+
+	v.Set(flagLoginProvider, provider.NameVault)
+	assert.EqualError(t, checkLoginConfig(v), "The vault provider needs the server given with --hcvault-addr or VAULT_ADDR")
+	v.Set(flagLoginHCVaultAddr, "https://vault.example.com:8200")
+	v.Set(flagLoginHCVaultRoleID, "role-id")
+	assert.EqualError(t, checkLoginConfig(v), "Logging in to Vault with AppRole needs the secret ID given with --hcvault-secret-id")
+	v.Set(flagLoginHCVaultSecretID, "secret-id")
+	v.Set(flagLoginHCVaultKVPath, "aws/breakglass")
+	client, err = newProvider(v, "/tmp/.op_session", bufio.NewReader(strings.NewReader("")), schema)
+	require.NoError(t, err)
+	server, ok := client.(*hcvault.Client)
+	require.True(t, ok)
+	assert.Equal(t, "https://vault.example.com:8200", server.Address)
+	assert.Equal(t, "role-id", server.RoleID)
+	assert.Empty(t, server.Token)
+	assert.Equal(t, "aws/breakglass", server.Path)
+
+	v.Set(flagLoginProvider, provider.NameExternal)
+	assert.EqualError(t, checkLoginConfig(v), "The external provider needs the executable given with --external-command")
+	v.Set(flagLoginExternalCommand, "/usr/local/bin/accounts-provider")
+	v.Set(flagLoginExternalArgs, []string{"--team", "platform"})
+	client, err = newProvider(v, "/tmp/.op_session", bufio.NewReader(strings.NewReader("")), schema)
+	require.NoError(t, err)
+	assert.Equal(t, &external.Command{
+		Path:    "/usr/local/bin/accounts-provider",
+		Args:    []string{"--team", "platform"},
+		Section: testSectionName,
+		Timeout: external.DefaultTimeout,
+	}, client)
+
+	v.Set(flagLoginProvider, "lastpass")
+	assert.EqualError(t, checkLoginConfig(v), "Given provider \"lastpass\" is not an option\n")
+}
+
+func TestRunWithAliasTitler(t *testing.T) {
+	client := optest.New(optest.NewItem("aws/zeta", "zeta", testSectionName, testFieldTitle, "zeta"))
+	client.Totps["aws/zeta"] = "777777"
+	flow, calls, _ := newTestFlow(&pathTitledClient{Provider: client}, "", map[string]time.Duration{})
+
+	_, _, err := flow.run(context.Background(), "zeta", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "zeta", mfaToken: "777777"}}, *calls)
+	// A provider without sessions is never asked for one
+	assert.Equal(t, 0, client.CallCount(optest.MethodGetAccount))
+	assert.Equal(t, []string{"aws/zeta"}, client.Calls[len(client.Calls)-1].Args)
+}
+
+func TestOpKeyringConfig(t *testing.T) {
+	dds := op.New("OP_SESSION_dds", "dds-token")
+	other := op.New("OP_SESSION_other", "other-token")
+	multi := &op.MultiClient{Shorthands: []string{"dds", "other"}, Clients: map[string]op.Client{"dds": dds, "other": other}}
+
+	config, err := opKeyringConfig(&op.CachedClient{Client: multi})
+	require.NoError(t, err)
+	assert.Same(t, dds, config)
+
+	_, err = opKeyringConfig(op.NewConnect("http://localhost:8080", "token", nil))
+	assert.Error(t, err)
+
+	flags := pflag.NewFlagSet("awslogin", pflag.ContinueOnError)
+	initLoginFlags(flags)
+	v := viper.New()
+	require.NoError(t, v.BindPFlags(flags))
+	v.Set(flagLoginKeyringVault, "AWS Keyring")
+	v.Set(flagLoginProvider, provider.NamePass)
+	assert.EqualError(t, checkLoginConfig(v), "The 1Password keyring given with --keyring-vault needs the op provider without a Connect server")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/spf13/viper"
+
+	"github.com/deptofdefense/awslogin/pkg/awsvault"
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// The limits AWS puts on the duration of a console session
+const (
+	minSessionDuration = 15 * time.Minute
+	maxSessionDuration = 12 * time.Hour
+)
+
+// regionPattern matches AWS region names such as us-east-1, us-gov-west-1 and cn-north-1
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// itemSchema maps the fields of a 1Password item to the settings of an AWS account
+type itemSchema struct {
+	// Section is the title of the item section holding the fields
+	Section string       `mapstructure:"section"`
+	Fields  schemaFields `mapstructure:"fields"`
+}
+
+// schemaFields holds the field title of each setting, where an empty title leaves the setting out
+type schemaFields struct {
+	Alias           string `mapstructure:"alias"`
+	Profile         string `mapstructure:"profile"`
+	Region          string `mapstructure:"region"`
+	ConsolePath     string `mapstructure:"console_path"`
+	RoleARN         string `mapstructure:"role_arn"`
+	SessionDuration string `mapstructure:"session_duration"`
+	Browser         string `mapstructure:"browser"`
+	MfaSerial       string `mapstructure:"mfa_serial"`
+}
+
+// defaultSchema returns the schema used without a schema file, reading the alias from the given field
+func defaultSchema(sectionName, fieldTitle string) itemSchema {
+	return itemSchema{
+		Section: sectionName,
+		Fields: schemaFields{
+			Alias:           fieldTitle,
+			Profile:         "AWS_PROFILE",
+			Region:          "REGION",
+			ConsolePath:     "CONSOLE_PATH",
+			RoleARN:         "ROLE_ARN",
+			SessionDuration: "SESSION_DURATION",
+			Browser:         "BROWSER",
+			MfaSerial:       "MFA_SERIAL",
+		},
+	}
+}
+
+// loadSchema reads the schema file over the default schema, rejecting settings it doesn't know
+func loadSchema(filename string, schema itemSchema) (itemSchema, error) {
+	if len(filename) > 0 {
+		file := viper.New()
+		file.SetConfigFile(filename)
+		errRead := file.ReadInConfig()
+		if errRead != nil {
+			return schema, fmt.Errorf("Unable to read the schema file %q: %w", filename, errRead)
+		}
+		errUnmarshal := file.UnmarshalExact(&schema)
+		if errUnmarshal != nil {
+			return schema, fmt.Errorf("Unable to read the schema file %q: %w", filename, errUnmarshal)
+		}
+	}
+	if len(strings.TrimSpace(schema.Section)) == 0 {
+		return schema, errors.New("The schema needs the section holding the account settings")
+	}
+	if len(strings.TrimSpace(schema.Fields.Alias)) == 0 {
+		return schema, errors.New("The schema needs the field holding the account alias")
+	}
+	return schema, nil
+}
+
+// accountSettings are the settings of an AWS account read from its 1Password item
+type accountSettings struct {
+	Alias string
+	// Profile is the aws-vault profile to log in with, defaulting to the alias
+	Profile         string
+	Region          string
+	ConsolePath     string
+	RoleARN         string
+	SessionDuration time.Duration
+	Browser         string
+	// MfaSerial is the MFA device whose one-time password the item holds
+	MfaSerial string
+}
+
+// loginOptions returns the settings that override the profile in the AWS config file
+func (settings *accountSettings) loginOptions() awsvault.LoginOptions {
+	return awsvault.LoginOptions{
+		Region:          settings.Region,
+		ConsolePath:     settings.ConsolePath,
+		RoleARN:         settings.RoleARN,
+		SessionDuration: settings.SessionDuration,
+	}
+}
+
+// aliasSettings returns the settings of an account known only by its alias
+func aliasSettings(accountAlias string) *accountSettings {
+	return &accountSettings{Alias: accountAlias, Profile: accountAlias}
+}
+
+// parseSettings reads the settings of the item, reporting every field that isn't valid at once
+func parseSettings(item *op.Item, schema itemSchema) (*accountSettings, error) {
+	values := map[string]string{}
+	for _, section := range item.Details.Sections {
+		if section.Title != schema.Section {
+			continue
+		}
+		for _, field := range section.Fields {
+			values[field.T] = strings.TrimSpace(field.V)
+		}
+	}
+	value := func(title string) string {
+		if len(title) == 0 {
+			return ""
+		}
+		return values[title]
+	}
+
+	settings := &accountSettings{
+		Alias:       value(schema.Fields.Alias),
+		Profile:     value(schema.Fields.Profile),
+		Region:      value(schema.Fields.Region),
+		ConsolePath: strings.TrimPrefix(value(schema.Fields.ConsolePath), "/"),
+		RoleARN:     value(schema.Fields.RoleARN),
+		Browser:     value(schema.Fields.Browser),
+		MfaSerial:   value(schema.Fields.MfaSerial),
+	}
+	if len(settings.Alias) == 0 {
+		return nil, fmt.Errorf("There is no account alias defined for the choice %q\n", item.Overview.Title)
+	}
+	if len(settings.Profile) == 0 {
+		settings.Profile = settings.Alias
+	}
+
+	problems := map[string]string{}
+	if len(settings.Region) > 0 && !regionPattern.MatchString(settings.Region) {
+		problems[schema.Fields.Region] = fmt.Sprintf("%q isn't an AWS region", settings.Region)
+	}
+	if strings.Contains(settings.ConsolePath, "://") {
+		problems[schema.Fields.ConsolePath] = fmt.Sprintf("%q should be a path in the console rather than a URL", settings.ConsolePath)
+	}
+	if len(settings.RoleARN) > 0 {
+		if problem := checkRoleARN(settings.RoleARN); len(problem) > 0 {
+			problems[schema.Fields.RoleARN] = problem
+		}
+	}
+	if duration := value(schema.Fields.SessionDuration); len(duration) > 0 {
+		var problem string
+		settings.SessionDuration, problem = parseSessionDuration(duration)
+		if len(problem) > 0 {
+			problems[schema.Fields.SessionDuration] = problem
+		}
+	}
+	if strings.HasPrefix(settings.MfaSerial, "arn:") {
+		if problem := checkMfaARN(settings.MfaSerial); len(problem) > 0 {
+			problems[schema.Fields.MfaSerial] = problem
+		}
+	}
+	if _, ok := browserToPath[settings.Browser]; len(settings.Browser) > 0 && !ok {
+		problems[schema.Fields.Browser] = fmt.Sprintf("%q is not an option", settings.Browser)
+	}
+	if len(problems) > 0 {
+		lines := []string{}
+		for title, problem := range problems {
+			lines = append(lines, fmt.Sprintf("  %s: %s", title, problem))
+		}
+		sort.Strings(lines)
+		return nil, fmt.Errorf("The settings of %q in the %s section are not valid:\n%s", item.Overview.Title, schema.Section, strings.Join(lines, "\n"))
+	}
+	return settings, nil
+}
+
+// checkRoleARN describes what is wrong with the role ARN, or returns an empty string when it is valid
+func checkRoleARN(roleARN string) string {
+	parsed, errParse := arn.Parse(roleARN)
+	if errParse != nil {
+		return fmt.Sprintf("%q isn't an ARN", roleARN)
+	}
+	if parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return fmt.Sprintf("%q isn't the ARN of an IAM role", roleARN)
+	}
+	return ""
+}
+
+// checkMfaARN describes what is wrong with the ARN of a virtual MFA device, or returns an empty string when it is valid
+func checkMfaARN(mfaARN string) string {
+	parsed, errParse := arn.Parse(mfaARN)
+	if errParse != nil {
+		return fmt.Sprintf("%q isn't an ARN", mfaARN)
+	}
+	if parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "mfa/") {
+		return fmt.Sprintf("%q isn't the ARN of an MFA device", mfaARN)
+	}
+	return ""
+}
+
+// parseSessionDuration reads a duration such as "90m" or a number of seconds, describing what is wrong
+// with it when it can't be used
+func parseSessionDuration(value string) (time.Duration, string) {
+	duration, errParse := time.ParseDuration(value)
+	if errParse != nil {
+		seconds, errAtoi := strconv.Atoi(value)
+		if errAtoi != nil {
+			return 0, fmt.Sprintf("%q isn't a duration such as 1h or a number of seconds", value)
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	if duration < minSessionDuration || duration > maxSessionDuration {
+		return 0, fmt.Sprintf("%s isn't between %s and %s", duration, minSessionDuration, maxSessionDuration)
+	}
+	return duration, ""
+}
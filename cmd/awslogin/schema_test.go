@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/op/optest"
+)
+
+// newSettingsItem returns an item holding the given fields in the ACCOUNT_INFO section
+func newSettingsItem(fields map[string]string) op.Item {
+	item := optest.NewItem("uuid-7", "AWS zeta", testSectionName, testFieldTitle, "zeta")
+	for title, value := range fields {
+		item.Details.Sections[0].Fields = append(item.Details.Sections[0].Fields, op.SectionField{K: "string", T: title, V: value})
+	}
+	return item
+}
+
+func TestParseSettings(t *testing.T) {
+	item := newSettingsItem(map[string]string{
+		"AWS_PROFILE":      "zeta-admin",
+		"REGION":           "us-gov-west-1",
+		"CONSOLE_PATH":     "/s3/home",
+		"ROLE_ARN":         "arn:aws-us-gov:iam::123456789012:role/Admin",
+		"SESSION_DURATION": "3600",
+		"BROWSER":          browserFirefox,
+	})
+
+	settings, err := parseSettings(&item, defaultSchema(testSectionName, testFieldTitle))
+	require.NoError(t, err)
+	assert.Equal(t, &accountSettings{
+		Alias:           "zeta",
+		Profile:         "zeta-admin",
+		Region:          "us-gov-west-1",
+		ConsolePath:     "s3/home",
+		RoleARN:         "arn:aws-us-gov:iam::123456789012:role/Admin",
+		SessionDuration: time.Hour,
+		Browser:         browserFirefox,
+	}, settings)
+
+	// The profile defaults to the alias
+	item = newSettingsItem(nil)
+	settings, err = parseSettings(&item, defaultSchema(testSectionName, testFieldTitle))
+	require.NoError(t, err)
+	assert.Equal(t, aliasSettings("zeta"), settings)
+}
+
+func TestParseSettingsErrors(t *testing.T) {
+	item := newSettingsItem(map[string]string{
+		"REGION":           "virginia",
+		"CONSOLE_PATH":     "https://console.aws.amazon.com/s3",
+		"ROLE_ARN":         "arn:aws:iam::123456789012:user/admin",
+		"SESSION_DURATION": "48h",
+		"BROWSER":          "lynx",
+	})
+
+	_, err := parseSettings(&item, defaultSchema(testSectionName, testFieldTitle))
+	require.Error(t, err)
+	assert.Equal(t, `The settings of "AWS zeta" in the ACCOUNT_INFO section are not valid:
+  BROWSER: "lynx" is not an option
+  CONSOLE_PATH: "https://console.aws.amazon.com/s3" should be a path in the console rather than a URL
+  REGION: "virginia" isn't an AWS region
+  ROLE_ARN: "arn:aws:iam::123456789012:user/admin" isn't the ARN of an IAM role
+  SESSION_DURATION: 48h0m0s isn't between 15m0s and 12h0m0s`, err.Error())
+
+	item = newSettingsItem(map[string]string{"SESSION_DURATION": "soon"})
+	_, err = parseSettings(&item, defaultSchema(testSectionName, testFieldTitle))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"soon" isn't a duration`)
+}
+
+func TestLoadSchema(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "schema.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte("section: AWS\nfields:\n  alias: Alias\n  region: Default Region\n"), 0600))
+
+	schema, err := loadSchema(filename, defaultSchema(testSectionName, testFieldTitle))
+	require.NoError(t, err)
+	assert.Equal(t, "AWS", schema.Section)
+	assert.Equal(t, "Alias", schema.Fields.Alias)
+	assert.Equal(t, "Default Region", schema.Fields.Region)
+	assert.Equal(t, "ROLE_ARN", schema.Fields.RoleARN, "settings left out of the file keep their default")
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("section: AWS\nfields:\n  alias: Alias\n  colour: Colour\n"), 0600))
+	_, err = loadSchema(filename, defaultSchema(testSectionName, testFieldTitle))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "colour")
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("fields:\n  alias: \"\"\n"), 0600))
+	_, err = loadSchema(filename, defaultSchema(testSectionName, testFieldTitle))
+	assert.EqualError(t, err, "The schema needs the field holding the account alias")
+}
+
+func TestRunUsesItemProfile(t *testing.T) {
+	client := optest.New(newSettingsItem(map[string]string{"AWS_PROFILE": "zeta-admin", "BROWSER": browserSafari}))
+	client.Totps["uuid-7"] = "777777"
+	flow, calls, _ := newTestFlow(client, "", map[string]time.Duration{"zeta": time.Hour})
+
+	// The session of the alias doesn't count since the profile is what aws-vault logs into
+	_, settings, err := flow.run(context.Background(), "", []string{"zeta"})
+	require.NoError(t, err)
+	assert.Equal(t, []loginURLCall{{profile: "zeta-admin", mfaToken: "777777"}}, *calls)
+	assert.Equal(t, browserSafari, settings.Browser)
+}
@@ -40,12 +40,28 @@ func generateLoginURL(region string, path string) (string, string) {
 	return loginURLPrefix, destination
 }
 
+// DefaultSessionDuration is how long the console session lasts when the account doesn't set it
+const DefaultSessionDuration = time.Hour
+
+// LoginOptions override the profile of an account in the AWS config file when they are set
+type LoginOptions struct {
+	Region          string
+	ConsolePath     string
+	RoleARN         string
+	SessionDuration time.Duration
+}
+
 func GetLoginURL(profileName string, mfaToken string, f *vault.ConfigFile, keyring keyring.Keyring) (*string, error) {
+	return GetLoginURLWithOptions(profileName, mfaToken, LoginOptions{}, f, keyring)
+}
+
+// GetLoginURLWithOptions returns the console login URL of the profile with the options applied to it
+func GetLoginURLWithOptions(profileName string, mfaToken string, options LoginOptions, f *vault.ConfigFile, keyring keyring.Keyring) (*string, error) {
 	vault.UseSession = true
 
-	sessionDuration, errParseDuration := time.ParseDuration("1h")
-	if errParseDuration != nil {
-		return nil, errParseDuration
+	sessionDuration := DefaultSessionDuration
+	if options.SessionDuration > 0 {
+		sessionDuration = options.SessionDuration
 	}
 	configLoader := vault.ConfigLoader{
 		File: f,
@@ -62,6 +78,12 @@ func GetLoginURL(profileName string, mfaToken string, f *vault.ConfigFile, keyri
 	if err != nil {
 		return nil, fmt.Errorf("Error loading config: %w", err)
 	}
+	if len(options.Region) > 0 {
+		config.Region = options.Region
+	}
+	if len(options.RoleARN) > 0 {
+		config.RoleARN = options.RoleARN
+	}
 
 	var creds *credentials.Credentials
 
@@ -90,7 +112,7 @@ func GetLoginURL(profileName string, mfaToken string, f *vault.ConfigFile, keyri
 		return nil, err
 	}
 
-	loginURLPrefix, destination := generateLoginURL(config.Region, "")
+	loginURLPrefix, destination := generateLoginURL(config.Region, options.ConsolePath)
 
 	req, err := http.NewRequest("GET", loginURLPrefix, nil)
 	if err != nil {
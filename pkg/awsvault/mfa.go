@@ -0,0 +1,27 @@
+package awsvault
+
+import (
+	"fmt"
+
+	"github.com/99designs/aws-vault/v6/vault"
+)
+
+// GetMfaSerial returns the MFA device used to log into the profile, following source_profile to the
+// profile the credentials come from when the profile itself doesn't name one. An empty serial means
+// the profile doesn't use MFA.
+func GetMfaSerial(profileName string, f *vault.ConfigFile) (string, error) {
+	configLoader := vault.ConfigLoader{
+		File:          f,
+		ActiveProfile: profileName,
+	}
+	config, err := configLoader.LoadFromProfile(profileName)
+	if err != nil {
+		return "", fmt.Errorf("Error loading config: %w", err)
+	}
+	for ; config != nil; config = config.SourceProfile {
+		if config.HasMfaSerial() {
+			return config.MfaSerial, nil
+		}
+	}
+	return "", nil
+}
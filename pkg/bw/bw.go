@@ -0,0 +1,395 @@
+// Package bw reads AWS accounts from Bitwarden items through the bw command
+package bw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/99designs/aws-vault/v6/prompt"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+)
+
+// EnvSession is the variable bw reads the session key of an unlocked vault from
+const EnvSession = "BW_SESSION"
+
+// DefaultTimeout is how long a single bw command may run before it is killed
+const DefaultTimeout = 30 * time.Second
+
+// DefaultAttempts is how many times the master password is asked for before giving up
+const DefaultAttempts = 3
+
+// envPassword passes the master password to `bw unlock` without putting it on the command line
+const envPassword = "AWSLOGIN_BW_PASSWORD"
+
+// itemKind is what the errors call an item
+const itemKind = "Bitwarden item"
+
+// The kinds of bw failures callers can check for with errors.Is
+var (
+	ErrLocked          = errors.New("The Bitwarden vault is locked")
+	ErrUnauthenticated = errors.New("Not logged in to Bitwarden, log in with `bw login` first")
+	ErrWrongPassword   = errors.New("The Bitwarden master password was not accepted")
+)
+
+// The types bw gives custom fields
+const (
+	fieldTypeText    = 0
+	fieldTypeHidden  = 1
+	fieldTypeBoolean = 2
+)
+
+// Item is a Bitwarden item as printed by `bw get item` and `bw list items`
+type Item struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	FolderID      string    `json:"folderId"`
+	CollectionIDs []string  `json:"collectionIds"`
+	RevisionDate  time.Time `json:"revisionDate"`
+	Fields        []Field   `json:"fields"`
+	Login         *Login    `json:"login"`
+}
+
+// Field is a custom field of an item
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Type  int    `json:"type"`
+}
+
+// Login holds the login of an item, of which only the one-time password seed is used
+type Login struct {
+	Totp string `json:"totp"`
+}
+
+// named is a folder or collection as printed by `bw list folders` and `bw list collections`
+type named struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Client lists the items of a folder or collection as AWS accounts. The custom fields of an item become
+// the fields of the settings section, so the alias is read from the field named like the 1Password field.
+type Client struct {
+	// Session is the key of the unlocked vault, read from BW_SESSION or set when the vault is unlocked
+	Session string
+	// Folder and Collection are the names or IDs the items are listed from, where neither lists the
+	// items with an alias field from the whole vault
+	Folder     string
+	Collection string
+	// Section and AliasField are where the login flow reads the fields and the account alias from
+	Section    string
+	AliasField string
+	// Password asks for the master password, defaulting to a terminal prompt
+	Password func(message string) (string, error)
+	// Attempts is how many times the master password is asked for, defaulting to DefaultAttempts
+	Attempts int
+	// Timeout limits each bw command, defaulting to DefaultTimeout
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	unlocked bool
+	// unlockMu makes commands wait for an unlock in progress
+	unlockMu sync.Mutex
+}
+
+var _ provider.Provider = (*Client)(nil)
+
+// New returns the client listing the folder or collection, using the session exported in BW_SESSION
+func New(folder, collection, section, aliasField string) *Client {
+	return &Client{
+		Session:    os.Getenv(EnvSession),
+		Folder:     folder,
+		Collection: collection,
+		Section:    section,
+		AliasField: aliasField,
+	}
+}
+
+// Exec returns the bw command for the args with the session of the client in its environment
+func (client *Client) Exec(ctx context.Context, args []string) (*exec.Cmd, error) {
+	bwPath, errLookPath := exec.LookPath("bw")
+	if errLookPath != nil {
+		return nil, errLookPath
+	}
+	client.mu.Lock()
+	session := client.Session
+	client.mu.Unlock()
+
+	cmd := exec.CommandContext(ctx, bwPath, append(args, "--nointeraction")...)
+	// bw keeps its data in the home or app data directory so the environment is passed on, apart from
+	// a session that the client hasn't chosen
+	env := []string{}
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, EnvSession+"=") {
+			env = append(env, variable)
+		}
+	}
+	if len(session) > 0 {
+		env = append(env, fmt.Sprintf("%s=%s", EnvSession, session))
+	}
+	cmd.Env = env
+	return cmd, nil
+}
+
+// timeout returns how long each bw command of the client may run
+func (client *Client) timeout() time.Duration {
+	if client.Timeout > 0 {
+		return client.Timeout
+	}
+	return DefaultTimeout
+}
+
+// output runs bw with the args and returns its output, killing it once the timeout of the client passes
+func (client *Client) output(ctx context.Context, args []string, extraEnv ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, client.timeout())
+	defer cancel()
+
+	cmd, errExec := client.Exec(ctx, args)
+	if errExec != nil {
+		return nil, errExec
+	}
+	cmd.Env = append(cmd.Env, extraEnv...)
+	out, errOutput := cmd.Output()
+	if errOutput != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("bw %s did not finish: %w", strings.Join(args[:2], " "), ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(errOutput, &exitErr) {
+		return nil, classify(args, strings.TrimSpace(string(exitErr.Stderr)), errOutput)
+	}
+	return out, errOutput
+}
+
+// classify turns what bw printed to stderr into an error callers can check for
+func classify(args []string, stderr string, err error) error {
+	message := strings.ToLower(stderr)
+	switch {
+	case strings.Contains(message, "vault is locked"):
+		return ErrLocked
+	case strings.Contains(message, "you are not logged in"):
+		return ErrUnauthenticated
+	case strings.Contains(message, "invalid master password"):
+		return ErrWrongPassword
+	case strings.Contains(message, "more than one result"):
+		return fmt.Errorf("%w: %s", op.ErrAmbiguousItem, stderr)
+	case message == "not found." && len(args) > 2:
+		return &provider.NotFoundError{Kind: itemKind, Name: args[2]}
+	case len(stderr) > 0:
+		return fmt.Errorf("bw %s failed: %s", strings.Join(args[:2], " "), stderr)
+	}
+	return err
+}
+
+// run runs bw with the args once the vault is unlocked, unlocking it again when the session has expired
+func (client *Client) run(ctx context.Context, args []string) ([]byte, error) {
+	session, errUnlock := client.ensureUnlocked(ctx, nil)
+	if errUnlock != nil {
+		return nil, errUnlock
+	}
+	out, errOutput := client.output(ctx, args)
+	if !errors.Is(errOutput, ErrLocked) {
+		return out, errOutput
+	}
+	_, errUnlock = client.ensureUnlocked(ctx, &session)
+	if errUnlock != nil {
+		return nil, errUnlock
+	}
+	return client.output(ctx, args)
+}
+
+// ensureUnlocked returns the session of the unlocked vault, checking with `bw status` the first time and
+// asking for the master password when it is locked. A refused session is unlocked again unless another
+// command already has, so commands running at the same time only ask once.
+func (client *Client) ensureUnlocked(ctx context.Context, refused *string) (string, error) {
+	client.unlockMu.Lock()
+	defer client.unlockMu.Unlock()
+	client.mu.Lock()
+	session, unlocked := client.Session, client.unlocked
+	client.mu.Unlock()
+	if unlocked && (refused == nil || *refused != session) {
+		return session, nil
+	}
+
+	if refused == nil {
+		out, errStatus := client.output(ctx, []string{"status", "--raw"})
+		if errStatus != nil {
+			return "", errStatus
+		}
+		var status struct {
+			Status string `json:"status"`
+		}
+		if errUnmarshal := json.Unmarshal(out, &status); errUnmarshal != nil {
+			return "", fmt.Errorf("Unable to read the output of bw status: %w", errUnmarshal)
+		}
+		switch status.Status {
+		case "unauthenticated":
+			return "", ErrUnauthenticated
+		case "unlocked":
+			client.mu.Lock()
+			client.unlocked = true
+			client.mu.Unlock()
+			return session, nil
+		}
+	}
+	errUnlock := client.Unlock(ctx)
+	if errUnlock != nil {
+		return "", errUnlock
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.Session, nil
+}
+
+// Unlock asks for the master password and keeps the session key bw prints for the next commands
+func (client *Client) Unlock(ctx context.Context) error {
+	readPassword := client.Password
+	if readPassword == nil {
+		readPassword = prompt.TerminalSecretPrompt
+	}
+	attempts := client.Attempts
+	if attempts < 1 {
+		attempts = DefaultAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		password, errPassword := readPassword("Enter your Bitwarden master password: ")
+		if errPassword != nil {
+			return errPassword
+		}
+		out, errUnlock := client.output(ctx, []string{"unlock", "--raw", "--passwordenv", envPassword}, fmt.Sprintf("%s=%s", envPassword, password))
+		if errUnlock == nil {
+			session := strings.TrimSpace(string(out))
+			if len(session) == 0 || strings.ContainsAny(session, " \t\r\n") {
+				return errors.New("Unable to read the session key printed by bw unlock")
+			}
+			client.mu.Lock()
+			client.Session, client.unlocked = session, true
+			client.mu.Unlock()
+			return nil
+		}
+		if !errors.Is(errUnlock, ErrWrongPassword) || attempt >= attempts {
+			return errUnlock
+		}
+		fmt.Fprintln(os.Stderr, "The Bitwarden master password was not accepted, try again.")
+	}
+}
+
+// resolve returns the ID of the folder or collection with the name or ID
+func (client *Client) resolve(ctx context.Context, kind, nameOrID string) (string, error) {
+	out, errList := client.run(ctx, []string{"list", kind, "--search", nameOrID})
+	if errList != nil {
+		return "", errList
+	}
+	found := []named{}
+	if errUnmarshal := json.Unmarshal(out, &found); errUnmarshal != nil {
+		return "", fmt.Errorf("Unable to read the output of bw list %s: %w", kind, errUnmarshal)
+	}
+	for _, candidate := range found {
+		if candidate.ID == nameOrID || candidate.Name == nameOrID {
+			return candidate.ID, nil
+		}
+	}
+	return "", fmt.Errorf("The Bitwarden %s %q was not found", strings.TrimSuffix(kind, "s"), nameOrID)
+}
+
+// ListItems lists the items of the folder or collection of the client. Bitwarden has no tags so the tags
+// asked for by the login flow aren't used.
+func (client *Client) ListItems(ctx context.Context, tags string) ([]op.Item, error) {
+	args := []string{"list", "items"}
+	if len(client.Folder) > 0 {
+		folderID, errResolve := client.resolve(ctx, "folders", client.Folder)
+		if errResolve != nil {
+			return nil, errResolve
+		}
+		args = append(args, "--folderid", folderID)
+	}
+	if len(client.Collection) > 0 {
+		collectionID, errResolve := client.resolve(ctx, "collections", client.Collection)
+		if errResolve != nil {
+			return nil, errResolve
+		}
+		args = append(args, "--collectionid", collectionID)
+	}
+
+	out, errList := client.run(ctx, args)
+	if errList != nil {
+		return nil, errList
+	}
+	found := []Item{}
+	if errUnmarshal := json.Unmarshal(out, &found); errUnmarshal != nil {
+		return nil, fmt.Errorf("Unable to read the output of bw list items: %w", errUnmarshal)
+	}
+	whole := len(client.Folder) == 0 && len(client.Collection) == 0
+	items := []op.Item{}
+	for _, bwItem := range found {
+		if whole && !bwItem.hasField(client.AliasField) {
+			continue
+		}
+		items = append(items, client.item(bwItem))
+	}
+	return items, nil
+}
+
+// GetItem returns the item with the ID or name
+func (client *Client) GetItem(ctx context.Context, name string) (*op.Item, error) {
+	out, errGet := client.run(ctx, []string{"get", "item", name})
+	if errGet != nil {
+		return nil, errGet
+	}
+	var bwItem Item
+	if errUnmarshal := json.Unmarshal(out, &bwItem); errUnmarshal != nil {
+		return nil, fmt.Errorf("Unable to read the output of bw get item: %w", errUnmarshal)
+	}
+	item := client.item(bwItem)
+	return &item, nil
+}
+
+// GetTotp returns the one-time password bw generates for the item
+func (client *Client) GetTotp(ctx context.Context, name string) (*string, error) {
+	out, errGet := client.run(ctx, []string{"get", "totp", name})
+	if errGet != nil {
+		return nil, errGet
+	}
+	code := strings.TrimSpace(string(out))
+	return &code, nil
+}
+
+// hasField reports whether the item has a custom field with the name
+func (bwItem Item) hasField(name string) bool {
+	for _, field := range bwItem.Fields {
+		if field.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// item turns the Bitwarden item into an item with its custom fields in the settings section
+func (client *Client) item(bwItem Item) op.Item {
+	section := op.Section{Name: "bw", Title: client.Section}
+	for _, field := range bwItem.Fields {
+		switch field.Type {
+		case fieldTypeText, fieldTypeBoolean:
+			section.Fields = append(section.Fields, op.SectionField{K: "string", T: field.Name, V: field.Value})
+		case fieldTypeHidden:
+			section.Fields = append(section.Fields, op.SectionField{K: "concealed", T: field.Name, V: field.Value})
+		}
+	}
+	if bwItem.Login != nil && len(bwItem.Login.Totp) > 0 {
+		section.Fields = append(section.Fields, op.SectionField{K: "concealed", N: "TOTP_bw", T: "totp", V: bwItem.Login.Totp})
+	}
+	return op.Item{
+		Uuid:      bwItem.ID,
+		UpdatedAt: bwItem.RevisionDate,
+		Overview:  op.Overview{Title: bwItem.Name},
+		Details:   op.Details{Sections: []op.Section{section}},
+	}
+}
@@ -0,0 +1,149 @@
+package bw
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// fakeBwScript answers like bw with an AWS folder holding two items, unlocked by the password "master"
+const fakeBwScript = `#!/bin/sh
+alpha='{"id":"item-1","name":"AWS alpha","folderId":"folder-1","revisionDate":"2021-09-01T12:00:00.000Z","fields":[{"name":"ACCOUNT_ALIAS","value":"alpha","type":0},{"name":"ROLE_ARN","value":"arn:aws:iam::123456789012:role/admin","type":1}],"login":{"totp":"otpauth://totp/AWS:alpha?secret=JBSWY3DPEHPK3PXP"}}'
+beta='{"id":"item-2","name":"AWS beta","folderId":"folder-1","fields":[{"name":"ACCOUNT_ALIAS","value":"beta","type":0}],"login":{"totp":null}}'
+bank='{"id":"item-3","name":"Bank","login":{"username":"user"}}'
+if [ "$1" = "status" ]; then
+  if [ "$BW_SESSION" = "good-session" ]; then echo '{"status":"unlocked"}'; else echo '{"status":"locked"}'; fi
+  exit 0
+fi
+if [ "$1" = "unlock" ]; then
+  if [ "$AWSLOGIN_BW_PASSWORD" = "master" ]; then echo "good-session"; exit 0; fi
+  echo "Invalid master password." >&2; exit 1
+fi
+if [ "$BW_SESSION" != "good-session" ]; then echo "Vault is locked." >&2; exit 1; fi
+case "$1 $2" in
+  "list folders") echo '[{"id":"folder-1","name":"AWS"}]' ;;
+  "list items")
+    if [ "$3" = "--folderid" ]; then echo "[$alpha,$beta]"; else echo "[$alpha,$beta,$bank]"; fi
+    ;;
+  "get item")
+    case "$3" in
+      "item-1"|"AWS alpha") echo "$alpha" ;;
+      *) echo "Not found." >&2; exit 1 ;;
+    esac
+    ;;
+  "get totp")
+    case "$3" in
+      "item-1") echo "123456" ;;
+      *) echo "Not found." >&2; exit 1 ;;
+    esac
+    ;;
+  *) exit 1 ;;
+esac
+`
+
+func installFakeBw(t *testing.T) {
+	dir := t.TempDir()
+	// #nosec G306 the fake bw must be executable
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bw"), []byte(fakeBwScript), 0700))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func newTestClient(t *testing.T, session string) *Client {
+	installFakeBw(t)
+	t.Setenv(EnvSession, session)
+	client := New("AWS", "", "ACCOUNT_INFO", "ACCOUNT_ALIAS")
+	client.Password = func(string) (string, error) {
+		return "", errors.New("the password should not be asked for")
+	}
+	return client
+}
+
+func TestListItemsWithSession(t *testing.T) {
+	client := newTestClient(t, "good-session")
+
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "item-1", items[0].Uuid)
+	assert.Equal(t, "AWS alpha", items[0].Overview.Title)
+	assert.Equal(t, []op.SectionField{
+		{K: "string", T: "ACCOUNT_ALIAS", V: "alpha"},
+		{K: "concealed", T: "ROLE_ARN", V: "arn:aws:iam::123456789012:role/admin"},
+		{K: "concealed", N: "TOTP_bw", T: "totp", V: "otpauth://totp/AWS:alpha?secret=JBSWY3DPEHPK3PXP"},
+	}, items[0].Details.Sections[0].Fields)
+	_, ok := items[1].OTPSecret()
+	assert.False(t, ok)
+}
+
+func TestListItemsWholeVault(t *testing.T) {
+	client := newTestClient(t, "good-session")
+	client.Folder = ""
+
+	// Only the items with an alias are accounts
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+
+	client.Folder = "Personal"
+	_, err = client.ListItems(context.Background(), "aws")
+	assert.EqualError(t, err, `The Bitwarden folder "Personal" was not found`)
+}
+
+func TestUnlock(t *testing.T) {
+	client := newTestClient(t, "")
+	passwords := []string{"wrong", "master"}
+	client.Password = func(string) (string, error) {
+		password := passwords[0]
+		passwords = passwords[1:]
+		return password, nil
+	}
+
+	totp, err := client.GetTotp(context.Background(), "item-1")
+	require.NoError(t, err)
+	assert.Equal(t, "123456", *totp)
+	assert.Equal(t, "good-session", client.Session)
+	assert.Empty(t, passwords)
+
+	// The unlocked session is used from then on
+	_, err = client.GetItem(context.Background(), "item-1")
+	assert.NoError(t, err)
+}
+
+func TestUnlockExpiredSession(t *testing.T) {
+	client := newTestClient(t, "good-session")
+	_, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+
+	// The vault is locked again once the session key stops working
+	client.Session = "expired-session"
+	client.Password = func(string) (string, error) {
+		return "master", nil
+	}
+	_, err = client.GetItem(context.Background(), "AWS alpha")
+	require.NoError(t, err)
+	assert.Equal(t, "good-session", client.Session)
+
+	client.Session = "expired-session"
+	client.Attempts = 1
+	client.Password = func(string) (string, error) {
+		return "wrong", nil
+	}
+	_, err = client.GetItem(context.Background(), "AWS alpha")
+	assert.True(t, errors.Is(err, ErrWrongPassword))
+}
+
+func TestGetItemNotFound(t *testing.T) {
+	client := newTestClient(t, "good-session")
+
+	_, err := client.GetItem(context.Background(), "AWS gamma")
+	assert.True(t, errors.Is(err, op.ErrItemNotFound))
+	assert.EqualError(t, err, `The Bitwarden item "AWS gamma" was not found`)
+}
@@ -0,0 +1,136 @@
+// Package conformance checks that an executable answers the external provider protocol the way awslogin expects.
+// Provider authors run it against their provider with
+//
+//	AWSLOGIN_CONFORMANCE_COMMAND="/path/to/provider --flag" go test github.com/deptofdefense/awslogin/pkg/external/conformance
+//
+// or call Run from a Go test of their own. The provider needs at least one account.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/deptofdefense/awslogin/pkg/external"
+)
+
+// EnvCommand names the provider executable, followed by its arguments, that TestConformance runs
+const EnvCommand = "AWSLOGIN_CONFORMANCE_COMMAND"
+
+// missingName is a name no account should have
+const missingName = "awslogin-conformance-missing-account"
+
+// Run checks the provider answers every request with a valid response within its timeout
+func Run(t *testing.T, command *external.Command) {
+	ctx := context.Background()
+	t.Logf("Checking %s %v", command.Path, command.Args)
+
+	var accounts []external.Account
+	t.Run("list", func(t *testing.T) {
+		response := do(ctx, t, command, external.Request{Request: external.RequestList})
+		if len(response.Accounts) == 0 {
+			t.Fatal("The list request must be answered with at least one account to check the others")
+		}
+		accounts = response.Accounts
+
+		// The IDs don't change between requests
+		again := do(ctx, t, command, external.Request{Request: external.RequestList})
+		if fmt.Sprint(ids(accounts)) != fmt.Sprint(ids(again.Accounts)) {
+			t.Errorf("The IDs %v were listed again as %v", ids(accounts), ids(again.Accounts))
+		}
+	})
+	if len(accounts) == 0 {
+		t.FailNow()
+	}
+
+	titles := map[string]int{}
+	for _, account := range accounts {
+		titles[account.Title]++
+	}
+	described := map[string]*external.Account{}
+	t.Run("describe", func(t *testing.T) {
+		for _, account := range accounts {
+			response := do(ctx, t, command, external.Request{Request: external.RequestDescribe, Name: account.ID})
+			if response.Account.ID != account.ID || response.Account.Title != account.Title {
+				t.Errorf("The account %q listed as %q was described as %q titled %q", account.ID, account.Title, response.Account.ID, response.Account.Title)
+			}
+			described[account.ID] = response.Account
+
+			if titles[account.Title] > 1 {
+				expectError(ctx, t, command, external.Request{Request: external.RequestDescribe, Name: account.Title}, external.ErrorCodeAmbiguous)
+				continue
+			}
+			byTitle := do(ctx, t, command, external.Request{Request: external.RequestDescribe, Name: account.Title})
+			if byTitle.Account.ID != account.ID {
+				t.Errorf("The title %q described the account %q instead of %q", account.Title, byTitle.Account.ID, account.ID)
+			}
+		}
+		expectError(ctx, t, command, external.Request{Request: external.RequestDescribe, Name: missingName}, external.ErrorCodeNotFound)
+	})
+
+	t.Run("totp", func(t *testing.T) {
+		codes := 0
+		for _, account := range accounts {
+			response, errDo := command.Do(ctx, external.Request{Request: external.RequestTotp, Name: account.ID})
+			if errDo != nil {
+				t.Errorf("The totp request for %q failed: %v", account.ID, errDo)
+				continue
+			}
+			if response.Error == nil {
+				codes++
+				continue
+			}
+			// Without a code the one-time passwords are generated from the secret of the description
+			if described[account.ID] == nil || len(described[account.ID].OTPSecret) == 0 {
+				t.Errorf("The account %q has neither a code nor a one-time password secret: %v", account.ID, response.Error)
+			}
+		}
+		if codes == 0 {
+			t.Log("No account answered the totp request with a code")
+		}
+		expectError(ctx, t, command, external.Request{Request: external.RequestTotp, Name: missingName}, external.ErrorCodeNotFound)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		expectError(ctx, t, command, external.Request{Request: "awslogin-conformance-request"}, external.ErrorCodeUnsupported)
+		expectError(ctx, t, command, external.Request{Version: 1000, Request: external.RequestList}, external.ErrorCodeUnsupported)
+	})
+}
+
+// do runs the request, failing the test unless it is answered with a valid response that isn't an error
+func do(ctx context.Context, t *testing.T, command *external.Command, request external.Request) *external.Response {
+	t.Helper()
+	started := time.Now()
+	response, errDo := command.Do(ctx, request)
+	if errDo != nil {
+		t.Fatalf("The %s request for %q failed: %v", request.Request, request.Name, errDo)
+	}
+	if response.Error != nil {
+		t.Fatalf("The %s request for %q was answered with the error %v", request.Request, request.Name, response.Error)
+	}
+	t.Logf("The %s request for %q was answered in %s", request.Request, request.Name, time.Since(started).Round(time.Millisecond))
+	return response
+}
+
+// expectError runs the request, failing the test unless it is answered with the error code
+func expectError(ctx context.Context, t *testing.T, command *external.Command, request external.Request, code string) {
+	t.Helper()
+	response, errDo := command.Do(ctx, request)
+	switch {
+	case errDo != nil:
+		t.Errorf("The %s request for %q failed instead of answering with the %q error: %v", request.Request, request.Name, code, errDo)
+	case response.Error == nil:
+		t.Errorf("The %s request for %q was answered instead of answering with the %q error", request.Request, request.Name, code)
+	case response.Error.Code != code:
+		t.Errorf("The %s request for %q was answered with the error %v instead of %q", request.Request, request.Name, response.Error, code)
+	}
+}
+
+func ids(accounts []external.Account) []string {
+	result := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		result = append(result, account.ID)
+	}
+	return result
+}
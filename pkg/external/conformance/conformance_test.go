@@ -0,0 +1,32 @@
+package conformance
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/external"
+)
+
+// TestConformance checks the provider named by AWSLOGIN_CONFORMANCE_COMMAND, or the reference provider with the
+// accounts in testdata
+func TestConformance(t *testing.T) {
+	if command := strings.Fields(os.Getenv(EnvCommand)); len(command) > 0 {
+		Run(t, external.New(command[0], command[1:], "ACCOUNT_INFO"))
+		return
+	}
+
+	provider := filepath.Join(t.TempDir(), "awslogin-example-provider")
+	// #nosec G204 the reference provider is built from this module
+	build := exec.Command("go", "build", "-o", provider, "github.com/deptofdefense/awslogin/cmd/awslogin-example-provider")
+	out, errBuild := build.CombinedOutput()
+	require.NoError(t, errBuild, string(out))
+
+	accounts, errAbs := filepath.Abs("testdata/accounts.json")
+	require.NoError(t, errAbs)
+	Run(t, external.New(provider, []string{accounts}, "ACCOUNT_INFO"))
+}
@@ -0,0 +1,180 @@
+// Package external reads AWS accounts from a user-configured executable that answers JSON requests on its stdin
+// with JSON responses on its stdout. Each request runs the executable once:
+//
+//	{"version":1,"request":"list"}                     -> {"accounts":[{"id":"...","title":"AWS alpha"}]}
+//	{"version":1,"request":"describe","name":"..."}    -> {"account":{"id":"...","title":"...","fields":{...}}}
+//	{"version":1,"request":"totp","name":"..."}        -> {"code":"123456"}
+//
+// Any request may be answered with {"error":{"code":"not_found","message":"..."}} instead, and a request the
+// provider doesn't know with the "unsupported" error code.
+package external
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+)
+
+// DefaultTimeout is how long the executable may take to answer a request
+const DefaultTimeout = 30 * time.Second
+
+// accountKind is what the errors call an account
+const accountKind = "external provider account"
+
+// Command runs the executable for each request
+type Command struct {
+	Path string
+	Args []string
+	// Section is where the login flow reads the fields from
+	Section string
+	// Timeout limits each request, defaulting to DefaultTimeout
+	Timeout time.Duration
+}
+
+var _ provider.Provider = (*Command)(nil)
+
+// New returns the provider running the executable at path with the args
+func New(path string, args []string, section string) *Command {
+	return &Command{
+		Path:    path,
+		Args:    args,
+		Section: section,
+		Timeout: DefaultTimeout,
+	}
+}
+
+// Do runs the executable for the request and returns its validated response, which may be an error response
+func (command *Command) Do(ctx context.Context, request Request) (*Response, error) {
+	timeout := command.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if request.Version == 0 {
+		request.Version = ProtocolVersion
+	}
+	encoded, errMarshal := json.Marshal(request)
+	if errMarshal != nil {
+		return nil, errMarshal
+	}
+
+	// #nosec G204 the executable is chosen by the user to act as the provider
+	cmd := exec.CommandContext(ctx, command.Path, command.Args...)
+	cmd.Stdin = bytes.NewReader(append(encoded, '\n'))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	errRun := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("The external provider %s did not answer the %s request within %s: %w", command.Path, request.Request, timeout, ctx.Err())
+	}
+	if errContext := ctx.Err(); errContext != nil {
+		return nil, errContext
+	}
+
+	// A provider may exit with a failure after answering with an error
+	response, errDecode := DecodeResponse(request.Request, &stdout)
+	if errRun != nil && (errDecode != nil || response.Error == nil) {
+		if message := strings.TrimSpace(stderr.String()); len(message) > 0 {
+			return nil, fmt.Errorf("The external provider %s failed to answer the %s request: %s", command.Path, request.Request, message)
+		}
+		return nil, fmt.Errorf("The external provider %s failed to answer the %s request: %w", command.Path, request.Request, errRun)
+	}
+	if errDecode != nil {
+		return nil, fmt.Errorf("%w to the %s request", errDecode, request.Request)
+	}
+	return response, nil
+}
+
+// do runs the request and turns an error response into the error the login flow expects
+func (command *Command) do(ctx context.Context, request Request) (*Response, error) {
+	response, errDo := command.Do(ctx, request)
+	if errDo != nil {
+		return nil, errDo
+	}
+	if response.Error == nil {
+		return response, nil
+	}
+	switch response.Error.Code {
+	case ErrorCodeNotFound:
+		return nil, &provider.NotFoundError{Kind: accountKind, Name: request.Name}
+	case ErrorCodeAmbiguous:
+		return nil, fmt.Errorf("%w %q: %s", op.ErrAmbiguousItem, request.Name, response.Error.Message)
+	}
+	return nil, fmt.Errorf("The external provider %s failed to answer the %s request: %w", command.Path, request.Request, response.Error)
+}
+
+// ListItems lists the accounts of the provider. The tags asked for by the login flow are those of 1Password so
+// they aren't sent.
+func (command *Command) ListItems(ctx context.Context, tags string) ([]op.Item, error) {
+	response, errDo := command.do(ctx, Request{Request: RequestList})
+	if errDo != nil {
+		return nil, errDo
+	}
+	items := make([]op.Item, 0, len(response.Accounts))
+	for _, account := range response.Accounts {
+		items = append(items, command.item(account))
+	}
+	return items, nil
+}
+
+// GetItem describes the account with the ID or title given as the name
+func (command *Command) GetItem(ctx context.Context, name string) (*op.Item, error) {
+	response, errDo := command.do(ctx, Request{Request: RequestDescribe, Name: name})
+	if errDo != nil {
+		return nil, errDo
+	}
+	item := command.item(*response.Account)
+	if len(item.Details.Sections) == 0 {
+		item.Details.Sections = []op.Section{{Name: "external", Title: command.Section}}
+	}
+	return &item, nil
+}
+
+// GetTotp asks the provider for the current one-time password of the account
+func (command *Command) GetTotp(ctx context.Context, name string) (*string, error) {
+	response, errDo := command.do(ctx, Request{Request: RequestTotp, Name: name})
+	if errDo != nil {
+		return nil, errDo
+	}
+	return &response.Code, nil
+}
+
+// item turns the account into an item with its fields, in name order, as the fields of the settings section
+func (command *Command) item(account Account) op.Item {
+	item := op.Item{
+		Uuid:     account.ID,
+		Overview: op.Overview{Title: account.Title},
+	}
+	if account.UpdatedAt != nil {
+		item.UpdatedAt = *account.UpdatedAt
+	}
+	if account.Fields == nil && len(account.OTPSecret) == 0 {
+		return item
+	}
+
+	names := make([]string, 0, len(account.Fields))
+	for name := range account.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	section := op.Section{Name: "external", Title: command.Section}
+	for _, name := range names {
+		section.Fields = append(section.Fields, op.SectionField{K: "string", T: name, V: account.Fields[name]})
+	}
+	if len(account.OTPSecret) > 0 {
+		section.Fields = append(section.Fields, op.SectionField{K: "concealed", N: "TOTP_external", T: "otp_secret", V: account.OTPSecret})
+	}
+	item.Details.Sections = []op.Section{section}
+	return item
+}
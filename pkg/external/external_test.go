@@ -0,0 +1,116 @@
+package external
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// newTestCommand returns the provider running a script that answers every request with the output
+func newTestCommand(t *testing.T, script string) *Command {
+	path := filepath.Join(t.TempDir(), "provider")
+	// #nosec G306 the fake provider must be executable
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700))
+	return New(path, nil, "ACCOUNT_INFO")
+}
+
+func TestListItems(t *testing.T) {
+	command := newTestCommand(t, `read request
+case "$request" in
+  *'"version":1,"request":"list"'*) ;;
+  *) echo "unexpected request $request" >&2; exit 1 ;;
+esac
+echo '{"accounts":[{"id":"1","title":"AWS alpha","updated_at":"2021-09-01T12:00:00Z"},{"id":"2","title":"AWS beta","fields":{"REGION":"us-gov-west-1","ACCOUNT_ALIAS":"beta"},"otp_secret":"JBSWY3DPEHPK3PXP"}]}'
+`)
+
+	items, err := command.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "1", items[0].Uuid)
+	assert.Equal(t, "AWS alpha", items[0].Overview.Title)
+	assert.Equal(t, time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC), items[0].UpdatedAt)
+	assert.Empty(t, items[0].Details.Sections)
+
+	// A listed account with fields has its details
+	require.Len(t, items[1].Details.Sections, 1)
+	assert.Equal(t, []op.SectionField{
+		{K: "string", T: "ACCOUNT_ALIAS", V: "beta"},
+		{K: "string", T: "REGION", V: "us-gov-west-1"},
+		{K: "concealed", N: "TOTP_external", T: "otp_secret", V: "JBSWY3DPEHPK3PXP"},
+	}, items[1].Details.Sections[0].Fields)
+	secret, ok := items[1].OTPSecret()
+	assert.True(t, ok)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", secret)
+}
+
+func TestErrorResponses(t *testing.T) {
+	command := newTestCommand(t, `read request
+case "$request" in
+  *'"name":"missing"'*) echo '{"error":{"code":"not_found","message":"no such account"}}' ;;
+  *'"name":"AWS twin"'*) echo '{"error":{"code":"ambiguous","message":"2 accounts are titled AWS twin"}}'; exit 1 ;;
+  *) echo '{"error":{"code":"locked","message":"unlock the store first"}}' ;;
+esac
+`)
+
+	_, err := command.GetItem(context.Background(), "missing")
+	assert.True(t, errors.Is(err, op.ErrItemNotFound))
+	assert.EqualError(t, err, `The external provider account "missing" was not found`)
+
+	_, err = command.GetTotp(context.Background(), "AWS twin")
+	assert.True(t, errors.Is(err, op.ErrAmbiguousItem))
+
+	_, err = command.GetItem(context.Background(), "AWS alpha")
+	assert.EqualError(t, err, "The external provider "+command.Path+" failed to answer the describe request: locked: unlock the store first")
+}
+
+func TestInvalidResponses(t *testing.T) {
+	responses := map[string]string{
+		`{"code":"12ab56"}`:                       `the code "12ab56" isn't 6 to 8 digits`,
+		`{"code":"123456","account":{"id":"1"}}`:  `the totp request is answered with "code" alone, not [account code]`,
+		`{"accounts":[]}`:                         `the totp request is answered with "code" alone, not [accounts]`,
+		`{"code":"123456","expires":30}`:          `json: unknown field "expires"`,
+		`{"code":"123456"}{"code":"654321"}`:      `more than one JSON value`,
+		`{"error":{"message":"no code"}}`:         `the error has no code`,
+		`{"error":{"code":"x"},"code":"123456"}`:  `an error can't be answered along with [code]`,
+		`Enter your passphrase: {"code":"12345"}`: `invalid character 'E' looking for beginning of value`,
+	}
+	for response, message := range responses {
+		command := newTestCommand(t, "cat > /dev/null\necho '"+response+"'\n")
+		_, err := command.GetTotp(context.Background(), "AWS alpha")
+		assert.True(t, errors.Is(err, ErrInvalidResponse), response)
+		assert.EqualError(t, err, ErrInvalidResponse.Error()+": "+message+" to the totp request", response)
+	}
+
+	command := newTestCommand(t, `echo '{"accounts":[{"id":"1","title":"AWS alpha"},{"id":"1","title":"AWS beta"}]}'`)
+	_, err := command.ListItems(context.Background(), "aws")
+	assert.EqualError(t, err, ErrInvalidResponse.Error()+`: the ID "1" is listed twice to the list request`)
+
+	command = newTestCommand(t, `echo '{"account":{"id":"1","title":"AWS alpha","otp_secret":"not base32!"}}'`)
+	_, err = command.GetItem(context.Background(), "1")
+	assert.True(t, errors.Is(err, ErrInvalidResponse))
+}
+
+func TestFailures(t *testing.T) {
+	command := newTestCommand(t, "echo 'gpg: decryption failed: No secret key' >&2\nexit 2\n")
+	_, err := command.ListItems(context.Background(), "aws")
+	assert.EqualError(t, err, "The external provider "+command.Path+" failed to answer the list request: gpg: decryption failed: No secret key")
+
+	command = newTestCommand(t, "exec sleep 5\n")
+	command.Timeout = 100 * time.Millisecond
+	_, err = command.ListItems(context.Background(), "aws")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, strings.Contains(err.Error(), "did not answer the list request within 100ms"), err.Error())
+
+	command = New(filepath.Join(t.TempDir(), "missing"), nil, "ACCOUNT_INFO")
+	_, err = command.ListItems(context.Background(), "aws")
+	assert.Error(t, err)
+}
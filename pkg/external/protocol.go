@@ -0,0 +1,185 @@
+package external
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/deptofdefense/awslogin/pkg/totp"
+)
+
+// ProtocolVersion is sent with every request so providers can tell later revisions of the protocol apart
+const ProtocolVersion = 1
+
+// The requests a provider answers
+const (
+	RequestList     = "list"
+	RequestDescribe = "describe"
+	RequestTotp     = "totp"
+)
+
+// The error codes a provider answers with, where any other code is reported with its message
+const (
+	ErrorCodeNotFound    = "not_found"
+	ErrorCodeAmbiguous   = "ambiguous"
+	ErrorCodeUnsupported = "unsupported"
+)
+
+// ErrInvalidResponse is returned when a provider answers with something other than the response to the request
+var ErrInvalidResponse = errors.New("The external provider answered with an invalid response")
+
+// codePattern is what a one-time password looks like
+var codePattern = regexp.MustCompile(`^[0-9]{6,8}$`)
+
+// Request is written as a single JSON object to the stdin of the provider, which is then closed
+type Request struct {
+	Version int    `json:"version"`
+	Request string `json:"request"`
+	// Name is the ID or title of the account to describe or generate a one-time password for
+	Name string `json:"name,omitempty"`
+}
+
+// Response is read as a single JSON object from the stdout of the provider. It holds the member for the request
+// or the error, but never both.
+type Response struct {
+	// Accounts answers the list request
+	Accounts []Account `json:"accounts,omitempty"`
+	// Account answers the describe request
+	Account *Account `json:"account,omitempty"`
+	// Code answers the totp request
+	Code  string `json:"code,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
+
+// Account is an AWS account of the provider
+type Account struct {
+	// ID identifies the account and never changes, e.g. a UUID or a path
+	ID string `json:"id"`
+	// Title is shown when choosing an account. An account named by its alias is found by the title "AWS <alias>".
+	Title     string     `json:"title"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// Fields are the account settings, e.g. ACCOUNT_ALIAS and REGION, which listed accounts may leave out
+	Fields map[string]string `json:"fields,omitempty"`
+	// OTPSecret is an optional otpauth:// URI or base32 seed the one-time passwords are generated from locally
+	OTPSecret string `json:"otp_secret,omitempty"`
+}
+
+// Error reports why the provider couldn't answer the request
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// DecodeResponse reads the response to the request and checks it holds exactly what the request asks for
+func DecodeResponse(request string, r io.Reader) (*Response, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	var response Response
+	errDecode := decoder.Decode(&response)
+	if errDecode != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, errDecode)
+	}
+	if _, errToken := decoder.Token(); errToken != io.EOF {
+		return nil, fmt.Errorf("%w: more than one JSON value", ErrInvalidResponse)
+	}
+	errValidate := response.Validate(request)
+	if errValidate != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, errValidate)
+	}
+	return &response, nil
+}
+
+// Validate checks the response holds exactly what the request asks for
+func (response *Response) Validate(request string) error {
+	set := []string{}
+	if response.Accounts != nil {
+		set = append(set, "accounts")
+	}
+	if response.Account != nil {
+		set = append(set, "account")
+	}
+	if len(response.Code) > 0 {
+		set = append(set, "code")
+	}
+	if response.Error != nil {
+		if len(set) > 0 {
+			return fmt.Errorf("an error can't be answered along with %v", set)
+		}
+		if len(response.Error.Code) == 0 {
+			return errors.New("the error has no code")
+		}
+		return nil
+	}
+
+	var want string
+	switch request {
+	case RequestList:
+		want = "accounts"
+	case RequestDescribe:
+		want = "account"
+	case RequestTotp:
+		want = "code"
+	default:
+		return fmt.Errorf("the request %q is unknown", request)
+	}
+	if len(set) != 1 || set[0] != want {
+		return fmt.Errorf("the %s request is answered with %q alone, not %v", request, want, set)
+	}
+
+	switch request {
+	case RequestList:
+		ids := map[string]bool{}
+		for i := range response.Accounts {
+			if errAccount := response.Accounts[i].validate(); errAccount != nil {
+				return fmt.Errorf("account %d: %w", i, errAccount)
+			}
+			if ids[response.Accounts[i].ID] {
+				return fmt.Errorf("the ID %q is listed twice", response.Accounts[i].ID)
+			}
+			ids[response.Accounts[i].ID] = true
+		}
+	case RequestDescribe:
+		return response.Account.validate()
+	case RequestTotp:
+		if !codePattern.MatchString(response.Code) {
+			return fmt.Errorf("the code %q isn't 6 to 8 digits", response.Code)
+		}
+	}
+	return nil
+}
+
+func (account *Account) validate() error {
+	if len(account.ID) == 0 {
+		return errors.New("the account has no ID")
+	}
+	if len(account.Title) == 0 {
+		return fmt.Errorf("the account %q has no title", account.ID)
+	}
+	for name := range account.Fields {
+		if len(name) == 0 {
+			return fmt.Errorf("the account %q has a field without a name", account.ID)
+		}
+	}
+	if len(account.OTPSecret) > 0 {
+		if _, errParse := totp.Parse(account.OTPSecret); errParse != nil {
+			return fmt.Errorf("the one-time password secret of the account %q: %w", account.ID, errParse)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON leaves out the members that aren't set, apart from an empty list of accounts
+func (response Response) MarshalJSON() ([]byte, error) {
+	type plain Response
+	if response.Accounts != nil && len(response.Accounts) == 0 && response.Error == nil {
+		return []byte(`{"accounts":[]}`), nil
+	}
+	return json.Marshal(plain(response))
+}
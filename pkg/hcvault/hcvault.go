@@ -0,0 +1,360 @@
+// Package hcvault reads AWS accounts from the KV version 2 secrets of a HashiCorp Vault server and their
+// one-time passwords from its TOTP secrets engine
+package hcvault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+)
+
+// The mounts and path the Vault engines are found at by default
+const (
+	DefaultKVMount     = "secret"
+	DefaultPath        = "aws"
+	DefaultTOTPMount   = "totp"
+	DefaultAppRoleAuth = "approle"
+)
+
+// DefaultTimeout is how long a single request to Vault may take
+const DefaultTimeout = 30 * time.Second
+
+// TOTPKeyField names the key of the TOTP engine in the data of a secret when it isn't named like the secret
+const TOTPKeyField = "TOTP_KEY"
+
+// secretKind is what the errors call an account
+const secretKind = "Vault secret"
+
+// The kinds of Vault failures callers can check for with errors.Is
+var (
+	ErrNoCredentials    = errors.New("A Vault token or an AppRole role ID and secret ID is needed")
+	ErrPermissionDenied = errors.New("Vault denied the request")
+)
+
+// Client lists the secrets below a KV version 2 path as AWS accounts. The string values of a secret become the
+// fields of the settings section, so the alias is read from the key named like the 1Password field, and the
+// one-time password is read from the TOTP key named like the secret.
+type Client struct {
+	// Address is the URL of the Vault server, e.g. https://vault.example.com:8200
+	Address string
+	// Namespace is the Vault Enterprise namespace the mounts are in
+	Namespace string
+	// Token authenticates the requests, otherwise RoleID and SecretID log in with AppRole
+	Token    string
+	RoleID   string
+	SecretID string
+	// AppRoleAuth is the mount of the AppRole auth method, defaulting to DefaultAppRoleAuth
+	AppRoleAuth string
+	// KVMount is the mount of the KV version 2 engine and Path the directory of the accounts in it
+	KVMount string
+	Path    string
+	// TOTPMount is the mount of the TOTP engine
+	TOTPMount string
+	// Section and AliasField are where the login flow reads the fields and the account alias from
+	Section    string
+	AliasField string
+	HTTPClient *http.Client
+
+	mu sync.Mutex
+	// loggedIn is the token of the AppRole login
+	loggedIn string
+}
+
+var _ provider.Provider = (*Client)(nil)
+var _ provider.AliasTitler = (*Client)(nil)
+
+// New returns the client for the Vault server at address, reading the accounts below the default path of the
+// default KV mount
+func New(address, section, aliasField string) *Client {
+	return &Client{
+		Address:     strings.TrimRight(address, "/"),
+		AppRoleAuth: DefaultAppRoleAuth,
+		KVMount:     DefaultKVMount,
+		Path:        DefaultPath,
+		TOTPMount:   DefaultTOTPMount,
+		Section:     section,
+		AliasField:  aliasField,
+		HTTPClient:  &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// HelperToken returns the token `vault login` keeps in ~/.vault-token, or nothing when there is none
+func HelperToken() string {
+	homedir, errUserHomeDir := os.UserHomeDir()
+	if errUserHomeDir != nil {
+		return ""
+	}
+	token, errReadFile := ioutil.ReadFile(filepath.Join(homedir, ".vault-token"))
+	if errReadFile != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(token))
+}
+
+// ListItems lists the secrets below the path and its subdirectories without reading them, titled by their path
+// below it. Vault has no tags so every secret is listed.
+func (client *Client) ListItems(ctx context.Context, tags string) ([]op.Item, error) {
+	items := []op.Item{}
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		var list struct {
+			Data struct {
+				Keys []string `json:"keys"`
+			} `json:"data"`
+		}
+		errList := client.do(ctx, "LIST", client.kvPath("metadata", dir), nil, &list)
+		if errors.Is(errList, op.ErrItemNotFound) && len(dir) == 0 {
+			return nil, fmt.Errorf("The Vault path %q does not exist in the %q mount", client.Path, client.KVMount)
+		}
+		if errList != nil {
+			return nil, errList
+		}
+		for _, key := range list.Data.Keys {
+			if strings.HasSuffix(key, "/") {
+				dirs = append(dirs, dir+key)
+				continue
+			}
+			items = append(items, op.Item{
+				Uuid:     path.Join(strings.Trim(client.Path, "/"), dir+key),
+				Overview: op.Overview{Title: dir + key},
+			})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Overview.Title < items[j].Overview.Title
+	})
+	return items, nil
+}
+
+// GetItem reads the latest version of the secret with the path in the mount or below the path given as the name
+func (client *Client) GetItem(ctx context.Context, name string) (*op.Item, error) {
+	title := client.title(name)
+	if title == ".." || strings.HasPrefix(title, "../") || len(title) == 0 {
+		return nil, &provider.NotFoundError{Kind: secretKind, Name: name}
+	}
+	var secret struct {
+		Data struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata struct {
+				CreatedTime time.Time `json:"created_time"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	errRead := client.do(ctx, http.MethodGet, client.kvPath("data", title), nil, &secret)
+	if errors.Is(errRead, op.ErrItemNotFound) {
+		return nil, &provider.NotFoundError{Kind: secretKind, Name: name}
+	}
+	if errRead != nil {
+		return nil, errRead
+	}
+	// A deleted version is read back without its data
+	if secret.Data.Data == nil {
+		return nil, &provider.NotFoundError{Kind: secretKind, Name: name}
+	}
+
+	keys := make([]string, 0, len(secret.Data.Data))
+	for key := range secret.Data.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	section := op.Section{Name: "vault", Title: client.Section}
+	for _, key := range keys {
+		value, ok := secret.Data.Data[key].(string)
+		if !ok {
+			encoded, errMarshal := json.Marshal(secret.Data.Data[key])
+			if errMarshal != nil {
+				return nil, errMarshal
+			}
+			value = string(encoded)
+		}
+		section.Fields = append(section.Fields, op.SectionField{K: "string", T: key, V: value})
+	}
+	if _, ok := secret.Data.Data[client.AliasField]; !ok && len(client.AliasField) > 0 {
+		section.Fields = append(section.Fields, op.SectionField{K: "string", T: client.AliasField, V: path.Base(title)})
+	}
+	return &op.Item{
+		Uuid:      path.Join(strings.Trim(client.Path, "/"), title),
+		UpdatedAt: secret.Data.Metadata.CreatedTime,
+		Overview:  op.Overview{Title: title},
+		Details:   op.Details{Sections: []op.Section{section}},
+	}, nil
+}
+
+// GetTotp reads the current code of the TOTP key named like the secret, or by its TOTP_KEY value
+func (client *Client) GetTotp(ctx context.Context, name string) (*string, error) {
+	item, errGetItem := client.GetItem(ctx, name)
+	if errGetItem != nil {
+		return nil, errGetItem
+	}
+	key := path.Base(item.Overview.Title)
+	for _, field := range item.Details.Sections[0].Fields {
+		if field.T == TOTPKeyField && len(field.V) > 0 {
+			key = field.V
+		}
+	}
+
+	var code struct {
+		Data struct {
+			Code string `json:"code"`
+		} `json:"data"`
+	}
+	errCode := client.do(ctx, http.MethodGet, path.Join(strings.Trim(client.TOTPMount, "/"), "code", key), nil, &code)
+	if errors.Is(errCode, op.ErrItemNotFound) {
+		return nil, fmt.Errorf("The Vault TOTP key %q of the secret %q does not exist", key, item.Uuid)
+	}
+	if errCode != nil {
+		return nil, errCode
+	}
+	if len(code.Data.Code) == 0 {
+		return nil, fmt.Errorf("Vault returned no code for the TOTP key %q", key)
+	}
+	return &code.Data.Code, nil
+}
+
+// AliasTitle returns the title of the secret named after the alias, which is its path below the path
+func (client *Client) AliasTitle(alias string) string {
+	return alias
+}
+
+// title returns the path of the secret below the path of the client
+func (client *Client) title(name string) string {
+	name = path.Clean(strings.Trim(name, "/"))
+	if dir := strings.Trim(client.Path, "/"); len(dir) > 0 {
+		return strings.TrimPrefix(name, dir+"/")
+	}
+	return name
+}
+
+// kvPath returns the API path of the secret or directory below the path of the client
+func (client *Client) kvPath(kind, name string) string {
+	return path.Join(strings.Trim(client.KVMount, "/"), kind, strings.Trim(client.Path, "/"), name)
+}
+
+// do sends the request to the API path, logging in with AppRole first and again when the token has expired
+func (client *Client) do(ctx context.Context, method, apiPath string, body, v interface{}) error {
+	token, errToken := client.token(ctx, "")
+	if errToken != nil {
+		return errToken
+	}
+	errRequest := client.request(ctx, method, apiPath, token, body, v)
+	if errors.Is(errRequest, ErrPermissionDenied) && len(client.Token) == 0 {
+		token, errToken = client.token(ctx, token)
+		if errToken != nil {
+			return errToken
+		}
+		errRequest = client.request(ctx, method, apiPath, token, body, v)
+	}
+	return errRequest
+}
+
+// token returns the token of the client or logs in with AppRole, again when the refused token is the current one
+func (client *Client) token(ctx context.Context, refused string) (string, error) {
+	if len(client.Token) > 0 {
+		return client.Token, nil
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.loggedIn) > 0 && client.loggedIn != refused {
+		return client.loggedIn, nil
+	}
+	if len(client.RoleID) == 0 || len(client.SecretID) == 0 {
+		return "", ErrNoCredentials
+	}
+
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	mount := client.AppRoleAuth
+	if len(mount) == 0 {
+		mount = DefaultAppRoleAuth
+	}
+	credentials := map[string]string{"role_id": client.RoleID, "secret_id": client.SecretID}
+	errLogin := client.request(ctx, http.MethodPost, path.Join("auth", strings.Trim(mount, "/"), "login"), "", credentials, &login)
+	if errLogin != nil {
+		return "", fmt.Errorf("Unable to log in to Vault with AppRole: %w", errLogin)
+	}
+	if len(login.Auth.ClientToken) == 0 {
+		return "", errors.New("Unable to log in to Vault with AppRole: no token was returned")
+	}
+	client.loggedIn = login.Auth.ClientToken
+	return client.loggedIn, nil
+}
+
+// request sends a single request to the API path and decodes the JSON response into v
+func (client *Client) request(ctx context.Context, method, apiPath, token string, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, errMarshal := json.Marshal(body)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	address := client.Address + "/v1/" + (&url.URL{Path: apiPath}).EscapedPath()
+	req, errNewRequest := http.NewRequestWithContext(ctx, method, address, reader)
+	if errNewRequest != nil {
+		return errNewRequest
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if len(client.Namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", client.Namespace)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, errDo := httpClient.Do(req)
+	if errDo != nil {
+		return errDo
+	}
+	defer resp.Body.Close()
+
+	respBody, errReadAll := ioutil.ReadAll(resp.Body)
+	if errReadAll != nil {
+		return errReadAll
+	}
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		message := resp.Status
+		if json.Unmarshal(respBody, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			message = fmt.Sprintf("%s: %s", resp.Status, strings.Join(vaultErr.Errors, ", "))
+		}
+		switch resp.StatusCode {
+		case http.StatusForbidden:
+			return fmt.Errorf("%w: call to Vault %s failed with %s", ErrPermissionDenied, apiPath, message)
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: call to Vault %s failed with %s", op.ErrItemNotFound, apiPath, message)
+		}
+		return fmt.Errorf("Call to Vault %s failed with %s", apiPath, message)
+	}
+	return json.Unmarshal(respBody, v)
+}
@@ -0,0 +1,173 @@
+package hcvault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+const (
+	testToken    = "root-token"
+	testRoleID   = "role-id"
+	testSecretID = "secret-id"
+)
+
+// testServer stands in for the Vault API with a KV version 2 engine at secret/ and a TOTP engine at totp/
+type testServer struct {
+	*httptest.Server
+	// tokens are the tokens the server accepts, where logging in with AppRole adds one
+	tokens map[string]bool
+	logins int
+}
+
+func newTestServer(t *testing.T) *testServer {
+	server := &testServer{tokens: map[string]bool{testToken: true}}
+	routes := map[string]string{
+		"LIST /v1/secret/metadata/aws":     `{"data":{"keys":["alpha","gov/"]}}`,
+		"LIST /v1/secret/metadata/aws/gov": `{"data":{"keys":["beta"]}}`,
+		"GET /v1/secret/data/aws/alpha": `{"data":{"data":{"ACCOUNT_ALIAS":"alpha-prod","REGION":"us-gov-west-1","SESSION_DURATION":3600},` +
+			`"metadata":{"created_time":"2021-09-01T12:00:00Z","version":2}}}`,
+		"GET /v1/secret/data/aws/gov/beta":  `{"data":{"data":{"TOTP_KEY":"breakglass-beta"},"metadata":{"created_time":"2021-09-01T12:00:00Z"}}}`,
+		"GET /v1/totp/code/alpha":           `{"data":{"code":"123456"}}`,
+		"GET /v1/totp/code/breakglass-beta": `{"data":{"code":"654321"}}`,
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/auth/approle/login" {
+			var credentials map[string]string
+			if json.NewDecoder(r.Body).Decode(&credentials) != nil || credentials["role_id"] != testRoleID || credentials["secret_id"] != testSecretID {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+				return
+			}
+			server.logins++
+			token := fmt.Sprintf("approle-token-%d", server.logins)
+			server.tokens[token] = true
+			_, _ = w.Write([]byte(`{"auth":{"client_token":"` + token + `"}}`))
+			return
+		}
+		if !server.tokens[r.Header.Get("X-Vault-Token")] {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		body, ok := routes[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestClient(server *testServer) *Client {
+	client := New(server.URL+"/", "ACCOUNT_INFO", "ACCOUNT_ALIAS")
+	client.Token = testToken
+	return client
+}
+
+func TestListItems(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server)
+
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "aws/alpha", items[0].Uuid)
+	assert.Equal(t, "alpha", items[0].Overview.Title)
+	assert.Equal(t, "aws/gov/beta", items[1].Uuid)
+	assert.Equal(t, "gov/beta", items[1].Overview.Title)
+
+	client.Path = "azure"
+	_, err = client.ListItems(context.Background(), "aws")
+	assert.EqualError(t, err, `The Vault path "azure" does not exist in the "secret" mount`)
+}
+
+func TestGetItem(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server)
+
+	for _, name := range []string{"alpha", "aws/alpha"} {
+		item, err := client.GetItem(context.Background(), name)
+		require.NoError(t, err, name)
+		assert.Equal(t, "aws/alpha", item.Uuid)
+		require.Len(t, item.Details.Sections, 1)
+		assert.Equal(t, "ACCOUNT_INFO", item.Details.Sections[0].Title)
+		assert.Equal(t, []op.SectionField{
+			{K: "string", T: "ACCOUNT_ALIAS", V: "alpha-prod"},
+			{K: "string", T: "REGION", V: "us-gov-west-1"},
+			{K: "string", T: "SESSION_DURATION", V: "3600"},
+		}, item.Details.Sections[0].Fields)
+	}
+
+	// The alias defaults to the name of the secret
+	item, err := client.GetItem(context.Background(), "gov/beta")
+	require.NoError(t, err)
+	assert.Contains(t, item.Details.Sections[0].Fields, op.SectionField{K: "string", T: "ACCOUNT_ALIAS", V: "beta"})
+
+	for _, name := range []string{"gamma", "../../sys/policy"} {
+		_, err = client.GetItem(context.Background(), name)
+		assert.True(t, errors.Is(err, op.ErrItemNotFound), name)
+	}
+}
+
+func TestGetTotp(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server)
+
+	code, err := client.GetTotp(context.Background(), "aws/alpha")
+	require.NoError(t, err)
+	assert.Equal(t, "123456", *code)
+
+	code, err = client.GetTotp(context.Background(), "gov/beta")
+	require.NoError(t, err)
+	assert.Equal(t, "654321", *code)
+}
+
+func TestAppRole(t *testing.T) {
+	server := newTestServer(t)
+	client := New(server.URL, "ACCOUNT_INFO", "ACCOUNT_ALIAS")
+
+	_, err := client.ListItems(context.Background(), "aws")
+	assert.True(t, errors.Is(err, ErrNoCredentials))
+
+	client.RoleID = testRoleID
+	client.SecretID = testSecretID
+	_, err = client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	_, err = client.GetTotp(context.Background(), "alpha")
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.logins)
+
+	// An expired token logs in again
+	server.tokens = map[string]bool{}
+	_, err = client.GetItem(context.Background(), "alpha")
+	require.NoError(t, err)
+	assert.Equal(t, 2, server.logins)
+
+	client.SecretID = "wrong"
+	server.tokens = map[string]bool{}
+	_, err = client.GetItem(context.Background(), "alpha")
+	assert.EqualError(t, err, "Unable to log in to Vault with AppRole: Call to Vault auth/approle/login failed with 400 Bad Request: invalid role or secret ID")
+}
+
+func TestPermissionDenied(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(server)
+	client.Token = "revoked"
+
+	_, err := client.GetItem(context.Background(), "alpha")
+	assert.True(t, errors.Is(err, ErrPermissionDenied))
+}
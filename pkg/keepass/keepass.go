@@ -0,0 +1,313 @@
+// Package keepass reads AWS accounts from the entries of a KeePass database, such as one kept by KeePassXC
+package keepass
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/99designs/aws-vault/v6/prompt"
+	"github.com/tobischo/gokeepasslib/v3"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+	"github.com/deptofdefense/awslogin/pkg/totp"
+)
+
+// DefaultOTPAttribute is the attribute KeePassXC keeps the otpauth:// URI of an entry in
+const DefaultOTPAttribute = "otp"
+
+// DefaultAttempts is how many times the database password is asked for before giving up
+const DefaultAttempts = 3
+
+// legacyOTPAttribute holds the bare seed of entries set up by KeePassXC before 2.6
+const legacyOTPAttribute = "TOTP Seed"
+
+// entryKind is what the errors call an entry
+const entryKind = "KeePass entry"
+
+// ErrWrongPassword is returned when the password or key file doesn't open the database
+var ErrWrongPassword = errors.New("The KeePass password or key file was not accepted")
+
+// standardAttributes are the attributes every entry has, which aren't account settings
+var standardAttributes = map[string]bool{
+	"Title":    true,
+	"UserName": true,
+	"Password": true,
+	"URL":      true,
+	"Notes":    true,
+}
+
+// Database lists the entries of a group or with a tag as AWS accounts. The custom attributes of an entry
+// become the fields of the settings section, so the alias is read from the attribute named like the
+// 1Password field, and the one-time password is generated from the OTP attribute.
+type Database struct {
+	Filename string
+	// KeyFile is the key file the database is locked with as well as or instead of a password
+	KeyFile string
+	// NoPassword opens the database with the key file alone
+	NoPassword bool
+	// Group is the path of the group holding the entries below the root group, e.g. "AWS/GovCloud",
+	// where the entries of its subgroups are included
+	Group string
+	// Tag limits the entries to those with the tag
+	Tag string
+	// Section is where the login flow reads the fields from
+	Section string
+	// OTPAttribute holds the otpauth:// URI or the bare seed, defaulting to DefaultOTPAttribute
+	OTPAttribute string
+	// Password asks for the password of the database, defaulting to a terminal prompt
+	Password func(message string) (string, error)
+	// Attempts is how many times the password is asked for, defaulting to DefaultAttempts
+	Attempts int
+
+	mu    sync.Mutex
+	items []op.Item
+}
+
+var _ provider.Provider = (*Database)(nil)
+
+// New returns the database in the file, which is only opened when its entries are first needed
+func New(filename, keyFile, group, tag, section string) *Database {
+	return &Database{
+		Filename:     filename,
+		KeyFile:      keyFile,
+		Group:        group,
+		Tag:          tag,
+		Section:      section,
+		OTPAttribute: DefaultOTPAttribute,
+	}
+}
+
+// ListItems returns the entries in the group with the tag of the database. The tags asked for by the
+// login flow are those of 1Password so they aren't used.
+func (db *Database) ListItems(ctx context.Context, tags string) ([]op.Item, error) {
+	items, errLoad := db.load(ctx)
+	if errLoad != nil {
+		return nil, errLoad
+	}
+	listed := make([]op.Item, len(items))
+	copy(listed, items)
+	return listed, nil
+}
+
+// GetItem returns the entry with the UUID or title given as the name
+func (db *Database) GetItem(ctx context.Context, name string) (*op.Item, error) {
+	items, errLoad := db.load(ctx)
+	if errLoad != nil {
+		return nil, errLoad
+	}
+	matches := []op.Item{}
+	for _, item := range items {
+		if item.Uuid == name || item.Overview.Title == name {
+			matches = append(matches, item)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, &provider.NotFoundError{Kind: entryKind, Name: name}
+	case 1:
+		return &matches[0], nil
+	}
+	return nil, fmt.Errorf("%w: %d KeePass entries are titled %q", op.ErrAmbiguousItem, len(matches), name)
+}
+
+// GetTotp generates the one-time password from the OTP attribute of the entry
+func (db *Database) GetTotp(ctx context.Context, name string) (*string, error) {
+	item, errGetItem := db.GetItem(ctx, name)
+	if errGetItem != nil {
+		return nil, errGetItem
+	}
+	secret, ok := item.OTPSecret()
+	if !ok {
+		return nil, fmt.Errorf("The KeePass entry %q has no %q attribute", item.Overview.Title, db.otpAttribute())
+	}
+	key, errParse := totp.Parse(secret)
+	if errParse != nil {
+		return nil, fmt.Errorf("Unable to use the one-time password seed of the KeePass entry %q: %w", item.Overview.Title, errParse)
+	}
+	code := key.Generate(time.Now())
+	return &code, nil
+}
+
+func (db *Database) otpAttribute() string {
+	if len(db.OTPAttribute) > 0 {
+		return db.OTPAttribute
+	}
+	return DefaultOTPAttribute
+}
+
+// load opens the database the first time it is needed, asking for the password again when it isn't accepted
+func (db *Database) load(ctx context.Context) ([]op.Item, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.items != nil {
+		return db.items, nil
+	}
+
+	attempts := db.Attempts
+	if attempts < 1 {
+		attempts = DefaultAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		if errContext := ctx.Err(); errContext != nil {
+			return nil, errContext
+		}
+		credentials, errCredentials := db.credentials()
+		if errCredentials != nil {
+			return nil, errCredentials
+		}
+		decoded, errOpen := db.open(credentials)
+		if errOpen == nil {
+			db.items = db.entries(decoded)
+			return db.items, nil
+		}
+		if !errors.Is(errOpen, ErrWrongPassword) || db.NoPassword || attempt >= attempts {
+			return nil, errOpen
+		}
+		fmt.Fprintln(os.Stderr, "The KeePass password was not accepted, try again.")
+	}
+}
+
+// credentials asks for the password and reads the key file the database is locked with
+func (db *Database) credentials() (*gokeepasslib.DBCredentials, error) {
+	if db.NoPassword {
+		if len(db.KeyFile) == 0 {
+			return nil, errors.New("A key file is needed to open the KeePass database without a password")
+		}
+		return gokeepasslib.NewKeyCredentials(db.KeyFile)
+	}
+
+	readPassword := db.Password
+	if readPassword == nil {
+		readPassword = prompt.TerminalSecretPrompt
+	}
+	password, errPassword := readPassword(fmt.Sprintf("Enter the password of %s: ", db.Filename))
+	if errPassword != nil {
+		return nil, errPassword
+	}
+	if len(db.KeyFile) > 0 {
+		return gokeepasslib.NewPasswordAndKeyCredentials(password, db.KeyFile)
+	}
+	return gokeepasslib.NewPasswordCredentials(password), nil
+}
+
+// open decodes the database with the credentials and unlocks the protected attributes
+func (db *Database) open(credentials *gokeepasslib.DBCredentials) (*gokeepasslib.Database, error) {
+	file, errOpen := os.Open(db.Filename)
+	if errOpen != nil {
+		return nil, fmt.Errorf("Unable to open the KeePass database: %w", errOpen)
+	}
+	defer file.Close()
+
+	decoded := gokeepasslib.NewDatabase()
+	decoded.Credentials = credentials
+	errDecode := gokeepasslib.NewDecoder(file).Decode(decoded)
+	if errDecode != nil {
+		// The decoder can only tell a wrong password by the checksums it doesn't match
+		if strings.HasPrefix(errDecode.Error(), "Wrong password") {
+			return nil, fmt.Errorf("%w: %v", ErrWrongPassword, errDecode)
+		}
+		return nil, fmt.Errorf("Unable to read the KeePass database %s: %w", db.Filename, errDecode)
+	}
+	errUnlock := decoded.UnlockProtectedEntries()
+	if errUnlock != nil {
+		return nil, fmt.Errorf("Unable to read the KeePass database %s: %w", db.Filename, errUnlock)
+	}
+	return decoded, nil
+}
+
+// entries returns the entries of the group with the tag, leaving out the recycle bin
+func (db *Database) entries(decoded *gokeepasslib.Database) []op.Item {
+	var recycleBin gokeepasslib.UUID
+	if decoded.Content.Meta != nil && decoded.Content.Meta.RecycleBinEnabled.Bool {
+		recycleBin = decoded.Content.Meta.RecycleBinUUID
+	}
+	wanted := strings.Split(strings.Trim(db.Group, "/"), "/")
+	if len(db.Group) == 0 {
+		wanted = nil
+	}
+
+	items := []op.Item{}
+	var walk func(group gokeepasslib.Group, path []string)
+	walk = func(group gokeepasslib.Group, path []string) {
+		if group.UUID.Compare(recycleBin) {
+			return
+		}
+		if inGroup(path, wanted) {
+			for _, entry := range group.Entries {
+				if len(db.Tag) == 0 || hasTag(entry.Tags, db.Tag) {
+					items = append(items, db.item(entry, strings.Join(path, "/")))
+				}
+			}
+		}
+		for _, subgroup := range group.Groups {
+			walk(subgroup, append(append([]string{}, path...), subgroup.Name))
+		}
+	}
+	if decoded.Content.Root != nil {
+		for _, root := range decoded.Content.Root.Groups {
+			// The path of a group starts below the root group, whose name is the name of the database
+			walk(root, []string{})
+		}
+	}
+	return items
+}
+
+// inGroup reports whether the group path is the wanted group or one of its subgroups
+func inGroup(path, wanted []string) bool {
+	if len(path) < len(wanted) {
+		return false
+	}
+	for i := range wanted {
+		if path[i] != wanted[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTag reports whether the tag is one of the tags, which KeePass separates with semicolons or commas
+func hasTag(tags, tag string) bool {
+	for _, t := range strings.FieldsFunc(tags, func(r rune) bool { return r == ';' || r == ',' }) {
+		if strings.EqualFold(strings.TrimSpace(t), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// item turns the entry into an item with its custom attributes as the fields of the settings section
+func (db *Database) item(entry gokeepasslib.Entry, groupPath string) op.Item {
+	section := op.Section{Name: "keepass", Title: db.Section}
+	for _, value := range entry.Values {
+		switch {
+		case value.Key == db.otpAttribute() || value.Key == legacyOTPAttribute:
+			section.Fields = append(section.Fields, op.SectionField{K: "concealed", N: "TOTP_keepass", T: value.Key, V: value.Value.Content})
+		case standardAttributes[value.Key]:
+		case value.Value.Protected.Bool:
+			section.Fields = append(section.Fields, op.SectionField{K: "concealed", T: value.Key, V: value.Value.Content})
+		default:
+			section.Fields = append(section.Fields, op.SectionField{K: "string", T: value.Key, V: value.Value.Content})
+		}
+	}
+
+	item := op.Item{
+		Uuid:      hex.EncodeToString(entry.UUID[:]),
+		VaultName: groupPath,
+		Overview: op.Overview{
+			Title: entry.GetTitle(),
+			Tags:  strings.FieldsFunc(entry.Tags, func(r rune) bool { return r == ';' || r == ',' }),
+		},
+		Details: op.Details{Sections: []op.Section{section}},
+	}
+	if entry.Times.LastModificationTime != nil {
+		item.UpdatedAt = entry.Times.LastModificationTime.Time
+	}
+	return item
+}
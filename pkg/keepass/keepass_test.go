@@ -0,0 +1,142 @@
+package keepass
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// The sample databases hold an Accounts root group with these entries:
+//
+//	AWS/AWS alpha           ACCOUNT_ALIAS, REGION and an otp URI
+//	AWS/AWS beta            ACCOUNT_ALIAS and a KeePassXC 2.5 TOTP Seed
+//	AWS/GovCloud/AWS gamma  tagged aws
+//	Personal/Bank
+//	Personal/AWS delta      tagged finance and aws
+//	Recycle Bin/AWS deleted tagged aws
+//
+// accounts-kdbx3.kdbx is KDBX 3.1 with the password, accounts-kdbx4.kdbx is KDBX 4 with the password and
+// the key file, and accounts-keyfile.kdbx is KDBX 4 with the key file alone.
+const (
+	testPassword = "awslogin"
+	testKeyFile  = "testdata/accounts.key"
+)
+
+func newTestDatabase(filename, keyFile, group, tag string) *Database {
+	db := New(filename, keyFile, group, tag, "ACCOUNT_INFO")
+	db.Password = func(string) (string, error) {
+		return testPassword, nil
+	}
+	return db
+}
+
+func titles(items []op.Item) []string {
+	result := []string{}
+	for _, item := range items {
+		result = append(result, item.Overview.Title)
+	}
+	return result
+}
+
+func TestListItemsByGroup(t *testing.T) {
+	for _, filename := range []string{"testdata/accounts-kdbx3.kdbx", "testdata/accounts-kdbx4.kdbx"} {
+		keyFile := ""
+		if filename == "testdata/accounts-kdbx4.kdbx" {
+			keyFile = testKeyFile
+		}
+		db := newTestDatabase(filename, keyFile, "AWS", "")
+
+		items, err := db.ListItems(context.Background(), "aws")
+		require.NoError(t, err, filename)
+		assert.Equal(t, []string{"AWS alpha", "AWS beta", "AWS gamma"}, titles(items), filename)
+		assert.Equal(t, "AWS/GovCloud", items[2].VaultName)
+	}
+}
+
+func TestListItemsByTag(t *testing.T) {
+	db := newTestDatabase("testdata/accounts-kdbx3.kdbx", "", "", "aws")
+
+	// The recycle bin is left out
+	items, err := db.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AWS gamma", "AWS delta"}, titles(items))
+
+	db = newTestDatabase("testdata/accounts-kdbx3.kdbx", "", "Personal", "aws")
+	items, err = db.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AWS delta"}, titles(items))
+}
+
+func TestKeyFileOnly(t *testing.T) {
+	db := New("testdata/accounts-keyfile.kdbx", testKeyFile, "AWS", "", "ACCOUNT_INFO")
+	db.NoPassword = true
+	db.Password = func(string) (string, error) {
+		return "", errors.New("the password should not be asked for")
+	}
+
+	items, err := db.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Len(t, items, 3)
+}
+
+func TestGetItem(t *testing.T) {
+	db := newTestDatabase("testdata/accounts-kdbx3.kdbx", "", "AWS", "")
+
+	item, err := db.GetItem(context.Background(), "AWS alpha")
+	require.NoError(t, err)
+	require.Len(t, item.Details.Sections, 1)
+	section := item.Details.Sections[0]
+	assert.Equal(t, "ACCOUNT_INFO", section.Title)
+	assert.Contains(t, section.Fields, op.SectionField{K: "string", T: "ACCOUNT_ALIAS", V: "alpha"})
+	assert.Contains(t, section.Fields, op.SectionField{K: "string", T: "REGION", V: "us-gov-west-1"})
+	for _, field := range section.Fields {
+		assert.NotEqual(t, "Password", field.T)
+	}
+
+	// The UUID finds the same entry
+	byUUID, err := db.GetItem(context.Background(), item.Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, item, byUUID)
+
+	_, err = db.GetItem(context.Background(), "Bank")
+	assert.True(t, errors.Is(err, op.ErrItemNotFound))
+}
+
+func TestGetTotp(t *testing.T) {
+	db := newTestDatabase("testdata/accounts-kdbx4.kdbx", testKeyFile, "AWS", "")
+
+	for _, name := range []string{"AWS alpha", "AWS beta"} {
+		code, err := db.GetTotp(context.Background(), name)
+		require.NoError(t, err, name)
+		assert.Len(t, *code, 6, name)
+	}
+
+	_, err := db.GetTotp(context.Background(), "AWS gamma")
+	assert.EqualError(t, err, `The KeePass entry "AWS gamma" has no "otp" attribute`)
+}
+
+func TestWrongPassword(t *testing.T) {
+	db := newTestDatabase("testdata/accounts-kdbx3.kdbx", "", "AWS", "")
+	asked := 0
+	db.Password = func(string) (string, error) {
+		asked++
+		if asked < 2 {
+			return "wrong", nil
+		}
+		return testPassword, nil
+	}
+
+	_, err := db.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Equal(t, 2, asked)
+
+	db = newTestDatabase("testdata/accounts-kdbx4.kdbx", "", "AWS", "")
+	db.Attempts = 1
+	_, err = db.ListItems(context.Background(), "aws")
+	assert.True(t, errors.Is(err, ErrWrongPassword))
+}
@@ -0,0 +1,323 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/99designs/aws-vault/v6/prompt"
+)
+
+// Account is a 1Password account added to the op command on this machine
+type Account struct {
+	Shorthand string `json:"shorthand"`
+	URL       string `json:"url"`
+	Email     string `json:"email"`
+	UserUUID  string `json:"user_uuid"`
+}
+
+// SessionFilename returns the session file used for the account shorthand
+func SessionFilename(sessionFilename, shorthand string) string {
+	if len(shorthand) == 0 {
+		return sessionFilename
+	}
+	return fmt.Sprintf("%s_%s", sessionFilename, shorthand)
+}
+
+// ListAccounts returns the accounts added to the op command on this machine
+func (config *Config) ListAccounts(ctx context.Context) ([]Account, error) {
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return nil, errDialect
+	}
+	if _, ok := d.(dialectV1); ok {
+		return listAccountsV1()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.timeout())
+	defer cancel()
+	// Listing accounts must not be scoped to the account of the config
+	args := []string{"account", "list", "--format", "json"}
+	command, errCommand := newCommand(ctx, args, nil)
+	if errCommand != nil {
+		return nil, errCommand
+	}
+	out, errOutput := output(command)
+	if errOutput != nil {
+		return nil, contextError(ctx, args, errOutput)
+	}
+	var accounts []Account
+	errUnmarshal := json.Unmarshal(out, &accounts)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	return accounts, nil
+}
+
+// configV1 is the op 1.x config file, which has no command to list its accounts
+type configV1 struct {
+	LatestSignin string `json:"latest_signin"`
+	Accounts     []struct {
+		Shorthand string `json:"shorthand"`
+		URL       string `json:"url"`
+		Email     string `json:"email"`
+		UserUUID  string `json:"userUUID"`
+	} `json:"accounts"`
+}
+
+// readConfigV1 reads the op 1.x config file, returning an empty config when there is none
+func readConfigV1() (*configV1, error) {
+	homedir, errUserHomeDir := os.UserHomeDir()
+	if errUserHomeDir != nil {
+		return nil, errUserHomeDir
+	}
+	paths := []string{filepath.Join(homedir, ".op", "config")}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); len(xdg) > 0 {
+		paths = append([]string{filepath.Join(xdg, ".op", "config")}, paths...)
+	}
+	paths = append(paths, filepath.Join(homedir, ".config", ".op", "config"))
+
+	for _, path := range paths {
+		data, errReadFile := ioutil.ReadFile(filepath.Clean(path))
+		if os.IsNotExist(errReadFile) {
+			continue
+		}
+		if errReadFile != nil {
+			return nil, errReadFile
+		}
+		var opConfig configV1
+		errUnmarshal := json.Unmarshal(data, &opConfig)
+		if errUnmarshal != nil {
+			return nil, fmt.Errorf("Unable to read JSON file at %q: %w", path, errUnmarshal)
+		}
+		return &opConfig, nil
+	}
+	return &configV1{}, nil
+}
+
+// listAccountsV1 reads the accounts from the op 1.x config file
+func listAccountsV1() ([]Account, error) {
+	opConfig, errReadConfig := readConfigV1()
+	if errReadConfig != nil {
+		return nil, errReadConfig
+	}
+	accounts := []Account{}
+	for _, account := range opConfig.Accounts {
+		accounts = append(accounts, Account{
+			Shorthand: account.Shorthand,
+			URL:       account.URL,
+			Email:     account.Email,
+			UserUUID:  account.UserUUID,
+		})
+	}
+	return accounts, nil
+}
+
+// ensureAccountAdded guides the user through adding the account when op doesn't know its shorthand yet
+func (config *Config) ensureAccountAdded(ctx context.Context) error {
+	accounts, errListAccounts := config.ListAccounts(ctx)
+	if errListAccounts != nil {
+		return errListAccounts
+	}
+	for _, account := range accounts {
+		if account.Shorthand == config.Account {
+			return nil
+		}
+	}
+
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return errDialect
+	}
+
+	fmt.Fprintf(os.Stderr, "The 1Password account %q has not been added on this machine yet.\n", config.Account)
+	address, errPrompt := prompt.TerminalPrompt("Enter the sign-in address (e.g. example.1password.com): ")
+	if errPrompt != nil {
+		return errPrompt
+	}
+	email, errPrompt := prompt.TerminalPrompt("Enter the email address for the account: ")
+	if errPrompt != nil {
+		return errPrompt
+	}
+	if len(address) == 0 || len(email) == 0 {
+		return fmt.Errorf("A sign-in address and email are required to add the 1Password account %q", config.Account)
+	}
+
+	// op asks for the Secret Key and password itself, so the terminal is handed over to it without a timeout
+	command, errCommand := newCommand(ctx, d.addAccountArgs(address, email, config.Account), nil)
+	if errCommand != nil {
+		return errCommand
+	}
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stderr
+	command.Stderr = os.Stderr
+	errRun := command.Run()
+	if errRun != nil {
+		return fmt.Errorf("Unable to add the 1Password account %q: %w", config.Account, errRun)
+	}
+	return nil
+}
+
+// MultiClient merges the items of several 1Password accounts, each with its own session file
+type MultiClient struct {
+	Shorthands []string
+	Clients    map[string]Client
+
+	mu      sync.Mutex
+	sources map[string]string
+}
+
+var _ Client = (*MultiClient)(nil)
+
+// NewMultiClient loads the session of each account from the store, each under its own session filename.
+// Every account uses the settings of base, such as the vaults to search.
+func NewMultiClient(store SessionStore, sessionFilename string, shorthands []string, base *Config) (*MultiClient, error) {
+	clients := map[string]Client{}
+	for _, shorthand := range shorthands {
+		config, errLoadSession := LoadSession(store, SessionFilename(sessionFilename, shorthand))
+		if errLoadSession != nil {
+			return nil, errLoadSession
+		}
+		config.CopySettings(base)
+		config.Account = shorthand
+		clients[shorthand] = config
+	}
+	return &MultiClient{
+		Shorthands: shorthands,
+		Clients:    clients,
+	}, nil
+}
+
+// ListItems returns the items of every account tagged with the account they came from
+func (multi *MultiClient) ListItems(ctx context.Context, tags string) ([]Item, error) {
+	items := []Item{}
+	for _, shorthand := range multi.Shorthands {
+		accountItems, errListItems := multi.Clients[shorthand].ListItems(ctx, tags)
+		if errListItems != nil {
+			return items, fmt.Errorf("Unable to list items in the 1Password account %q: %w", shorthand, errListItems)
+		}
+		for _, item := range accountItems {
+			item.Account = shorthand
+			multi.remember(item, shorthand)
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (multi *MultiClient) remember(item Item, shorthand string) {
+	multi.mu.Lock()
+	defer multi.mu.Unlock()
+	if multi.sources == nil {
+		multi.sources = map[string]string{}
+	}
+	if len(item.Uuid) > 0 {
+		multi.sources[item.Uuid] = shorthand
+	}
+	multi.sources[item.Overview.Title] = shorthand
+}
+
+// candidates returns the account the item was listed from, or every account when it hasn't been listed
+func (multi *MultiClient) candidates(name string) []string {
+	multi.mu.Lock()
+	shorthand, ok := multi.sources[name]
+	multi.mu.Unlock()
+	if ok {
+		return []string{shorthand}
+	}
+	return multi.Shorthands
+}
+
+func (multi *MultiClient) GetItem(ctx context.Context, name string) (*Item, error) {
+	var errGetItem error
+	for _, shorthand := range multi.candidates(name) {
+		var item *Item
+		item, errGetItem = multi.Clients[shorthand].GetItem(ctx, name)
+		if errGetItem == nil {
+			item.Account = shorthand
+			return item, nil
+		}
+	}
+	return nil, errGetItem
+}
+
+func (multi *MultiClient) GetTotp(ctx context.Context, name string) (*string, error) {
+	var errGetTotp error
+	for _, shorthand := range multi.candidates(name) {
+		var totp *string
+		totp, errGetTotp = multi.Clients[shorthand].GetTotp(ctx, name)
+		if errGetTotp == nil {
+			return totp, nil
+		}
+	}
+	return nil, errGetTotp
+}
+
+// SessionTrusted reports whether every account used its session recently enough to skip checking it
+func (multi *MultiClient) SessionTrusted() bool {
+	for _, shorthand := range multi.Shorthands {
+		trusted, ok := multi.Clients[shorthand].(trustedSessionClient)
+		if !ok || !trusted.SessionTrusted() {
+			return false
+		}
+	}
+	return len(multi.Shorthands) > 0
+}
+
+// UseEnvSession switches each account to a valid session exported in the environment and reports
+// whether every account found one
+func (multi *MultiClient) UseEnvSession(ctx context.Context) (bool, error) {
+	all := true
+	for _, shorthand := range multi.Shorthands {
+		envClient, ok := multi.Clients[shorthand].(envSessionClient)
+		if !ok {
+			all = false
+			continue
+		}
+		found, errUseEnvSession := envClient.UseEnvSession(ctx)
+		if errUseEnvSession != nil {
+			return false, fmt.Errorf("Unable to check the session of the 1Password account %q: %w", shorthand, errUseEnvSession)
+		}
+		all = all && found
+	}
+	return all, nil
+}
+
+// GetAccount returns the details of every account and fails when any of them has no active session
+func (multi *MultiClient) GetAccount(ctx context.Context) (*string, error) {
+	details := []string{}
+	for _, shorthand := range multi.Shorthands {
+		account, errGetAccount := multi.Clients[shorthand].GetAccount(ctx)
+		if errGetAccount != nil {
+			return nil, fmt.Errorf("The 1Password account %q has no active session: %w", shorthand, errGetAccount)
+		}
+		details = append(details, *account)
+	}
+	out := strings.Join(details, "\n")
+	return &out, nil
+}
+
+// Signin signs into every account without an active session, saving each to its own session file
+func (multi *MultiClient) Signin(ctx context.Context, sessionFilename string) error {
+	for _, shorthand := range multi.Shorthands {
+		client := multi.Clients[shorthand]
+		_, errGetAccount := client.GetAccount(ctx)
+		if errGetAccount == nil {
+			continue
+		}
+		if !errors.Is(errGetAccount, ErrNotSignedIn) {
+			return fmt.Errorf("Unable to check the session of the 1Password account %q: %w", shorthand, errGetAccount)
+		}
+		errSignin := client.Signin(ctx, SessionFilename(sessionFilename, shorthand))
+		if errSignin != nil {
+			return fmt.Errorf("Unable to sign into the 1Password account %q: %w", shorthand, errSignin)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package op_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/op/optest"
+)
+
+func newTestMultiClient() (*op.MultiClient, *optest.Client, *optest.Client) {
+	agency := optest.New(
+		optest.NewItem("uuid-a", "AWS agency", "ACCOUNT_INFO", "ACCOUNT_ALIAS", "agency"),
+		optest.NewItem("uuid-shared-a", "AWS shared", "ACCOUNT_INFO", "ACCOUNT_ALIAS", "shared-agency"),
+	)
+	agency.Totps["AWS agency"] = "111111"
+	contractor := optest.New(
+		optest.NewItem("uuid-c", "AWS contractor", "ACCOUNT_INFO", "ACCOUNT_ALIAS", "contractor"),
+		optest.NewItem("uuid-shared-c", "AWS shared", "ACCOUNT_INFO", "ACCOUNT_ALIAS", "shared-contractor"),
+	)
+	contractor.Totps["AWS contractor"] = "222222"
+	contractor.Totps["uuid-shared-c"] = "333333"
+	multi := &op.MultiClient{
+		Shorthands: []string{"agency", "contractor"},
+		Clients: map[string]op.Client{
+			"agency":     agency,
+			"contractor": contractor,
+		},
+	}
+	return multi, agency, contractor
+}
+
+func TestSessionFilename(t *testing.T) {
+	assert.Equal(t, "/home/user/.op_session", op.SessionFilename("/home/user/.op_session", ""))
+	assert.Equal(t, "/home/user/.op_session_dds", op.SessionFilename("/home/user/.op_session", "dds"))
+}
+
+func TestMultiClientListItems(t *testing.T) {
+	multi, _, _ := newTestMultiClient()
+
+	items, err := multi.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 4)
+	assert.Equal(t, "agency", items[0].Account)
+	assert.Equal(t, "agency", items[1].Account)
+	assert.Equal(t, "contractor", items[2].Account)
+	assert.Equal(t, "contractor", items[3].Account)
+}
+
+func TestMultiClientRoutesLookups(t *testing.T) {
+	multi, agency, contractor := newTestMultiClient()
+	_, err := multi.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+
+	item, err := multi.GetItem(context.Background(), "AWS contractor")
+	require.NoError(t, err)
+	assert.Equal(t, "contractor", item.Account)
+	assert.Equal(t, 0, agency.CallCount(optest.MethodGetItem))
+
+	totp, err := multi.GetTotp(context.Background(), "uuid-shared-c")
+	require.NoError(t, err)
+	assert.Equal(t, "333333\n", *totp)
+	assert.Equal(t, 0, agency.CallCount(optest.MethodGetTotp))
+	assert.Equal(t, 1, contractor.CallCount(optest.MethodGetTotp))
+}
+
+func TestMultiClientSearchesUnlistedItems(t *testing.T) {
+	multi, agency, _ := newTestMultiClient()
+
+	totp, err := multi.GetTotp(context.Background(), "AWS contractor")
+	require.NoError(t, err)
+	assert.Equal(t, "222222\n", *totp)
+	assert.Equal(t, 1, agency.CallCount(optest.MethodGetTotp))
+
+	_, err = multi.GetItem(context.Background(), "AWS missing")
+	assert.Error(t, err)
+}
+
+func TestMultiClientSignin(t *testing.T) {
+	multi, agency, contractor := newTestMultiClient()
+	contractor.SignedIn = false
+
+	source, err := op.EnsureSession(context.Background(), multi, "/home/user/.op_session")
+	require.NoError(t, err)
+	assert.Equal(t, op.SessionSourceSignin, source)
+	assert.Equal(t, 0, agency.CallCount(optest.MethodSignin))
+	require.Equal(t, 1, contractor.CallCount(optest.MethodSignin))
+	for _, call := range contractor.Calls {
+		if call.Method == optest.MethodSignin {
+			assert.Equal(t, []string{"/home/user/.op_session_contractor"}, call.Args)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package op
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Catalog is the cached list of 1Password items along with the details fetched for them
+type Catalog struct {
+	// Tags, Accounts and Vaults are what the items were listed with, since a different listing can't reuse them
+	Tags        string        `json:"tags"`
+	Accounts    []string      `json:"accounts,omitempty"`
+	Vaults      []string      `json:"vaults,omitempty"`
+	Items       []CatalogItem `json:"items"`
+	RefreshedAt time.Time     `json:"refreshed_at"`
+}
+
+// CatalogItem is a cached item identified by its account, vault and UUID
+type CatalogItem struct {
+	Item Item `json:"item"`
+	// Detailed is true once the sections of the item have been fetched
+	Detailed bool `json:"detailed"`
+}
+
+// CatalogStore keeps the catalog between runs somewhere the aliases it holds aren't readable by others
+type CatalogStore interface {
+	LoadCatalog(key string) (*Catalog, error)
+	SaveCatalog(key string, catalog *Catalog) error
+}
+
+// CachedClient lists items from a catalog saved by an earlier run and refreshes it in the background
+type CachedClient struct {
+	Client Client
+	Store  CatalogStore
+	// Key is where the catalog is saved, which is the session file path of the client
+	Key string
+	// Accounts are the shorthands of the accounts the client lists items from
+	Accounts []string
+	// Vaults are the vaults the client lists items from, with none meaning every vault
+	Vaults []string
+	// Refresh lists the items from 1Password instead of the catalog
+	Refresh bool
+
+	mu         sync.Mutex
+	catalog    *Catalog
+	refreshing chan struct{}
+	cancel     context.CancelFunc
+}
+
+var _ Client = (*CachedClient)(nil)
+
+// NewCachedClient returns the client with its item list cached in the store under the key
+func NewCachedClient(client Client, store CatalogStore, key string, accounts []string, vaults []string, refresh bool) *CachedClient {
+	return &CachedClient{
+		Client:   client,
+		Store:    store,
+		Key:      key,
+		Accounts: accounts,
+		Vaults:   vaults,
+		Refresh:  refresh,
+	}
+}
+
+// catalogKey identifies an item across the accounts and vaults it may be listed from
+func catalogKey(item Item) string {
+	return strings.Join([]string{item.Account, item.VaultUuid, item.Uuid}, "/")
+}
+
+// summarize returns the item without its login fields, notes or concealed values such as the one-time
+// password seed, so only what is needed to choose the item and read its alias is cached
+func summarize(item Item) Item {
+	summary := item
+	summary.Details = Details{}
+	for _, section := range item.Details.Sections {
+		fields := []SectionField{}
+		for _, field := range section.Fields {
+			if field.K == "concealed" || strings.HasPrefix(field.N, "TOTP_") || strings.HasPrefix(field.V, "otpauth://") {
+				continue
+			}
+			fields = append(fields, field)
+		}
+		summary.Details.Sections = append(summary.Details.Sections, Section{Name: section.Name, Title: section.Title, Fields: fields})
+	}
+	return summary
+}
+
+// unchanged reports whether the listed item is the version the cached entry was made from
+func (entry CatalogItem) unchanged(listed Item) bool {
+	if listed.ItemVersion == 0 && listed.UpdatedAt.IsZero() {
+		return false
+	}
+	return entry.Item.ItemVersion == listed.ItemVersion && entry.Item.UpdatedAt.Equal(listed.UpdatedAt)
+}
+
+// reconcile returns the entries for the listed items, keeping the details of the cached items that haven't changed
+func reconcile(cached []CatalogItem, listed []Item) []CatalogItem {
+	previous := map[string]CatalogItem{}
+	for _, entry := range cached {
+		previous[catalogKey(entry.Item)] = entry
+	}
+	entries := make([]CatalogItem, 0, len(listed))
+	for _, item := range listed {
+		if entry, ok := previous[catalogKey(item)]; ok && entry.Detailed && entry.unchanged(item) {
+			entries = append(entries, entry)
+			continue
+		}
+		entries = append(entries, CatalogItem{Item: summarize(item)})
+	}
+	return entries
+}
+
+// listedWith reports whether the catalog was listed with the tags, accounts and vaults of the client
+func (client *CachedClient) listedWith(catalog *Catalog, tags string) bool {
+	return catalog.Tags == tags &&
+		strings.Join(catalog.Accounts, ",") == strings.Join(client.Accounts, ",") &&
+		strings.Join(catalog.Vaults, ",") == strings.Join(client.Vaults, ",")
+}
+
+// load returns the catalog saved for the tags, or nil when there isn't a usable one
+func (client *CachedClient) load(tags string) *Catalog {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.catalog == nil {
+		catalog, errLoad := client.Store.LoadCatalog(client.Key)
+		if errLoad != nil || catalog == nil {
+			// A catalog that can't be read is listed again
+			catalog = &Catalog{}
+		}
+		client.catalog = catalog
+	}
+	if !client.listedWith(client.catalog, tags) {
+		return nil
+	}
+	return client.catalog
+}
+
+// list lists the items from 1Password and saves them to the catalog
+func (client *CachedClient) list(ctx context.Context, tags string) ([]Item, error) {
+	items, errListItems := client.Client.ListItems(ctx, tags)
+	if errListItems != nil {
+		return items, errListItems
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	var cached []CatalogItem
+	if client.catalog != nil && client.listedWith(client.catalog, tags) {
+		cached = client.catalog.Items
+	}
+	client.catalog = &Catalog{
+		Tags:        tags,
+		Accounts:    client.Accounts,
+		Vaults:      client.Vaults,
+		Items:       reconcile(cached, items),
+		RefreshedAt: time.Now(),
+	}
+	// The catalog only saves time on the next run so failing to save it isn't an error
+	_ = client.Store.SaveCatalog(client.Key, client.catalog)
+	return items, nil
+}
+
+// ListItems returns the cached items straight away and lists them again in the background, only waiting
+// for 1Password when nothing is cached or Refresh is set
+func (client *CachedClient) ListItems(ctx context.Context, tags string) ([]Item, error) {
+	catalog := client.load(tags)
+	if client.Refresh || catalog == nil || len(catalog.Items) == 0 {
+		return client.list(ctx, tags)
+	}
+
+	client.mu.Lock()
+	items := make([]Item, 0, len(catalog.Items))
+	for _, entry := range catalog.Items {
+		items = append(items, entry.Item)
+	}
+	if client.refreshing == nil {
+		// The refresh outlives this call so it is only stopped by Wait, and it can't ask for a password
+		// while the menu is waiting for a choice
+		refreshCtx, cancel := context.WithCancel(WithoutSignin(context.Background()))
+		client.refreshing, client.cancel = make(chan struct{}), cancel
+		go func(done chan struct{}) {
+			defer close(done)
+			defer cancel()
+			_, _ = client.list(refreshCtx, tags)
+		}(client.refreshing)
+	}
+	client.mu.Unlock()
+	return items, nil
+}
+
+// Wait waits for a background refresh to save the catalog, stopping it when ctx is done first
+func (client *CachedClient) Wait(ctx context.Context) error {
+	client.mu.Lock()
+	refreshing, cancel := client.refreshing, client.cancel
+	client.mu.Unlock()
+	if refreshing == nil {
+		return nil
+	}
+	select {
+	case <-refreshing:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+// GetItem always fetches the item from 1Password, since the cached details leave out the one-time password
+// seed and may predate an edit the background refresh hasn't seen yet. The details are then cached for the
+// menu and the alias lookups of the next run.
+func (client *CachedClient) GetItem(ctx context.Context, name string) (*Item, error) {
+	item, errGetItem := client.Client.GetItem(ctx, name)
+	if errGetItem != nil {
+		return item, errGetItem
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.catalog == nil {
+		return item, nil
+	}
+	for i, entry := range client.catalog.Items {
+		if entry.Item.Uuid == item.Uuid && entry.Item.VaultUuid == item.VaultUuid && entry.unchanged(*item) {
+			detailed := summarize(*item)
+			// The account and vault name come from the listing
+			detailed.Account, detailed.VaultName = entry.Item.Account, entry.Item.VaultName
+			client.catalog.Items[i] = CatalogItem{Item: detailed, Detailed: true}
+			_ = client.Store.SaveCatalog(client.Key, client.catalog)
+			break
+		}
+	}
+	return item, nil
+}
+
+func (client *CachedClient) GetTotp(ctx context.Context, name string) (*string, error) {
+	return client.Client.GetTotp(ctx, name)
+}
+
+func (client *CachedClient) GetAccount(ctx context.Context) (*string, error) {
+	return client.Client.GetAccount(ctx)
+}
+
+func (client *CachedClient) Signin(ctx context.Context, sessionFilename string) error {
+	return client.Client.Signin(ctx, sessionFilename)
+}
+
+// UseEnvSession switches the wrapped client to a session exported in the environment when it can
+func (client *CachedClient) UseEnvSession(ctx context.Context) (bool, error) {
+	if envClient, ok := client.Client.(envSessionClient); ok {
+		return envClient.UseEnvSession(ctx)
+	}
+	return false, nil
+}
+
+// SessionTrusted reports whether the wrapped client can skip checking its session
+func (client *CachedClient) SessionTrusted() bool {
+	trusted, ok := client.Client.(trustedSessionClient)
+	return ok && trusted.SessionTrusted()
+}
@@ -0,0 +1,160 @@
+package op_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/99designs/keyring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/op/optest"
+)
+
+const testCatalogKey = "/home/user/.op_session"
+
+func newCatalogClient() *optest.Client {
+	item := optest.NewItem("uuid-a", "AWS agency", "ACCOUNT_INFO", "ACCOUNT_ALIAS", "agency")
+	item.ItemVersion = 1
+	item.VaultUuid = "vault-a"
+	item.Details.Sections[0].Fields = append(item.Details.Sections[0].Fields, op.SectionField{
+		K: "concealed",
+		N: "TOTP_abc",
+		V: "otpauth://totp/AWS?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+	})
+	item.Details.Fields = []op.Field{{Designation: "password", Value: "hunter2"}}
+	return optest.New(item)
+}
+
+func TestCachedClientFirstRun(t *testing.T) {
+	store := &op.KeyringStore{Keyring: keyring.NewArrayKeyring(nil)}
+	inner := newCatalogClient()
+	client := op.NewCachedClient(inner, store, testCatalogKey, nil, nil, false)
+
+	// Nothing is cached so the items are listed straight away
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, 1, inner.CallCount(optest.MethodListItems))
+
+	item, err := client.GetItem(context.Background(), "uuid-a")
+	require.NoError(t, err)
+	_, ok := item.OTPSecret()
+	assert.True(t, ok, "the fetched item should keep its seed")
+
+	catalog, err := store.LoadCatalog(testCatalogKey)
+	require.NoError(t, err)
+	require.Len(t, catalog.Items, 1)
+	cached := catalog.Items[0]
+	assert.True(t, cached.Detailed)
+	assert.Equal(t, "agency", cached.Item.Details.Sections[0].Fields[0].V)
+	_, ok = cached.Item.OTPSecret()
+	assert.False(t, ok, "the seed should not be cached")
+	assert.Empty(t, cached.Item.Details.Fields, "the login fields should not be cached")
+}
+
+func TestCachedClientUsesCatalog(t *testing.T) {
+	store := &op.KeyringStore{Keyring: keyring.NewArrayKeyring(nil)}
+	_, err := op.NewCachedClient(newCatalogClient(), store, testCatalogKey, nil, nil, false).ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	_, err = op.NewCachedClient(newCatalogClient(), store, testCatalogKey, nil, nil, false).GetItem(context.Background(), "uuid-a")
+	require.NoError(t, err)
+
+	// The item changed since it was cached
+	inner := newCatalogClient()
+	inner.Items[0].ItemVersion = 2
+	inner.Items[0].Details.Sections[0].Fields[0].V = "renamed"
+	client := op.NewCachedClient(inner, store, testCatalogKey, nil, nil, false)
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "AWS agency", items[0].Overview.Title)
+
+	require.NoError(t, client.Wait(context.Background()))
+	assert.Equal(t, 1, inner.CallCount(optest.MethodListItems), "the items should be listed again in the background")
+	item, err := client.GetItem(context.Background(), "uuid-a")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", item.Details.Sections[0].Fields[0].V)
+	assert.Equal(t, 1, inner.CallCount(optest.MethodGetItem))
+
+	// An unchanged item is listed with its cached details but still fetched for its seed
+	inner = newCatalogClient()
+	inner.Items[0].ItemVersion = 2
+	inner.Items[0].Details.Sections[0].Fields[0].V = "renamed"
+	client = op.NewCachedClient(inner, store, testCatalogKey, nil, nil, false)
+	items, err = client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", items[0].Details.Sections[0].Fields[0].V)
+	require.NoError(t, client.Wait(context.Background()))
+	item, err = client.GetItem(context.Background(), "uuid-a")
+	require.NoError(t, err)
+	_, ok := item.OTPSecret()
+	assert.True(t, ok, "the fetched item should keep its seed")
+	assert.Equal(t, 1, inner.CallCount(optest.MethodGetItem))
+}
+
+func TestCachedClientFetchesEditedItem(t *testing.T) {
+	store := &op.KeyringStore{Keyring: keyring.NewArrayKeyring(nil)}
+	first := op.NewCachedClient(newCatalogClient(), store, testCatalogKey, nil, nil, false)
+	_, err := first.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	_, err = first.GetItem(context.Background(), "uuid-a")
+	require.NoError(t, err)
+
+	// The item is chosen from the cached menu before the refresh has seen it change
+	inner := newCatalogClient()
+	inner.Items[0].ItemVersion = 2
+	inner.Items[0].Details.Sections[0].Fields[0].V = "renamed"
+	client := op.NewCachedClient(inner, store, testCatalogKey, nil, nil, false)
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Equal(t, "agency", items[0].Details.Sections[0].Fields[0].V)
+	item, err := client.GetItem(context.Background(), "uuid-a")
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", item.Details.Sections[0].Fields[0].V)
+	require.NoError(t, client.Wait(context.Background()))
+}
+
+func TestCachedClientRefresh(t *testing.T) {
+	store := &op.KeyringStore{Keyring: keyring.NewArrayKeyring(nil)}
+	_, err := op.NewCachedClient(newCatalogClient(), store, testCatalogKey, nil, nil, false).ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+
+	// Refreshing waits for 1Password and reports its errors
+	inner := newCatalogClient()
+	errNetwork := errors.New("network is unreachable")
+	inner.Errors[optest.MethodListItems] = errNetwork
+	_, err = op.NewCachedClient(inner, store, testCatalogKey, nil, nil, true).ListItems(context.Background(), "aws")
+	assert.Equal(t, errNetwork, err)
+
+	// A catalog of other accounts isn't used
+	inner = newCatalogClient()
+	client := op.NewCachedClient(inner, store, testCatalogKey, []string{"agency", "contractor"}, nil, false)
+	_, err = client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Equal(t, 1, inner.CallCount(optest.MethodListItems))
+	require.NoError(t, client.Wait(context.Background()))
+}
+
+func TestCachedClientSwitchesVaults(t *testing.T) {
+	store := &op.KeyringStore{Keyring: keyring.NewArrayKeyring(nil)}
+	_, err := op.NewCachedClient(newCatalogClient(), store, testCatalogKey, nil, []string{"Engineering"}, false).ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+
+	// A catalog of other vaults isn't used, and the items are listed from 1Password straight away
+	inner := newCatalogClient()
+	inner.Items[0].Uuid = "uuid-b"
+	client := op.NewCachedClient(inner, store, testCatalogKey, nil, []string{"Operations"}, false)
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "uuid-b", items[0].Uuid)
+	assert.Equal(t, 1, inner.CallCount(optest.MethodListItems))
+	require.NoError(t, client.Wait(context.Background()))
+
+	catalog, err := store.LoadCatalog(testCatalogKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Operations"}, catalog.Vaults)
+}
@@ -0,0 +1,71 @@
+package op
+
+import (
+	"context"
+	"errors"
+)
+
+// Client is the set of 1Password operations used to log into AWS
+// and each call stops once its context is done.
+type Client interface {
+	ListItems(ctx context.Context, tags string) ([]Item, error)
+	GetItem(ctx context.Context, name string) (*Item, error)
+	GetTotp(ctx context.Context, name string) (*string, error)
+	GetAccount(ctx context.Context) (*string, error)
+	Signin(ctx context.Context, sessionFilename string) error
+}
+
+var _ Client = (*Config)(nil)
+
+// The places EnsureSession finds an active session
+const (
+	SessionSourceEnv    = "environment"
+	SessionSourceStore  = "session store"
+	SessionSourceSignin = "signin"
+)
+
+// envSessionClient is implemented by clients that can use a session exported in the environment
+type envSessionClient interface {
+	UseEnvSession(ctx context.Context) (bool, error)
+}
+
+// trustedSessionClient is implemented by clients that can tell their session is still active without checking it
+type trustedSessionClient interface {
+	SessionTrusted() bool
+}
+
+// EnsureSession confirms the client has an active session and returns where it came from. A saved session
+// used within its idle timeout is trusted without running op, otherwise a valid session in the environment
+// is used first, then the saved session, and the client signs in again only when both have expired.
+func EnsureSession(ctx context.Context, client Client, sessionFilename string) (string, error) {
+	if trusted, ok := client.(trustedSessionClient); ok && trusted.SessionTrusted() {
+		return SessionSourceStore, nil
+	}
+
+	if envClient, ok := client.(envSessionClient); ok {
+		found, errUseEnvSession := envClient.UseEnvSession(ctx)
+		if errUseEnvSession != nil {
+			return "", errUseEnvSession
+		}
+		if found {
+			return SessionSourceEnv, nil
+		}
+	}
+
+	_, err := client.GetAccount(ctx)
+	if err == nil {
+		return SessionSourceStore, nil
+	}
+	if !errors.Is(err, ErrNotSignedIn) {
+		return "", err
+	}
+	err = client.Signin(ctx, sessionFilename)
+	if err != nil {
+		return "", err
+	}
+	_, err = client.GetAccount(ctx)
+	if err != nil {
+		return "", err
+	}
+	return SessionSourceSignin, nil
+}
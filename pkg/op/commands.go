@@ -1,54 +1,157 @@
 package op
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 )
 
-func (config *Config) GetItem(name string) (*Item, error) {
-	var item Item
+// vaultScopes returns the vaults each lookup runs in, where an empty vault searches every vault
+func (config *Config) vaultScopes() []string {
+	if len(config.Vaults) == 0 {
+		return []string{""}
+	}
+	return config.Vaults
+}
+
+// itemScopes returns the vaults to look up the named item in, only using the vault it was listed
+// from when the name is the UUID of a listed item
+func (config *Config) itemScopes(name string) []string {
+	config.mu.Lock()
+	vault, ok := config.itemVaults[name]
+	config.mu.Unlock()
+	if ok {
+		return []string{vault}
+	}
+	return config.vaultScopes()
+}
 
-	command, errExec := config.Exec([]string{"get", "item", name})
-	if errExec != nil {
-		return &item, errExec
+func withVault(args []string, vault string) []string {
+	if len(vault) == 0 {
+		return args
 	}
-	out, errOutput := command.Output()
+	return append(args, "--vault", vault)
+}
+
+func (config *Config) getItem(ctx context.Context, d dialect, name, vault string) (*Item, error) {
+	out, errOutput := config.runSignedIn(ctx, withVault(d.getItemArgs(name), vault))
 	if errOutput != nil {
-		return &item, errOutput
+		return nil, config.wrapServiceAccountError(ctx, name, errOutput)
 	}
-	errUnmarshal := json.Unmarshal(out, &item)
-	if errUnmarshal != nil {
-		return nil, errUnmarshal
+
+	return d.unmarshalItem(out)
+}
+
+func (config *Config) GetItem(ctx context.Context, name string) (*Item, error) {
+	var item Item
+
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return &item, errDialect
 	}
 
-	return &item, nil
+	var found []*Item
+	var foundIn []string
+	var errGetItem error
+	for _, vault := range config.itemScopes(name) {
+		vaultItem, err := config.getItem(ctx, d, name, vault)
+		if errors.Is(err, ErrItemNotFound) {
+			errGetItem = err
+			continue
+		}
+		if err != nil {
+			return &item, err
+		}
+		found = append(found, vaultItem)
+		foundIn = append(foundIn, vault)
+	}
+	switch len(found) {
+	case 0:
+		return &item, errGetItem
+	case 1:
+		return found[0], nil
+	}
+	return &item, fmt.Errorf("%w: %q was found in the vaults %s", ErrAmbiguousItem, name, strings.Join(foundIn, ", "))
 }
 
-func (config *Config) ListItems(tags string) ([]Item, error) {
+func (config *Config) ListItems(ctx context.Context, tags string) ([]Item, error) {
 	// 1p list items --tags $1 --categories login | jq -Mcr '.[].overview.title' | sort
 	var items []Item
 
-	command, errExec := config.Exec([]string{"list", "items", "--tags", tags, "--categories", "login"})
-	if errExec != nil {
-		return items, errExec
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return items, errDialect
 	}
-	out, errOutput := command.Output()
-	if errOutput != nil {
-		return items, errOutput
+	for _, vault := range config.vaultScopes() {
+		out, errOutput := config.runSignedIn(ctx, withVault(d.listItemsArgs(tags), vault))
+		if errOutput != nil {
+			return items, config.wrapServiceAccountError(ctx, tags, errOutput)
+		}
+		vaultItems, errUnmarshal := d.unmarshalItems(out)
+		if errUnmarshal != nil {
+			return items, errUnmarshal
+		}
+		items = append(items, vaultItems...)
+	}
+
+	config.mu.Lock()
+	if config.itemVaults == nil {
+		config.itemVaults = map[string]string{}
+	}
+	for _, item := range items {
+		if len(item.Uuid) > 0 && len(item.VaultUuid) > 0 {
+			config.itemVaults[item.Uuid] = item.VaultUuid
+		}
 	}
-	errUnmarshal := json.Unmarshal(out, &items)
-	if errUnmarshal != nil {
-		return items, errUnmarshal
+	config.mu.Unlock()
+
+	return items, config.fillVaultNames(ctx, items)
+}
+
+// fillVaultNames adds the vault names op 1.x leaves out when the items come from more than one vault
+func (config *Config) fillVaultNames(ctx context.Context, items []Item) error {
+	missing := false
+	vaults := map[string]bool{}
+	for _, item := range items {
+		vaults[item.VaultUuid] = true
+		missing = missing || len(item.VaultName) == 0
+	}
+	if !missing || len(vaults) < 2 {
+		return nil
 	}
 
-	return items, nil
+	available, errListVaults := config.ListVaults(ctx)
+	if errListVaults != nil {
+		return errListVaults
+	}
+	names := map[string]string{}
+	for _, vault := range available {
+		names[vault.Uuid] = vault.Name
+	}
+	for i := range items {
+		if len(items[i].VaultName) == 0 {
+			items[i].VaultName = names[items[i].VaultUuid]
+		}
+	}
+	return nil
 }
 
-func (config *Config) GetAccount() (*string, error) {
-	command, errExec := config.Exec([]string{"get", "account"})
-	if errExec != nil {
-		return nil, errExec
+func (config *Config) GetAccount(ctx context.Context) (*string, error) {
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return nil, errDialect
+	}
+	if config.IsServiceAccount() {
+		// Service accounts have no account details so confirm the token can read the vaults instead
+		available, errCheck := config.checkServiceAccount(ctx, config.Vaults)
+		if errCheck != nil {
+			return nil, errCheck
+		}
+		strOut := fmt.Sprintf("Service account with access to %s", vaultNames(available))
+		return &strOut, nil
 	}
-	out, errOutput := command.Output()
+	out, errOutput := config.run(ctx, d.getAccountArgs())
 	if errOutput != nil {
 		return nil, errOutput
 	}
@@ -56,16 +159,48 @@ func (config *Config) GetAccount() (*string, error) {
 	return &strOut, nil
 }
 
-func (config *Config) GetTotp(name string) (*string, error) {
+func (config *Config) GetTotp(ctx context.Context, name string) (*string, error) {
+
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return nil, errDialect
+	}
 
-	command, errExec := config.Exec([]string{"get", "totp", name})
-	if errExec != nil {
-		return nil, errExec
+	var found []string
+	var foundIn []string
+	var errGetTotp error
+	for _, vault := range config.itemScopes(name) {
+		out, errOutput := config.runSignedIn(ctx, withVault(d.getTotpArgs(name), vault))
+		if errors.Is(errOutput, ErrItemNotFound) {
+			errGetTotp = config.wrapServiceAccountError(ctx, name, errOutput)
+			continue
+		}
+		if errOutput != nil {
+			return nil, config.wrapServiceAccountError(ctx, name, errOutput)
+		}
+		found = append(found, string(out))
+		foundIn = append(foundIn, vault)
 	}
-	out, errOutput := command.Output()
+	switch len(found) {
+	case 0:
+		return nil, errGetTotp
+	case 1:
+		return &found[0], nil
+	}
+	return nil, fmt.Errorf("%w: %q was found in the vaults %s", ErrAmbiguousItem, name, strings.Join(foundIn, ", "))
+}
+
+func (config *Config) ListVaults(ctx context.Context) ([]Vault, error) {
+	var vaults []Vault
+
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return vaults, errDialect
+	}
+	out, errOutput := config.runSignedIn(ctx, d.listVaultsArgs())
 	if errOutput != nil {
-		return nil, errOutput
+		return vaults, errOutput
 	}
-	strOut := string(out)
-	return &strOut, nil
+
+	return d.unmarshalVaults(out)
 }
@@ -0,0 +1,120 @@
+package op
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpVaultsScript answers like op 1.x with an "AWS shared" item in both the Private and Shared vaults
+const fakeOpVaultsScript = `#!/bin/sh
+vault=""
+prev=""
+for arg in "$@"; do
+  if [ "$prev" = "--vault" ]; then vault="$arg"; fi
+  prev="$arg"
+done
+case "$1 $2" in
+  "--version ") echo "1.12.4" ;;
+  "list vaults") echo '[{"uuid":"vault-private","name":"Private"},{"uuid":"vault-shared","name":"Shared"}]' ;;
+  "list items")
+    case "$vault" in
+      Private) echo '[{"uuid":"item-1","vaultUuid":"vault-private","overview":{"title":"AWS shared"}}]' ;;
+      Shared) echo '[{"uuid":"item-2","vaultUuid":"vault-shared","overview":{"title":"AWS shared"}},{"uuid":"item-3","vaultUuid":"vault-shared","overview":{"title":"AWS team"}}]' ;;
+      *) exit 1 ;;
+    esac
+    ;;
+  "get item")
+    case "$vault/$3" in
+      "Private/AWS shared"|"vault-private/item-1") echo '{"uuid":"item-1","vaultUuid":"vault-private","overview":{"title":"AWS shared"}}' ;;
+      "Shared/AWS shared"|"vault-shared/item-2") echo '{"uuid":"item-2","vaultUuid":"vault-shared","overview":{"title":"AWS shared"}}' ;;
+      "Shared/AWS team"|"vault-shared/item-3") echo '{"uuid":"item-3","vaultUuid":"vault-shared","overview":{"title":"AWS team"}}' ;;
+      *) echo "[ERROR] item not found" >&2; exit 1 ;;
+    esac
+    ;;
+  "get totp")
+    case "$vault/$3" in
+      "Shared/AWS team"|"vault-shared/item-3") echo "123456" ;;
+      *) echo "[ERROR] item not found" >&2; exit 1 ;;
+    esac
+    ;;
+  *) exit 1 ;;
+esac
+`
+
+func TestVaultScopedListItems(t *testing.T) {
+	installFakeOp(t, fakeOpVaultsScript)
+	config := New("OP_SESSION_dds", "token")
+	config.Vaults = []string{"Private", "Shared"}
+
+	items, err := config.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	assert.Equal(t, "Private", items[0].VaultName)
+	assert.Equal(t, "Shared", items[1].VaultName)
+	assert.Equal(t, "Shared", items[2].VaultName)
+
+	// A single vault has no need for names
+	config.Vaults = []string{"Shared"}
+	items, err = config.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Empty(t, items[0].VaultName)
+}
+
+func TestVaultScopedGetItem(t *testing.T) {
+	installFakeOp(t, fakeOpVaultsScript)
+	config := New("OP_SESSION_dds", "token")
+	config.Vaults = []string{"Private", "Shared"}
+
+	item, err := config.GetItem(context.Background(), "AWS team")
+	require.NoError(t, err)
+	assert.Equal(t, "item-3", item.Uuid)
+
+	_, err = config.GetItem(context.Background(), "AWS shared")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Private, Shared")
+
+	config.Vaults = []string{"Private"}
+	item, err = config.GetItem(context.Background(), "AWS shared")
+	require.NoError(t, err)
+	assert.Equal(t, "item-1", item.Uuid)
+
+	_, err = config.GetItem(context.Background(), "AWS team")
+	assert.Error(t, err)
+}
+
+func TestVaultScopedGetTotp(t *testing.T) {
+	installFakeOp(t, fakeOpVaultsScript)
+	config := New("OP_SESSION_dds", "token")
+	config.Vaults = []string{"Private", "Shared"}
+
+	totp, err := config.GetTotp(context.Background(), "AWS team")
+	require.NoError(t, err)
+	assert.Equal(t, "123456\n", *totp)
+
+	config.Vaults = []string{"Private"}
+	_, err = config.GetTotp(context.Background(), "AWS team")
+	assert.Error(t, err)
+}
+
+func TestGetItemByListedUUID(t *testing.T) {
+	installFakeOp(t, fakeOpVaultsScript)
+	config := New("OP_SESSION_dds", "token")
+	config.Vaults = []string{"Private", "Shared"}
+
+	_, err := config.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+
+	// Items sharing a title are told apart by UUID and only looked up in the vault they were listed from
+	item, err := config.GetItem(context.Background(), "item-2")
+	require.NoError(t, err)
+	assert.Equal(t, "vault-shared", item.VaultUuid)
+	assert.Equal(t, []string{"vault-shared"}, config.itemScopes("item-2"))
+
+	totp, err := config.GetTotp(context.Background(), "item-3")
+	require.NoError(t, err)
+	assert.Equal(t, "123456\n", *totp)
+}
@@ -1,15 +1,50 @@
 package op
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Config struct {
 	SessionName  string `json:"session_name"`
 	SessionToken string `json:"session_token"`
+	// Account is the shorthand of the 1Password account the session belongs to
+	Account string `json:"account,omitempty"`
+	// LastUsed is when the session last completed an op command
+	LastUsed time.Time `json:"last_used,omitempty"`
+
+	// ServiceAccountToken authenticates every command without a session when set
+	ServiceAccountToken string `json:"-"`
+	// Store saves new sessions, defaulting to the session file
+	Store SessionStore `json:"-"`
+	// Vaults limits item lookups to these vault names or UUIDs
+	Vaults []string `json:"-"`
+	// Timeout limits how long each op command may run, defaulting to DefaultTimeout
+	Timeout time.Duration `json:"-"`
+	// Password reads the 1Password password when signing in, defaulting to a terminal prompt
+	Password func(message string) (string, error) `json:"-"`
+	// SigninAttempts is how many passwords are tried when signing in, defaulting to DefaultSigninAttempts
+	SigninAttempts int `json:"-"`
+	// IdleTimeout is how long after LastUsed the session is trusted without checking it, where zero always checks
+	IdleTimeout time.Duration `json:"-"`
+
+	dialect dialect
+	// itemVaults remembers the vault UUID of each listed item by item UUID
+	itemVaults map[string]string
+	// storeKey is where the session is saved and storedToken is the token saved there
+	storeKey    string
+	storedToken string
+
+	// mu guards the session, last use, dialect and listed vaults so the commands of the config can run concurrently
+	mu sync.Mutex
 }
 
 func New(sessionName, sessionToken string) *Config {
@@ -21,44 +56,124 @@ func New(sessionName, sessionToken string) *Config {
 }
 
 func (config *Config) GetEnvVars() []string {
+	if config.IsServiceAccount() {
+		return []string{
+			fmt.Sprintf("%s=%s", EnvServiceAccountToken, config.ServiceAccountToken),
+		}
+	}
 	envVars := []string{
 		fmt.Sprintf("%s=%s", config.SessionName, config.SessionToken),
 	}
 	return envVars
 }
 
-func CheckSession(sessionFilename string) (*Config, error) {
-	config, err := LoadConfig(sessionFilename)
-	if err != nil {
-		return nil, err
+// CopySettings copies the settings that aren't saved with the session from base
+func (config *Config) CopySettings(base *Config) {
+	config.Vaults = base.Vaults
+	config.Timeout = base.Timeout
+	config.Password = base.Password
+	config.SigninAttempts = base.SigninAttempts
+	config.IdleTimeout = base.IdleTimeout
+}
+
+// envSessionPrefix starts the name of the variables `eval $(op signin)` exports
+const envSessionPrefix = "OP_SESSION_"
+
+// envSession is a session variable exported in the environment
+type envSession struct {
+	name  string
+	token string
+}
+
+// envSessions returns the sessions exported in the environment, starting with the one named after the account
+func envSessions(account string) []envSession {
+	sessions := []envSession{}
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], envSessionPrefix) || len(parts[1]) == 0 {
+			continue
+		}
+		session := envSession{name: parts[0], token: parts[1]}
+		if len(account) > 0 && session.name == envSessionPrefix+account {
+			sessions = append([]envSession{session}, sessions...)
+			continue
+		}
+		sessions = append(sessions, session)
 	}
+	return sessions
+}
 
-	_, err = config.GetAccount()
-	if err != nil {
-		config, err = Signin(sessionFilename)
-		if err != nil {
-			return nil, err
+// UseEnvSession switches to a session exported in the environment, e.g. by `eval $(op signin)`, once a cheap
+// account call confirms it is still valid. The config is left alone when there is no valid session.
+func (config *Config) UseEnvSession(ctx context.Context) (bool, error) {
+	if config.IsServiceAccount() {
+		return false, nil
+	}
+	sessionName, sessionToken := config.SessionName, config.SessionToken
+	for _, session := range envSessions(config.Account) {
+		config.SessionName, config.SessionToken = session.name, session.token
+		_, errGetAccount := config.GetAccount(ctx)
+		if errGetAccount == nil {
+			return true, nil
+		}
+		config.SessionName, config.SessionToken = sessionName, sessionToken
+		if !errors.Is(errGetAccount, ErrNotSignedIn) {
+			return false, errGetAccount
 		}
-		_, err = config.GetAccount()
-		if err != nil {
-			return nil, err
+	}
+	return false, nil
+}
+
+// sessionStore returns the store new sessions are saved to
+func (config *Config) sessionStore() SessionStore {
+	if config.Store == nil {
+		return FileStore{}
+	}
+	return config.Store
+}
+
+// CheckSession loads the session saved in the store under sessionFilename and signs in again when it has expired,
+// saving the new session to the same store
+func CheckSession(ctx context.Context, store SessionStore, sessionFilename string) (*Config, error) {
+	// A service account token skips the password prompt and the session file entirely
+	if token := os.Getenv(EnvServiceAccountToken); len(token) > 0 {
+		config := NewServiceAccount(token)
+		errCheck := config.CheckServiceAccount(ctx, nil)
+		if errCheck != nil {
+			return nil, errCheck
 		}
 		return config, nil
 	}
 
+	config, err := LoadSession(store, sessionFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = EnsureSession(ctx, config, sessionFilename)
+	if err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
-func LoadConfig(filename string) (*Config, error) {
-	f, err := os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, 0644)
-	defer func() {
-		_ = f.Close()
-	}()
+// LoadSession loads the session saved under key and keeps the store for saving new sessions
+func LoadSession(store SessionStore, key string) (*Config, error) {
+	config, err := store.Load(key)
 	if err != nil {
 		return nil, err
 	}
+	config.Store = store
+	config.storeKey, config.storedToken = key, config.SessionToken
+	return config, nil
+}
 
-	data, err := ioutil.ReadAll(f)
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(filename))
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -74,21 +189,35 @@ func LoadConfig(filename string) (*Config, error) {
 	return &config, nil
 }
 
+// WriteConfig atomically replaces the file with the config, readable only by the user
 func WriteConfig(filename string, config *Config) error {
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	defer func() {
-		_ = f.Close()
-	}()
-	if err != nil {
-		return err
-	}
 	data, errMarshal := json.Marshal(config)
 	if errMarshal != nil {
 		return errMarshal
 	}
+
+	// Write to a temporary file in the same directory and rename it so the session file is never partially written
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	// TempFile creates the file with 0600 so the session is never readable by other users
 	_, errWrite := f.Write(data)
 	if errWrite != nil {
+		_ = f.Close()
 		return errWrite
 	}
-	return nil
+	errSync := f.Sync()
+	if errSync != nil {
+		_ = f.Close()
+		return errSync
+	}
+	errClose := f.Close()
+	if errClose != nil {
+		return errClose
+	}
+	return os.Rename(f.Name(), filename)
 }
@@ -0,0 +1,68 @@
+package op
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpSessionScript answers like op 2.x, accepting the "env-token" and "stored-token" sessions and the password "correct"
+const fakeOpSessionScript = `#!/bin/sh
+case "$1 $2" in
+  "--version ") echo "2.7.1" ;;
+  "account get")
+    case "$OP_SESSION_USERUUID" in
+      env-token|stored-token|new-token) echo '{"id":"ACCOUNTID"}' ;;
+      *) echo "[ERROR] 2022/10/01 12:00:00 You are not currently signed in" >&2; exit 1 ;;
+    esac
+    ;;
+  "account list") echo '[{"url":"dds.1password.com","email":"user@example.com","user_uuid":"USERUUID","shorthand":"dds"}]' ;;
+  "signin --account") read -r password; echo "new-token" ;;
+  *) exit 1 ;;
+esac
+`
+
+func TestEnsureSessionSources(t *testing.T) {
+	installFakeOp(t, fakeOpSessionScript)
+	filename := filepath.Join(t.TempDir(), ".op_session")
+
+	// A valid session in the environment is used first
+	t.Setenv("OP_SESSION_USERUUID", "env-token")
+	config := New("OP_SESSION_USERUUID", "stored-token")
+	source, err := EnsureSession(context.Background(), config, filename)
+	require.NoError(t, err)
+	assert.Equal(t, SessionSourceEnv, source)
+	assert.Equal(t, "env-token", config.SessionToken)
+
+	// An expired session in the environment falls back to the saved session
+	t.Setenv("OP_SESSION_USERUUID", "expired-token")
+	config = New("OP_SESSION_USERUUID", "stored-token")
+	source, err = EnsureSession(context.Background(), config, filename)
+	require.NoError(t, err)
+	assert.Equal(t, SessionSourceStore, source)
+	assert.Equal(t, "stored-token", config.SessionToken)
+
+	// Signing in is the last resort
+	config = New("OP_SESSION_USERUUID", "expired-token")
+	config.Password = func(string) (string, error) {
+		return "correct", nil
+	}
+	source, err = EnsureSession(context.Background(), config, filename)
+	require.NoError(t, err)
+	assert.Equal(t, SessionSourceSignin, source)
+	assert.Equal(t, "new-token", config.SessionToken)
+}
+
+func TestEnvSessions(t *testing.T) {
+	t.Setenv("OP_SESSION_other", "other-token")
+	t.Setenv("OP_SESSION_dds", "dds-token")
+	t.Setenv("OP_SESSION_empty", "")
+
+	sessions := envSessions("dds")
+	require.Len(t, sessions, 2)
+	assert.Equal(t, envSession{name: "OP_SESSION_dds", token: "dds-token"}, sessions[0])
+	assert.Equal(t, envSession{name: "OP_SESSION_other", token: "other-token"}, sessions[1])
+}
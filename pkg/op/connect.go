@@ -0,0 +1,346 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/deptofdefense/awslogin/pkg/totp"
+)
+
+// ConnectClient looks up items through the REST API of a 1Password Connect server
+type ConnectClient struct {
+	Host       string
+	Token      string
+	VaultIDs   []string
+	HTTPClient *http.Client
+
+	now func() time.Time
+
+	mu sync.Mutex
+	// available is the vault list, read once per client
+	available []vaultV2
+	// itemVaults is the vault of each listed item, so it can be fetched by UUID with one call
+	itemVaults map[string]string
+	// fetched holds the items already fetched by name, so GetTotp reuses the item fetched by GetItem
+	fetched map[string]*Item
+	// fetches joins concurrent fetches of the same name
+	fetches singleflight.Group
+}
+
+var _ Client = (*ConnectClient)(nil)
+
+// NewConnect returns a client for the Connect server at host. The vaults can be given by ID or name and
+// when none are given every vault the token can read is used.
+func NewConnect(host, token string, vaultIDs []string) *ConnectClient {
+	return &ConnectClient{
+		Host:       strings.TrimRight(host, "/"),
+		Token:      token,
+		VaultIDs:   vaultIDs,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		now:        time.Now,
+		itemVaults: map[string]string{},
+		fetched:    map[string]*Item{},
+	}
+}
+
+// connectItem is the item JSON returned by the Connect API
+type connectItem struct {
+	ID           string      `json:"id"`
+	Title        string      `json:"title"`
+	Version      int         `json:"version"`
+	Vault        vaultV2     `json:"vault"`
+	Category     string      `json:"category"`
+	LastEditedBy string      `json:"lastEditedBy"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	UpdatedAt    time.Time   `json:"updatedAt"`
+	Trashed      bool        `json:"trashed"`
+	Tags         []string    `json:"tags"`
+	Sections     []sectionV2 `json:"sections"`
+	Fields       []fieldV2   `json:"fields"`
+	URLs         []urlV2     `json:"urls"`
+}
+
+func (item connectItem) toItem() *Item {
+	converted := itemV2{
+		ID:           item.ID,
+		Title:        item.Title,
+		Version:      item.Version,
+		Vault:        item.Vault,
+		Category:     item.Category,
+		LastEditedBy: item.LastEditedBy,
+		CreatedAt:    item.CreatedAt,
+		UpdatedAt:    item.UpdatedAt,
+		Tags:         item.Tags,
+		Sections:     item.Sections,
+		Fields:       item.Fields,
+		URLs:         item.URLs,
+	}.toItem()
+	if item.Trashed {
+		converted.Trashed = "Y"
+	}
+	return converted
+}
+
+func (client *ConnectClient) get(ctx context.Context, path string, v interface{}) error {
+	req, errNewRequest := http.NewRequestWithContext(ctx, http.MethodGet, client.Host+path, nil)
+	if errNewRequest != nil {
+		return errNewRequest
+	}
+	req.Header.Set("Authorization", "Bearer "+client.Token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, errDo := client.HTTPClient.Do(req)
+	if errDo != nil {
+		return errDo
+	}
+	defer resp.Body.Close()
+
+	body, errReadAll := ioutil.ReadAll(resp.Body)
+	if errReadAll != nil {
+		return errReadAll
+	}
+	if resp.StatusCode != http.StatusOK {
+		var connectErr struct {
+			Status  int    `json:"status"`
+			Message string `json:"message"`
+		}
+		message := resp.Status
+		if json.Unmarshal(body, &connectErr) == nil && len(connectErr.Message) > 0 {
+			message = fmt.Sprintf("%s: %s", resp.Status, connectErr.Message)
+		}
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			return fmt.Errorf("%w: call to 1Password Connect %s failed with %s", ErrNotSignedIn, path, message)
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: call to 1Password Connect %s failed with %s", ErrItemNotFound, path, message)
+		}
+		return fmt.Errorf("Call to 1Password Connect %s failed with %s", path, message)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// vaults returns the configured vaults, given by ID or name, or every vault the token can read
+func (client *ConnectClient) vaults(ctx context.Context) ([]vaultV2, error) {
+	client.mu.Lock()
+	available := client.available
+	client.mu.Unlock()
+	if available == nil {
+		errGet := client.get(ctx, "/v1/vaults", &available)
+		if errGet != nil {
+			return nil, errGet
+		}
+		client.mu.Lock()
+		client.available = available
+		client.mu.Unlock()
+	}
+	if len(client.VaultIDs) == 0 {
+		return available, nil
+	}
+
+	vaults := []vaultV2{}
+	for _, id := range client.VaultIDs {
+		found := false
+		for _, vault := range available {
+			if vault.ID == id || vault.Name == id {
+				vaults = append(vaults, vault)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("The 1Password Connect token does not have access to the vault %q", id)
+		}
+	}
+	return vaults, nil
+}
+
+func (client *ConnectClient) ListItems(ctx context.Context, tags string) ([]Item, error) {
+	items := []Item{}
+
+	vaults, errVaults := client.vaults(ctx)
+	if errVaults != nil {
+		return items, errVaults
+	}
+	for _, vault := range vaults {
+		var summaries []connectItem
+		errGet := client.get(ctx, fmt.Sprintf("/v1/vaults/%s/items", url.PathEscape(vault.ID)), &summaries)
+		if errGet != nil {
+			return items, errGet
+		}
+		for _, summary := range summaries {
+			if summary.Trashed || summary.Category != "LOGIN" || !hasTag(summary.Tags, tags) {
+				continue
+			}
+			item := summary.toItem()
+			item.VaultName = vault.Name
+			items = append(items, *item)
+			client.mu.Lock()
+			client.itemVaults[summary.ID] = vault.ID
+			client.mu.Unlock()
+		}
+	}
+	return items, nil
+}
+
+// GetItem returns the item with the given title or UUID, fetching each name once per client
+func (client *ConnectClient) GetItem(ctx context.Context, name string) (*Item, error) {
+	client.mu.Lock()
+	item, ok := client.fetched[name]
+	client.mu.Unlock()
+	if ok {
+		return item, nil
+	}
+
+	fetched, errDo, _ := client.fetches.Do(name, func() (interface{}, error) {
+		item, errFetch := client.fetchItem(ctx, name)
+		if errFetch != nil {
+			return nil, errFetch
+		}
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		client.fetched[name] = item
+		return item, nil
+	})
+	if errDo != nil {
+		return nil, errDo
+	}
+	return fetched.(*Item), nil
+}
+
+// fetchItem gets a listed item straight from its vault and looks any other name up in each vault, by UUID
+// when it looks like one and with a title filter otherwise
+func (client *ConnectClient) fetchItem(ctx context.Context, name string) (*Item, error) {
+	client.mu.Lock()
+	vaultID, listed := client.itemVaults[name]
+	client.mu.Unlock()
+	if listed {
+		return client.getItem(ctx, vaultID, name)
+	}
+
+	vaults, errVaults := client.vaults(ctx)
+	if errVaults != nil {
+		return nil, errVaults
+	}
+	var matches []connectItem
+	for _, vault := range vaults {
+		if isConnectUUID(name) {
+			var item connectItem
+			errGet := client.get(ctx, fmt.Sprintf("/v1/vaults/%s/items/%s", url.PathEscape(vault.ID), url.PathEscape(name)), &item)
+			if errors.Is(errGet, ErrItemNotFound) {
+				continue
+			}
+			if errGet != nil {
+				return nil, errGet
+			}
+			if !item.Trashed {
+				return item.toItem(), nil
+			}
+			continue
+		}
+
+		var summaries []connectItem
+		filter := url.QueryEscape("title eq " + strconv.Quote(name))
+		errGet := client.get(ctx, fmt.Sprintf("/v1/vaults/%s/items?filter=%s", url.PathEscape(vault.ID), filter), &summaries)
+		if errGet != nil {
+			return nil, errGet
+		}
+		for _, summary := range summaries {
+			if !summary.Trashed && summary.Title == name {
+				summary.Vault.ID = vault.ID
+				matches = append(matches, summary)
+			}
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, fmt.Errorf("%w: %q isn't an item in any vault", ErrItemNotFound, name)
+	case len(matches) > 1:
+		duplicates := make([]string, 0, len(matches))
+		for _, match := range matches {
+			duplicates = append(duplicates, fmt.Sprintf("%s in the vault %s", match.ID, match.Vault.ID))
+		}
+		return nil, fmt.Errorf("%w %q, use one of the UUIDs %s", ErrAmbiguousItem, name, strings.Join(duplicates, ", "))
+	}
+	return client.getItem(ctx, matches[0].Vault.ID, matches[0].ID)
+}
+
+// getItem fetches the item with the UUID from the vault
+func (client *ConnectClient) getItem(ctx context.Context, vaultID, id string) (*Item, error) {
+	var item connectItem
+	errGet := client.get(ctx, fmt.Sprintf("/v1/vaults/%s/items/%s", url.PathEscape(vaultID), url.PathEscape(id)), &item)
+	if errGet != nil {
+		return nil, errGet
+	}
+	return item.toItem(), nil
+}
+
+// GetTotp computes the one-time password from the OTP field of the item, reusing the item GetItem fetched
+func (client *ConnectClient) GetTotp(ctx context.Context, name string) (*string, error) {
+	item, errGetItem := client.GetItem(ctx, name)
+	if errGetItem != nil {
+		return nil, errGetItem
+	}
+	secret, ok := item.OTPSecret()
+	if !ok {
+		return nil, fmt.Errorf("%q has no one-time password field", name)
+	}
+	key, errParse := totp.Parse(secret)
+	if errParse != nil {
+		return nil, errParse
+	}
+	code := key.Generate(client.now())
+	return &code, nil
+}
+
+// GetAccount confirms the token is accepted and returns the vaults it can read
+func (client *ConnectClient) GetAccount(ctx context.Context) (*string, error) {
+	var vaults []vaultV2
+	errGet := client.get(ctx, "/v1/vaults", &vaults)
+	if errGet != nil {
+		return nil, errGet
+	}
+	names := make([]string, 0, len(vaults))
+	for _, vault := range vaults {
+		names = append(names, vault.Name)
+	}
+	account := strings.Join(names, "\n")
+	return &account, nil
+}
+
+// Signin is a no-op because Connect authenticates every request with the token
+func (client *ConnectClient) Signin(ctx context.Context, sessionFilename string) error {
+	return nil
+}
+
+// isConnectUUID reports whether the name has the form of a 1Password UUID: 26 lowercase letters and digits
+func isConnectUUID(name string) bool {
+	if len(name) != 26 {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package op
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConnectToken = "connect-token"
+
+// newConnectServer serves the fixtures in testdata/connect the way the Connect API does, applying title
+// filters, and returns the requests it was sent
+func newConnectServer(t *testing.T) (*httptest.Server, *[]string) {
+	routes := map[string]string{
+		"/v1/vaults": "vaults.json",
+		"/v1/vaults/w3ezfgzxsz6ohbeo7ddh4irq4a/items":                            "items.json",
+		"/v1/vaults/ftz7mmh2amadyagiwbyu3ifkmq/items":                            "",
+		"/v1/vaults/w3ezfgzxsz6ohbeo7ddh4irq4a/items/4d2sfuhd5vhxzcc2ck7vxd3mfe": "item.json",
+	}
+	var mu sync.Mutex
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.RequestURI())
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+testConnectToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"status":401,"message":"Invalid token signature"}`))
+			return
+		}
+		fixture, ok := routes[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"status":404,"message":"Not found"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if len(fixture) == 0 {
+			_, _ = w.Write([]byte("[]"))
+			return
+		}
+		body := readFixture(t, filepath.Join("connect", fixture))
+		if filter := r.URL.Query().Get("filter"); len(filter) > 0 {
+			title, errUnquote := strconv.Unquote(strings.TrimPrefix(filter, "title eq "))
+			require.NoError(t, errUnquote)
+			var items []map[string]interface{}
+			require.NoError(t, json.Unmarshal(body, &items))
+			filtered := []map[string]interface{}{}
+			for _, item := range items {
+				if item["title"] == title {
+					filtered = append(filtered, item)
+				}
+			}
+			body, _ = json.Marshal(filtered)
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestConnectListItems(t *testing.T) {
+	server, _ := newConnectServer(t)
+	client := NewConnect(server.URL+"/", testConnectToken, nil)
+
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "AWS alias-example", items[0].Overview.Title)
+	assert.Equal(t, "4d2sfuhd5vhxzcc2ck7vxd3mfe", items[0].Uuid)
+	assert.Equal(t, "w3ezfgzxsz6ohbeo7ddh4irq4a", items[0].VaultUuid)
+}
+
+func TestConnectGetItem(t *testing.T) {
+	server, requests := newConnectServer(t)
+	client := NewConnect(server.URL, testConnectToken, []string{"w3ezfgzxsz6ohbeo7ddh4irq4a"})
+
+	for _, name := range []string{"AWS alias-example", "4d2sfuhd5vhxzcc2ck7vxd3mfe"} {
+		item, err := client.GetItem(context.Background(), name)
+		require.NoError(t, err)
+		require.Len(t, item.Details.Sections, 2)
+		assert.Equal(t, "ACCOUNT_INFO", item.Details.Sections[0].Title)
+		assert.Equal(t, "alias-example", item.Details.Sections[0].Fields[0].V)
+	}
+	// Titles are filtered by the server and UUIDs are fetched straight away
+	assert.Equal(t, []string{
+		"/v1/vaults",
+		"/v1/vaults/w3ezfgzxsz6ohbeo7ddh4irq4a/items?filter=title+eq+%22AWS+alias-example%22",
+		"/v1/vaults/w3ezfgzxsz6ohbeo7ddh4irq4a/items/4d2sfuhd5vhxzcc2ck7vxd3mfe",
+		"/v1/vaults/w3ezfgzxsz6ohbeo7ddh4irq4a/items/4d2sfuhd5vhxzcc2ck7vxd3mfe",
+	}, *requests)
+
+	_, err := client.GetItem(context.Background(), "AWS alias-example2")
+	assert.Error(t, err, "trashed items should not be found")
+}
+
+func TestConnectGetListedItem(t *testing.T) {
+	server, requests := newConnectServer(t)
+	client := NewConnect(server.URL, testConnectToken, nil)
+
+	items, err := client.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	*requests = nil
+
+	// A listed item is fetched from its vault once, and its one-time password comes from the same fetch
+	item, err := client.GetItem(context.Background(), items[0].Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, "AWS alias-example", item.Overview.Title)
+	client.now = func() time.Time { return time.Unix(59, 0) }
+	code, err := client.GetTotp(context.Background(), items[0].Uuid)
+	require.NoError(t, err)
+	assert.Equal(t, "287082", *code)
+	assert.Equal(t, []string{"/v1/vaults/w3ezfgzxsz6ohbeo7ddh4irq4a/items/4d2sfuhd5vhxzcc2ck7vxd3mfe"}, *requests)
+}
+
+func TestConnectGetTotp(t *testing.T) {
+	server, _ := newConnectServer(t)
+	client := NewConnect(server.URL, testConnectToken, nil)
+	client.now = func() time.Time { return time.Unix(59, 0) }
+
+	code, err := client.GetTotp(context.Background(), "AWS alias-example")
+	require.NoError(t, err)
+	assert.Equal(t, "287082", *code)
+}
+
+func TestConnectInvalidToken(t *testing.T) {
+	server, _ := newConnectServer(t)
+	client := NewConnect(server.URL, "wrong-token", nil)
+
+	_, err := client.GetAccount(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid token signature")
+
+	source, err := EnsureSession(context.Background(), NewConnect(server.URL, testConnectToken, nil), "")
+	assert.NoError(t, err)
+	assert.Equal(t, SessionSourceStore, source)
+}
@@ -0,0 +1,182 @@
+package op
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// dialect describes the command syntax and JSON output of one major version of the op CLI
+type dialect interface {
+	getItemArgs(name string) []string
+	listItemsArgs(tags string) []string
+	getTotpArgs(name string) []string
+	getAccountArgs() []string
+	listVaultsArgs() []string
+	signinArgs(account string) []string
+	sessionName(account Account) string
+	addAccountArgs(address, email, shorthand string) []string
+	unmarshalItem(data []byte) (*Item, error)
+	unmarshalItems(data []byte) ([]Item, error)
+	unmarshalVaults(data []byte) ([]Vault, error)
+}
+
+// dialectForVersion returns the dialect matching the output of `op --version`
+func dialectForVersion(version string) (dialect, error) {
+	v := strings.TrimSpace(version)
+	if len(v) > 0 && v[0] != 'v' {
+		v = "v" + v
+	}
+	switch semver.Major(v) {
+	case "v1":
+		return dialectV1{}, nil
+	case "v2":
+		return dialectV2{}, nil
+	}
+	return nil, fmt.Errorf("Unsupported version of op %q", strings.TrimSpace(version))
+}
+
+// dialectV1 speaks the op 1.x syntax, e.g. `op get item`
+type dialectV1 struct{}
+
+func (dialectV1) getItemArgs(name string) []string {
+	return []string{"get", "item", name}
+}
+
+func (dialectV1) listItemsArgs(tags string) []string {
+	return []string{"list", "items", "--tags", tags, "--categories", "login"}
+}
+
+func (dialectV1) getTotpArgs(name string) []string {
+	return []string{"get", "totp", name}
+}
+
+func (dialectV1) getAccountArgs() []string {
+	return []string{"get", "account"}
+}
+
+func (dialectV1) listVaultsArgs() []string {
+	return []string{"list", "vaults"}
+}
+
+// signinArgs for op 1.x prints only the session token
+func (dialectV1) signinArgs(account string) []string {
+	if len(account) == 0 {
+		return []string{"signin", "--raw"}
+	}
+	return []string{"signin", account, "--raw"}
+}
+
+// sessionName for op 1.x is named after the account shorthand
+func (dialectV1) sessionName(account Account) string {
+	return "OP_SESSION_" + account.Shorthand
+}
+
+// addAccountArgs for op 1.x signs in with the full details, which also adds the account
+func (dialectV1) addAccountArgs(address, email, shorthand string) []string {
+	return []string{"signin", address, email, "--shorthand", shorthand}
+}
+
+func (dialectV1) unmarshalItem(data []byte) (*Item, error) {
+	var item Item
+	errUnmarshal := json.Unmarshal(data, &item)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	return &item, nil
+}
+
+func (dialectV1) unmarshalItems(data []byte) ([]Item, error) {
+	var items []Item
+	errUnmarshal := json.Unmarshal(data, &items)
+	if errUnmarshal != nil {
+		return items, errUnmarshal
+	}
+	return items, nil
+}
+
+func (dialectV1) unmarshalVaults(data []byte) ([]Vault, error) {
+	var vaults []Vault
+	errUnmarshal := json.Unmarshal(data, &vaults)
+	if errUnmarshal != nil {
+		return vaults, errUnmarshal
+	}
+	return vaults, nil
+}
+
+// dialectV2 speaks the op 2.x syntax, e.g. `op item get`
+type dialectV2 struct{}
+
+func (dialectV2) getItemArgs(name string) []string {
+	return []string{"item", "get", name, "--format", "json"}
+}
+
+func (dialectV2) listItemsArgs(tags string) []string {
+	return []string{"item", "list", "--tags", tags, "--categories", "Login", "--format", "json"}
+}
+
+func (dialectV2) getTotpArgs(name string) []string {
+	return []string{"item", "get", name, "--otp"}
+}
+
+func (dialectV2) getAccountArgs() []string {
+	return []string{"account", "get", "--format", "json"}
+}
+
+func (dialectV2) listVaultsArgs() []string {
+	return []string{"vault", "list", "--format", "json"}
+}
+
+// signinArgs for op 2.x prints only the session token
+func (dialectV2) signinArgs(account string) []string {
+	if len(account) == 0 {
+		return []string{"signin", "--raw"}
+	}
+	return []string{"signin", "--account", account, "--raw"}
+}
+
+// sessionName for op 2.x is named after the user ID of the account
+func (dialectV2) sessionName(account Account) string {
+	return "OP_SESSION_" + account.UserUUID
+}
+
+func (dialectV2) addAccountArgs(address, email, shorthand string) []string {
+	return []string{"account", "add", "--address", address, "--email", email, "--shorthand", shorthand}
+}
+
+func (dialectV2) unmarshalItem(data []byte) (*Item, error) {
+	var item itemV2
+	errUnmarshal := json.Unmarshal(data, &item)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	return item.toItem(), nil
+}
+
+func (dialectV2) unmarshalItems(data []byte) ([]Item, error) {
+	var itemsV2 []itemV2
+	errUnmarshal := json.Unmarshal(data, &itemsV2)
+	if errUnmarshal != nil {
+		return []Item{}, errUnmarshal
+	}
+	items := make([]Item, 0, len(itemsV2))
+	for _, item := range itemsV2 {
+		items = append(items, *item.toItem())
+	}
+	return items, nil
+}
+
+func (dialectV2) unmarshalVaults(data []byte) ([]Vault, error) {
+	var vaultsV2 []vaultV2
+	errUnmarshal := json.Unmarshal(data, &vaultsV2)
+	if errUnmarshal != nil {
+		return []Vault{}, errUnmarshal
+	}
+	vaults := make([]Vault, 0, len(vaultsV2))
+	for _, vault := range vaultsV2 {
+		vaults = append(vaults, Vault{Uuid: vault.ID, Name: vault.Name})
+	}
+	return vaults, nil
+}
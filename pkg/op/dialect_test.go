@@ -0,0 +1,117 @@
+package op
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return data
+}
+
+func TestDialectForVersion(t *testing.T) {
+	d, err := dialectForVersion("1.12.4\n")
+	assert.NoError(t, err)
+	assert.Equal(t, dialectV1{}, d)
+
+	d, err = dialectForVersion("2.4.1")
+	assert.NoError(t, err)
+	assert.Equal(t, dialectV2{}, d)
+
+	_, err = dialectForVersion("3.0.0")
+	assert.Error(t, err)
+
+	_, err = dialectForVersion("")
+	assert.Error(t, err)
+}
+
+func TestVersionReadOnce(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "calls")
+	installFakeOp(t, "#!/bin/sh\necho \"$*\" >> "+log+"\necho 2.7.1\n")
+
+	// The version check and the dialect of every config share one run of op --version
+	version, err := GetVersion(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "2.7.1", *version)
+	for _, config := range []*Config{New("OP_SESSION_a", "a"), New("OP_SESSION_b", "b")} {
+		d, err := config.getDialect(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, dialectV2{}, d)
+	}
+	calls, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	assert.Equal(t, "--version\n", string(calls))
+}
+
+func TestDialectArgs(t *testing.T) {
+	assert.Equal(t, []string{"get", "item", "AWS alias"}, dialectV1{}.getItemArgs("AWS alias"))
+	assert.Equal(t, []string{"get", "totp", "AWS alias"}, dialectV1{}.getTotpArgs("AWS alias"))
+	assert.Equal(t, []string{"item", "get", "AWS alias", "--format", "json"}, dialectV2{}.getItemArgs("AWS alias"))
+	assert.Equal(t, []string{"item", "get", "AWS alias", "--otp"}, dialectV2{}.getTotpArgs("AWS alias"))
+}
+
+func TestUnmarshalItem(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		dialect dialect
+	}{
+		{name: "v1", dialect: dialectV1{}},
+		{name: "v2", dialect: dialectV2{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			item, err := tc.dialect.unmarshalItem(readFixture(t, filepath.Join(tc.name, "item.json")))
+			require.NoError(t, err)
+
+			assert.Equal(t, "4d2sfuhd5vhxzcc2ck7vxd3mfe", item.Uuid)
+			assert.Equal(t, "w3ezfgzxsz6ohbeo7ddh4irq4a", item.VaultUuid)
+			assert.Equal(t, 3, item.ItemVersion)
+			assert.Equal(t, "AWS alias-example", item.Overview.Title)
+			assert.Equal(t, []string{"aws"}, item.Overview.Tags)
+			assert.Equal(t, "https://alias-example.signin.aws.amazon.com/console", item.Overview.Url)
+			assert.Equal(t, "Example AWS account", item.Details.NotesPlain)
+
+			require.Len(t, item.Details.Fields, 2)
+			assert.Equal(t, "username", item.Details.Fields[0].Designation)
+			assert.Equal(t, "first.last", item.Details.Fields[0].Value)
+
+			require.Len(t, item.Details.Sections, 2)
+			assert.Equal(t, "ACCOUNT_INFO", item.Details.Sections[0].Title)
+			assert.Equal(t, []SectionField{{
+				K: "string",
+				N: "Field_6ymnn3ss2vhkhdnkxrkpxb4fhy",
+				T: "ACCOUNT_ALIAS",
+				V: "alias-example",
+			}}, item.Details.Sections[0].Fields)
+			require.Len(t, item.Details.Sections[1].Fields, 1)
+			assert.Equal(t, "concealed", item.Details.Sections[1].Fields[0].K)
+			assert.Equal(t, "one-time password", item.Details.Sections[1].Fields[0].T)
+		})
+	}
+}
+
+func TestUnmarshalItems(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		dialect dialect
+	}{
+		{name: "v1", dialect: dialectV1{}},
+		{name: "v2", dialect: dialectV2{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			items, err := tc.dialect.unmarshalItems(readFixture(t, filepath.Join(tc.name, "items.json")))
+			require.NoError(t, err)
+			require.Len(t, items, 2)
+			assert.Equal(t, "AWS alias-example", items[0].Overview.Title)
+			assert.Equal(t, "AWS alias-example2", items[1].Overview.Title)
+			assert.Equal(t, "kq3wxnqfgrgrjc6dfw6xqsnuvm", items[1].Uuid)
+			assert.Equal(t, "w3ezfgzxsz6ohbeo7ddh4irq4a", items[1].VaultUuid)
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package op
+
+import (
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// The kinds of op failures callers can check for with errors.Is
+var (
+	ErrNotSignedIn     = errors.New("Not signed in to 1Password")
+	ErrAmbiguousItem   = errors.New("More than one 1Password item matches")
+	ErrItemNotFound    = errors.New("The 1Password item was not found")
+	ErrAccountNotFound = errors.New("The 1Password account was not found")
+	ErrWrongPassword   = errors.New("The 1Password password was not accepted")
+)
+
+// CommandError is returned when op exits with an error and holds what it printed to stderr
+type CommandError struct {
+	Stderr string
+	Err    error
+
+	kind error
+}
+
+// errorPrefix matches the "[ERROR] 2021/01/02 15:04:05 " op puts before its messages
+var errorPrefix = regexp.MustCompile(`^\[ERROR\]\s+(\d{4}/\d{2}/\d{2}\s+\d{2}:\d{2}:\d{2}\s+)?`)
+
+func (e *CommandError) Error() string {
+	message := errorPrefix.ReplaceAllString(strings.TrimSpace(e.Stderr), "")
+	if len(message) == 0 {
+		return e.Err.Error()
+	}
+	return message
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether op failed in the way described by one of the Err values
+func (e *CommandError) Is(target error) bool {
+	return e.kind != nil && e.kind == target
+}
+
+// classifyStderr returns the kind of failure op described, or nil when it isn't recognized
+func classifyStderr(stderr string) error {
+	message := strings.ToLower(stderr)
+	contains := func(parts ...string) bool {
+		for _, part := range parts {
+			if strings.Contains(message, part) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case contains("more than one item matches", "more than one item named"):
+		return ErrAmbiguousItem
+	case contains("not currently signed in", "not signed in", "session expired", "invalid session token", "authentication required"):
+		return ErrNotSignedIn
+	case contains("account not found", "no account found", "isn't an account", "no accounts configured"):
+		return ErrAccountNotFound
+	case contains("isn't an item", "item not found", "no item found") || (contains("item") && contains("not found")):
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+// output runs the command and returns its output, turning a failed op into a CommandError
+func output(command *exec.Cmd) ([]byte, error) {
+	out, err := command.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		stderr := string(exitErr.Stderr)
+		return out, &CommandError{Stderr: stderr, Err: err, kind: classifyStderr(stderr)}
+	}
+	return out, err
+}
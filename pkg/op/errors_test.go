@@ -0,0 +1,71 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpErrorsScript answers like op 2.x, failing each command the way a real op does
+const fakeOpErrorsScript = `#!/bin/sh
+case "$1 $2" in
+  "--version ") echo "2.7.1" ;;
+  "account get") echo "[ERROR] 2022/10/01 12:00:00 You are not currently signed in. Please run op signin --help for instructions" >&2; exit 1 ;;
+  "item get")
+    case "$3" in
+      "AWS twin") echo "[ERROR] 2022/10/01 12:00:00 More than one item matches \"AWS twin\". Try again and specify the item by its ID" >&2 ;;
+      *) echo "[ERROR] 2022/10/01 12:00:00 \"$3\" isn't an item. Specify the item with its UUID, name, or domain." >&2 ;;
+    esac
+    exit 1
+    ;;
+  "vault list") echo "[ERROR] 2022/10/01 12:00:00 something unexpected" >&2; exit 1 ;;
+  *) exit 1 ;;
+esac
+`
+
+func TestCommandErrors(t *testing.T) {
+	installFakeOp(t, fakeOpErrorsScript)
+	config := New("OP_SESSION_dds", "token")
+
+	_, err := config.GetAccount(context.Background())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrNotSignedIn))
+	assert.Equal(t, "You are not currently signed in. Please run op signin --help for instructions", err.Error())
+
+	_, err = config.GetItem(context.Background(), "AWS twin")
+	assert.True(t, errors.Is(err, ErrAmbiguousItem))
+	assert.False(t, errors.Is(err, ErrItemNotFound))
+
+	_, err = config.GetItem(context.Background(), "AWS missing")
+	assert.True(t, errors.Is(err, ErrItemNotFound))
+	var commandErr *CommandError
+	require.True(t, errors.As(err, &commandErr))
+	assert.Contains(t, commandErr.Stderr, "[ERROR]")
+
+	_, err = config.ListVaults(context.Background())
+	require.Error(t, err)
+	for _, kind := range []error{ErrNotSignedIn, ErrAmbiguousItem, ErrItemNotFound, ErrAccountNotFound} {
+		assert.False(t, errors.Is(err, kind))
+	}
+	assert.Equal(t, "something unexpected", err.Error())
+}
+
+func TestClassifyStderr(t *testing.T) {
+	cases := map[string]error{
+		"[ERROR] 2020/01/01 12:00:00 You are not currently signed in":                  ErrNotSignedIn,
+		"[ERROR] 2020/01/01 12:00:00 session expired, sign in to create a new session": ErrNotSignedIn,
+		"[ERROR] 2020/01/01 12:00:00 Invalid session token":                            ErrNotSignedIn,
+		"[ERROR] 2020/01/01 12:00:00 More than one item matches \"AWS\"":               ErrAmbiguousItem,
+		"[ERROR] 2020/01/01 12:00:00 Item AWS beta not found":                          ErrItemNotFound,
+		"[ERROR] 2022/10/01 12:00:00 \"AWS beta\" isn't an item in any vault":          ErrItemNotFound,
+		"[ERROR] 2020/01/01 12:00:00 account not found":                                ErrAccountNotFound,
+		"[ERROR] 2022/10/01 12:00:00 No account found for filter \"dds\"":              ErrAccountNotFound,
+		"[ERROR] 2022/10/01 12:00:00 connection refused":                               nil,
+	}
+	for stderr, kind := range cases {
+		assert.Equal(t, kind, classifyStderr(stderr), stderr)
+	}
+}
@@ -1,29 +1,206 @@
 package op
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 )
 
+// DefaultTimeout is how long a single op command may run before it is killed
+const DefaultTimeout = 30 * time.Second
+
+// envAllowList holds the variables op needs from the environment; everything else is withheld from it
+var envAllowList = []string{
+	"HOME",
+	"USER",
+	"LOGNAME",
+	"PATH",
+	"SHELL",
+	"TMPDIR",
+	"TERM",
+	"LANG",
+	"LC_ALL",
+	"LC_CTYPE",
+	"XDG_CONFIG_HOME",
+	"XDG_RUNTIME_DIR",
+	"DISPLAY",
+	"WAYLAND_DISPLAY",
+	"DBUS_SESSION_BUS_ADDRESS",
+	"HTTP_PROXY",
+	"HTTPS_PROXY",
+	"NO_PROXY",
+	"http_proxy",
+	"https_proxy",
+	"no_proxy",
+	"OP_CONFIG_DIR",
+	"OP_DEVICE",
+	"OP_BIOMETRIC_UNLOCK_ENABLED",
+	"SYSTEMROOT",
+	"APPDATA",
+	"LOCALAPPDATA",
+	"USERPROFILE",
+}
+
+// execPaths caches the resolved op binary by the PATH it was found in
+var execPaths = struct {
+	sync.Mutex
+	paths map[string]string
+}{paths: map[string]string{}}
+
+// GetExecPath returns the path of the op binary, only searching PATH again when it changes
 func GetExecPath() (*string, error) {
-	opLocation, err := exec.Command("/usr/bin/which", "op").Output()
+	execPaths.Lock()
+	defer execPaths.Unlock()
+
+	pathEnv := os.Getenv("PATH")
+	if opPath, ok := execPaths.paths[pathEnv]; ok {
+		return &opPath, nil
+	}
+	opPath, err := exec.LookPath("op")
 	if err != nil {
 		return nil, err
 	}
-
-	opPath := strings.TrimSpace(string(opLocation))
+	execPaths.paths[pathEnv] = opPath
 	return &opPath, nil
 }
 
-func (config *Config) Exec(args []string) (*exec.Cmd, error) {
+// childEnv returns the allow-listed variables of the environment followed by the extra variables
+func childEnv(extra []string) []string {
+	env := []string{}
+	for _, name := range envAllowList {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, fmt.Sprintf("%s=%s", name, value))
+		}
+	}
+	return append(env, extra...)
+}
+
+// newCommand returns the op command with a minimal environment that is killed when ctx is done
+func newCommand(ctx context.Context, args []string, extraEnv []string) (*exec.Cmd, error) {
 	opPath, err := GetExecPath()
 	if err != nil {
 		return nil, err
 	}
-	cmd := exec.Command(*opPath, args...)
-
-	envVars := config.GetEnvVars()
-	cmd.Env = append(os.Environ(), envVars...)
+	cmd := exec.CommandContext(ctx, *opPath, args...)
+	cmd.Env = childEnv(extraEnv)
 	return cmd, nil
 }
+
+// Exec returns the op command for the args with the session of the config in its environment
+func (config *Config) Exec(ctx context.Context, args []string) (*exec.Cmd, error) {
+	if len(config.Account) > 0 {
+		args = append(args, "--account", config.Account)
+	}
+	config.mu.Lock()
+	env := config.GetEnvVars()
+	config.mu.Unlock()
+	return newCommand(ctx, args, env)
+}
+
+// timeout returns how long each op command of the config may run
+func (config *Config) timeout() time.Duration {
+	if config.Timeout > 0 {
+		return config.Timeout
+	}
+	return DefaultTimeout
+}
+
+// run runs op with the args and returns its output, killing it once the timeout of the config passes
+func (config *Config) run(ctx context.Context, args []string) ([]byte, error) {
+	return config.runInput(ctx, args, nil)
+}
+
+// runInput runs op like run with the input on its stdin
+func (config *Config) runInput(ctx context.Context, args []string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.timeout())
+	defer cancel()
+
+	cmd, errExec := config.Exec(ctx, args)
+	if errExec != nil {
+		return nil, errExec
+	}
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	out, errOutput := output(cmd)
+	if errOutput == nil {
+		config.touch()
+	}
+	return out, contextError(ctx, args, errOutput)
+}
+
+// contextError explains a command that failed because it was cancelled or ran out of time
+func contextError(ctx context.Context, args []string, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	name := strings.Join(args, " ")
+	if len(args) > 2 {
+		name = strings.Join(args[:2], " ")
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("op %s did not finish in time: %w", name, ctx.Err())
+	}
+	return fmt.Errorf("op %s was cancelled: %w", name, ctx.Err())
+}
+
+// versions caches the output of `op --version` by the path of op, so the version check and the dialect of
+// every config share a single run of it
+var versions = struct {
+	sync.Mutex
+	byPath map[string]string
+}{byPath: map[string]string{}}
+
+// GetVersion returns the version reported by `op --version`, which is only run once for each op binary
+func GetVersion(ctx context.Context) (*string, error) {
+	opPath, err := GetExecPath()
+	if err != nil {
+		return nil, err
+	}
+	versions.Lock()
+	defer versions.Unlock()
+	if version, ok := versions.byPath[*opPath]; ok {
+		return &version, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultTimeout)
+	defer cancel()
+	cmd, err := newCommand(ctx, []string{"--version"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	out, err := output(cmd)
+	if err != nil {
+		return nil, contextError(ctx, []string{"--version"}, err)
+	}
+	version := strings.TrimSpace(string(out))
+	versions.byPath[*opPath] = version
+	return &version, nil
+}
+
+// getDialect detects the op version on first use and returns the matching dialect
+func (config *Config) getDialect(ctx context.Context) (dialect, error) {
+	config.mu.Lock()
+	d := config.dialect
+	config.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+	version, err := GetVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d, err = dialectForVersion(*version)
+	if err != nil {
+		return nil, err
+	}
+	config.mu.Lock()
+	config.dialect = d
+	config.mu.Unlock()
+	return d, nil
+}
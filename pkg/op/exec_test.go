@@ -0,0 +1,73 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpExecScript answers like op 2.x, printing its environment for account details and hanging on vault lists
+const fakeOpExecScript = `#!/bin/sh
+case "$1 $2" in
+  "--version ") echo "2.7.1" ;;
+  "account get") env ;;
+  "vault list") exec sleep 10 ;;
+  *) exit 1 ;;
+esac
+`
+
+func TestExecEnvironment(t *testing.T) {
+	installFakeOp(t, fakeOpExecScript)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("OP_SESSION_other", "other-token")
+	t.Setenv("LANG", "en_US.UTF-8")
+
+	out, err := New("OP_SESSION_dds", "token").GetAccount(context.Background())
+	require.NoError(t, err)
+	assert.Contains(t, *out, "OP_SESSION_dds=token\n")
+	assert.Contains(t, *out, "LANG=en_US.UTF-8\n")
+	assert.NotContains(t, *out, "AWS_SECRET_ACCESS_KEY")
+	assert.NotContains(t, *out, "OP_SESSION_other")
+}
+
+func TestExecTimeout(t *testing.T) {
+	installFakeOp(t, fakeOpExecScript)
+	config := New("OP_SESSION_dds", "token")
+	config.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := config.ListVaults(context.Background())
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Contains(t, err.Error(), "op vault list did not finish in time")
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	config.Timeout = 0
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	_, err = config.ListVaults(ctx)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestGetExecPathCache(t *testing.T) {
+	installFakeOp(t, fakeOpExecScript)
+	first, err := GetExecPath()
+	require.NoError(t, err)
+	second, err := GetExecPath()
+	require.NoError(t, err)
+	assert.Equal(t, *first, *second)
+
+	// A new PATH is searched again
+	installFakeOp(t, fakeOpExecScript)
+	third, err := GetExecPath()
+	require.NoError(t, err)
+	assert.NotEqual(t, *first, *third)
+}
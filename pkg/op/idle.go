@@ -0,0 +1,85 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout is how long 1Password keeps a session alive without any activity
+const DefaultIdleTimeout = 30 * time.Minute
+
+// lastUsedSaveInterval limits how often LastUsed is written back to the session store
+const lastUsedSaveInterval = time.Minute
+
+// signinMu makes commands that find the session expired at the same time sign in once
+var signinMu sync.Mutex
+
+// noSigninKey marks a context whose commands shouldn't sign in again
+type noSigninKey struct{}
+
+// WithoutSignin returns a context whose commands fail instead of asking for the password again when the
+// session has expired, for commands running in the background
+func WithoutSignin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noSigninKey{}, true)
+}
+
+// SessionTrusted reports whether the session was used recently enough that checking it with op can be skipped
+func (config *Config) SessionTrusted() bool {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	if config.IsServiceAccount() || len(config.SessionToken) == 0 || config.IdleTimeout <= 0 || config.LastUsed.IsZero() {
+		return false
+	}
+	idle := time.Since(config.LastUsed)
+	return idle >= 0 && idle < config.IdleTimeout
+}
+
+// touch records that the session just completed an op command and saves the time when the session
+// came from the store, at most once every lastUsedSaveInterval
+func (config *Config) touch() {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	if config.IsServiceAccount() || len(config.SessionToken) == 0 {
+		return
+	}
+	now := time.Now()
+	saved := config.LastUsed
+	config.LastUsed = now
+	if len(config.storeKey) == 0 || config.SessionToken != config.storedToken || now.Sub(saved) < lastUsedSaveInterval {
+		return
+	}
+	// The time only saves a check on the next run so failing to save it isn't an error
+	_ = config.sessionStore().Save(config.storeKey, config)
+}
+
+// runSignedIn runs op like run, signing in again and retrying once when a trusted session turns out to have expired
+func (config *Config) runSignedIn(ctx context.Context, args []string) ([]byte, error) {
+	return config.runSignedInInput(ctx, args, nil)
+}
+
+// runSignedInInput runs op like runSignedIn with the input on its stdin
+func (config *Config) runSignedInInput(ctx context.Context, args []string, input []byte) ([]byte, error) {
+	config.mu.Lock()
+	token, storeKey := config.SessionToken, config.storeKey
+	config.mu.Unlock()
+
+	out, err := config.runInput(ctx, args, input)
+	if !errors.Is(err, ErrNotSignedIn) || config.IsServiceAccount() || len(storeKey) == 0 || ctx.Value(noSigninKey{}) != nil {
+		return out, err
+	}
+
+	signinMu.Lock()
+	defer signinMu.Unlock()
+	config.mu.Lock()
+	signedIn := config.SessionToken != token
+	config.mu.Unlock()
+	if !signedIn {
+		errSignin := config.Signin(ctx, storeKey)
+		if errSignin != nil {
+			return nil, errSignin
+		}
+	}
+	return config.runInput(ctx, args, input)
+}
@@ -0,0 +1,145 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpIdleScript answers like op 2.x, logging each command and only accepting the "new-token" session
+const fakeOpIdleScript = `#!/bin/sh
+echo "$1 $2" >> %s
+case "$1 $2" in
+  "--version ") echo "2.7.1" ;;
+  "account list") echo '[{"url":"dds.1password.com","email":"user@example.com","user_uuid":"USERUUID","shorthand":"dds"}]' ;;
+  "signin --account") read -r password; echo "new-token" ;;
+  "account get"|"item list")
+    if [ "$OP_SESSION_USERUUID" != "new-token" ]; then
+      echo "[ERROR] 2022/10/01 12:00:00 You are not currently signed in" >&2
+      exit 1
+    fi
+    if [ "$1" = "item" ]; then echo '[]'; else echo '{"id":"ACCOUNTID"}'; fi
+    ;;
+  *) exit 1 ;;
+esac
+`
+
+// installIdleOp installs fakeOpIdleScript and returns a func listing the commands it has run
+func installIdleOp(t *testing.T) func() []string {
+	logFilename := filepath.Join(t.TempDir(), "op.log")
+	installFakeOp(t, fmt.Sprintf(fakeOpIdleScript, logFilename))
+	return func() []string {
+		data, _ := ioutil.ReadFile(filepath.Clean(logFilename))
+		commands := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line = strings.TrimSpace(line); len(line) > 0 {
+				commands = append(commands, line)
+			}
+		}
+		return commands
+	}
+}
+
+func TestSessionTrusted(t *testing.T) {
+	config := New("OP_SESSION_USERUUID", "token")
+	config.IdleTimeout = DefaultIdleTimeout
+	assert.False(t, config.SessionTrusted(), "a session never used should be checked")
+
+	config.LastUsed = time.Now().Add(-10 * time.Minute)
+	assert.True(t, config.SessionTrusted())
+
+	config.LastUsed = time.Now().Add(-45 * time.Minute)
+	assert.False(t, config.SessionTrusted(), "an idle session may have expired")
+
+	config.LastUsed = time.Now()
+	config.IdleTimeout = 0
+	assert.False(t, config.SessionTrusted(), "a zero idle timeout always checks")
+
+	assert.False(t, NewServiceAccount("token").SessionTrusted())
+}
+
+func TestConfigsLockIndependently(t *testing.T) {
+	busy := &Config{SessionToken: "token", IdleTimeout: time.Minute, LastUsed: time.Now()}
+	other := &Config{SessionToken: "token", IdleTimeout: time.Minute, LastUsed: time.Now()}
+	busy.mu.Lock()
+	defer busy.mu.Unlock()
+
+	// A config in use by one account doesn't hold up the others
+	trusted := make(chan bool, 1)
+	go func() { trusted <- other.SessionTrusted() }()
+	select {
+	case ok := <-trusted:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("the config waited for the lock of another config")
+	}
+}
+
+func TestEnsureSessionTrustsRecentSession(t *testing.T) {
+	commands := installIdleOp(t)
+	filename := filepath.Join(t.TempDir(), ".op_session")
+	require.NoError(t, WriteConfig(filename, &Config{
+		SessionName:  "OP_SESSION_USERUUID",
+		SessionToken: "new-token",
+		LastUsed:     time.Now().Add(-5 * time.Minute),
+	}))
+
+	config, err := LoadSession(FileStore{}, filename)
+	require.NoError(t, err)
+	config.IdleTimeout = DefaultIdleTimeout
+	source, err := EnsureSession(context.Background(), config, filename)
+	require.NoError(t, err)
+	assert.Equal(t, SessionSourceStore, source)
+	assert.Empty(t, commands(), "op should not be run to check a recent session")
+
+	// Using the session saves when it was last used
+	_, err = config.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	saved, err := LoadConfig(filename)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), saved.LastUsed, time.Minute)
+}
+
+func TestExpiredTrustedSessionSignsInLazily(t *testing.T) {
+	commands := installIdleOp(t)
+	filename := filepath.Join(t.TempDir(), ".op_session")
+	require.NoError(t, WriteConfig(filename, &Config{
+		SessionName:  "OP_SESSION_USERUUID",
+		SessionToken: "expired-token",
+		LastUsed:     time.Now().Add(-time.Minute),
+	}))
+
+	config, err := LoadSession(FileStore{}, filename)
+	require.NoError(t, err)
+	config.IdleTimeout = DefaultIdleTimeout
+	config.Password = passwords("correct")
+	_, err = EnsureSession(context.Background(), config, filename)
+	require.NoError(t, err)
+
+	// The expired session is only noticed by the first real command, which signs in and runs again
+	_, err = config.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	assert.Equal(t, "new-token", config.SessionToken)
+	assert.Equal(t, []string{"--version", "item list", "account list", "signin --account", "item list"}, commands())
+}
+
+func TestWithoutSigninDoesNotPrompt(t *testing.T) {
+	commands := installIdleOp(t)
+	filename := filepath.Join(t.TempDir(), ".op_session")
+	require.NoError(t, WriteConfig(filename, New("OP_SESSION_USERUUID", "expired-token")))
+
+	config, err := LoadSession(FileStore{}, filename)
+	require.NoError(t, err)
+	config.Password = passwords("correct")
+	_, err = config.ListItems(WithoutSignin(context.Background()), "aws")
+	assert.True(t, errors.Is(err, ErrNotSignedIn))
+	assert.NotContains(t, commands(), "signin --account")
+}
@@ -0,0 +1,255 @@
+package op
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/99designs/keyring"
+)
+
+// KeyringTag marks the items kept by the 1Password keyring, so the other items of its vault are never touched
+const KeyringTag = "aws-vault"
+
+// The fields of a keyring item, where the data is base64 encoded because it can be any bytes
+const (
+	keyringSection     = "keyring"
+	keyringData        = "keyring_data"
+	keyringLabel       = "keyring_label"
+	keyringDescription = "keyring_description"
+)
+
+// ErrKeyringNeedsV2 is returned when the op command is too old to create items from a template on stdin
+var ErrKeyringNeedsV2 = errors.New("The 1Password keyring needs op 2 or later")
+
+// Keyring keeps the aws-vault credentials and sessions as Secure Note items of a dedicated 1Password vault, titled
+// by their keyring key and tagged with KeyringTag. It signs in with the session of the config like every other
+// command, so the IAM keys are unlocked along with the MFA seeds.
+type Keyring struct {
+	Config *Config
+	// Vault is the name or UUID of the vault holding the items
+	Vault string
+
+	mu sync.Mutex
+	// listed is the last listing of the items, reused until the keyring changes them since aws-vault looks up
+	// every session key with a call to Keys
+	listed []Item
+}
+
+var _ keyring.Keyring = (*Keyring)(nil)
+
+// NewKeyring returns the keyring keeping its items in the vault
+func NewKeyring(config *Config, vault string) *Keyring {
+	return &Keyring{Config: config, Vault: vault}
+}
+
+// keyringTemplate is the op 2.x item template piped to `op item create`
+type keyringTemplate struct {
+	Title    string          `json:"title"`
+	Category string          `json:"category"`
+	Tags     []string        `json:"tags"`
+	Sections []sectionV2     `json:"sections"`
+	Fields   []templateField `json:"fields"`
+}
+
+// templateField is a field of the template, which leaves out the members op only prints
+type templateField struct {
+	ID      string     `json:"id"`
+	Section *sectionV2 `json:"section"`
+	Type    string     `json:"type"`
+	Label   string     `json:"label"`
+	Value   string     `json:"value"`
+}
+
+// Get returns the item with the key or keyring.ErrKeyNotFound
+func (kr *Keyring) Get(key string) (keyring.Item, error) {
+	ctx := context.Background()
+	found, errFind := kr.find(ctx, key)
+	if errFind != nil {
+		return keyring.Item{}, errFind
+	}
+	out, errGet := kr.Config.runSignedIn(ctx, withVault([]string{"item", "get", found[0].Uuid, "--format", "json"}, kr.Vault))
+	if errors.Is(errGet, ErrItemNotFound) {
+		return keyring.Item{}, keyring.ErrKeyNotFound
+	}
+	if errGet != nil {
+		return keyring.Item{}, errGet
+	}
+	item, errUnmarshal := dialectV2{}.unmarshalItem(out)
+	if errUnmarshal != nil {
+		return keyring.Item{}, errUnmarshal
+	}
+
+	result := keyring.Item{Key: key}
+	hasData := false
+	for _, section := range item.Details.Sections {
+		for _, field := range section.Fields {
+			switch field.T {
+			case keyringData:
+				data, errDecode := base64.StdEncoding.DecodeString(field.V)
+				if errDecode != nil {
+					return keyring.Item{}, fmt.Errorf("Unable to read the 1Password keyring item %q: %w", key, errDecode)
+				}
+				result.Data = data
+				hasData = true
+			case keyringLabel:
+				result.Label = field.V
+			case keyringDescription:
+				result.Description = field.V
+			}
+		}
+	}
+	if !hasData {
+		return keyring.Item{}, fmt.Errorf("The 1Password keyring item %q has no %s field", key, keyringData)
+	}
+	return result, nil
+}
+
+// GetMetadata returns when the item with the key was last changed, without reading its data
+func (kr *Keyring) GetMetadata(key string) (keyring.Metadata, error) {
+	found, errFind := kr.find(context.Background(), key)
+	if errFind != nil {
+		return keyring.Metadata{}, errFind
+	}
+	return keyring.Metadata{
+		Item:             &keyring.Item{Key: key},
+		ModificationTime: found[0].UpdatedAt,
+	}, nil
+}
+
+// Set stores the item, replacing any item with its key only once the new one has been created
+func (kr *Keyring) Set(item keyring.Item) error {
+	ctx := context.Background()
+	existing, errFind := kr.find(ctx, item.Key)
+	if errFind != nil && !errors.Is(errFind, keyring.ErrKeyNotFound) {
+		return errFind
+	}
+
+	section := sectionV2{ID: keyringSection, Label: KeyringTag}
+	template := keyringTemplate{
+		Title:    item.Key,
+		Category: "SECURE_NOTE",
+		Tags:     []string{KeyringTag},
+		Sections: []sectionV2{section},
+		Fields: []templateField{
+			{ID: keyringData, Section: &section, Type: "CONCEALED", Label: keyringData, Value: base64.StdEncoding.EncodeToString(item.Data)},
+			{ID: keyringLabel, Section: &section, Type: "STRING", Label: keyringLabel, Value: item.Label},
+			{ID: keyringDescription, Section: &section, Type: "STRING", Label: keyringDescription, Value: item.Description},
+		},
+	}
+	encoded, errMarshal := json.Marshal(template)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	// The template is piped so the credentials never show up in the arguments of op
+	_, errCreate := kr.Config.runSignedInInput(ctx, withVault([]string{"item", "create", "--format", "json", "-"}, kr.Vault), encoded)
+	if errCreate != nil {
+		return fmt.Errorf("Unable to save %q in the 1Password keyring: %w", item.Key, errCreate)
+	}
+	kr.forget()
+	return kr.remove(ctx, existing)
+}
+
+// Remove deletes every item with the key
+func (kr *Keyring) Remove(key string) error {
+	ctx := context.Background()
+	found, errFind := kr.find(ctx, key)
+	if errFind != nil {
+		return errFind
+	}
+	return kr.remove(ctx, found)
+}
+
+// Keys returns the keys of every item of the keyring
+func (kr *Keyring) Keys() ([]string, error) {
+	items, errList := kr.list(context.Background())
+	if errList != nil {
+		return nil, errList
+	}
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, item := range items {
+		if !seen[item.Overview.Title] {
+			seen[item.Overview.Title] = true
+			keys = append(keys, item.Overview.Title)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// list returns the items of the vault tagged as keyring items, listing them once until they are changed.
+// Concurrent calls wait for the same listing.
+func (kr *Keyring) list(ctx context.Context) ([]Item, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.listed != nil {
+		return kr.listed, nil
+	}
+
+	d, errDialect := kr.Config.getDialect(ctx)
+	if errDialect != nil {
+		return nil, errDialect
+	}
+	if _, ok := d.(dialectV2); !ok {
+		return nil, ErrKeyringNeedsV2
+	}
+	if len(kr.Vault) == 0 {
+		return nil, errors.New("The 1Password keyring needs a vault to keep its items in")
+	}
+	out, errList := kr.Config.runSignedIn(ctx, withVault([]string{"item", "list", "--categories", "Secure Note", "--tags", KeyringTag, "--format", "json"}, kr.Vault))
+	if errList != nil {
+		return nil, errList
+	}
+	items, errUnmarshal := dialectV2{}.unmarshalItems(out)
+	if errUnmarshal != nil {
+		return nil, errUnmarshal
+	}
+	kr.listed = items
+	return items, nil
+}
+
+// find returns the items with the key, the most recently changed first, or keyring.ErrKeyNotFound
+func (kr *Keyring) find(ctx context.Context, key string) ([]Item, error) {
+	items, errList := kr.list(ctx)
+	if errList != nil {
+		return nil, errList
+	}
+	found := []Item{}
+	for _, item := range items {
+		if item.Overview.Title == key {
+			found = append(found, item)
+		}
+	}
+	if len(found) == 0 {
+		return nil, keyring.ErrKeyNotFound
+	}
+	// A Set interrupted before removing the item it replaced leaves both
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].UpdatedAt.After(found[j].UpdatedAt)
+	})
+	return found, nil
+}
+
+// forget drops the listing so the next call lists the items again
+func (kr *Keyring) forget() {
+	kr.mu.Lock()
+	kr.listed = nil
+	kr.mu.Unlock()
+}
+
+// remove deletes the items by UUID
+func (kr *Keyring) remove(ctx context.Context, items []Item) error {
+	defer kr.forget()
+	for _, item := range items {
+		_, errDelete := kr.Config.runSignedIn(ctx, withVault([]string{"item", "delete", item.Uuid}, kr.Vault))
+		if errDelete != nil && !errors.Is(errDelete, ErrItemNotFound) {
+			return fmt.Errorf("Unable to remove %q from the 1Password keyring: %w", item.Overview.Title, errDelete)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Package optest provides an in-memory op.Client for testing code that talks to 1Password.
+package optest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// Method names used to script errors and record calls
+const (
+	MethodListItems  = "ListItems"
+	MethodGetItem    = "GetItem"
+	MethodGetTotp    = "GetTotp"
+	MethodGetAccount = "GetAccount"
+	MethodSignin     = "Signin"
+)
+
+// ErrNotSignedIn is returned by GetAccount when the fake has no active session
+var ErrNotSignedIn = op.ErrNotSignedIn
+
+// Call records a single call made against the fake client
+type Call struct {
+	Method string
+	Args   []string
+}
+
+// Client is a scriptable in-memory implementation of op.Client
+type Client struct {
+	// Items are returned by GetItem, searched by title or UUID, and by ListItems without their details
+	// the way op lists them
+	Items []op.Item
+	// Totps holds the one-time password returned by GetTotp keyed by item title or UUID
+	Totps map[string]string
+	// Account is the output returned by GetAccount
+	Account string
+	// SignedIn controls whether GetAccount succeeds; Signin sets it to true
+	SignedIn bool
+	// Errors forces the named method to fail with the given error
+	Errors map[string]error
+	// Calls records every call made in order
+	Calls []Call
+
+	mu sync.Mutex
+}
+
+var _ op.Client = (*Client)(nil)
+
+// New returns a signed in fake client holding the given items
+func New(items ...op.Item) *Client {
+	return &Client{
+		Items:    items,
+		Totps:    map[string]string{},
+		SignedIn: true,
+		Errors:   map[string]error{},
+	}
+}
+
+// NewItem returns a login item tagged "aws" with the account alias stored in the given section and field
+func NewItem(uuid, title, sectionName, fieldTitle, accountAlias string) op.Item {
+	return op.Item{
+		Uuid: uuid,
+		Overview: op.Overview{
+			Title: title,
+			Tags:  []string{"aws"},
+		},
+		Details: op.Details{
+			Sections: []op.Section{
+				{
+					Title: sectionName,
+					Fields: []op.SectionField{
+						{K: "string", T: fieldTitle, V: accountAlias},
+					},
+				},
+			},
+		},
+	}
+}
+
+// CallCount returns how many times the named method was called
+func (c *Client) CallCount(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	for _, call := range c.Calls {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *Client) record(method string, args ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Calls = append(c.Calls, Call{Method: method, Args: args})
+	return c.Errors[method]
+}
+
+func (c *Client) findItem(name string) (*op.Item, error) {
+	for _, item := range c.Items {
+		if item.Uuid == name || item.Overview.Title == name {
+			found := item
+			return &found, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q isn't an item in any vault", op.ErrItemNotFound, name)
+}
+
+func (c *Client) ListItems(ctx context.Context, tags string) ([]op.Item, error) {
+	if err := c.record(MethodListItems, tags); err != nil {
+		return nil, err
+	}
+	items := []op.Item{}
+	for _, item := range c.Items {
+		for _, tag := range item.Overview.Tags {
+			if tag == tags {
+				item.Details = op.Details{}
+				items = append(items, item)
+				break
+			}
+		}
+	}
+	return items, nil
+}
+
+func (c *Client) GetItem(ctx context.Context, name string) (*op.Item, error) {
+	if err := c.record(MethodGetItem, name); err != nil {
+		return nil, err
+	}
+	return c.findItem(name)
+}
+
+func (c *Client) GetTotp(ctx context.Context, name string) (*string, error) {
+	if err := c.record(MethodGetTotp, name); err != nil {
+		return nil, err
+	}
+	totp, ok := c.Totps[name]
+	if item, errFind := c.findItem(name); !ok && errFind == nil {
+		totp, ok = c.Totps[item.Overview.Title]
+		if !ok {
+			totp, ok = c.Totps[item.Uuid]
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%q has no one-time password", name)
+	}
+	totp += "\n"
+	return &totp, nil
+}
+
+func (c *Client) GetAccount(ctx context.Context) (*string, error) {
+	if err := c.record(MethodGetAccount); err != nil {
+		return nil, err
+	}
+	if !c.SignedIn {
+		return nil, ErrNotSignedIn
+	}
+	account := c.Account
+	return &account, nil
+}
+
+func (c *Client) Signin(ctx context.Context, sessionFilename string) error {
+	if err := c.record(MethodSignin, sessionFilename); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SignedIn = true
+	return nil
+}
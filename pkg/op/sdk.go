@@ -1,6 +1,9 @@
 package op
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Item struct {
 	Uuid         string    `json:"uuid,omitempty"`
@@ -11,8 +14,16 @@ type Item struct {
 	ChangerUuid  string    `json:"changeUuid,omitempty"`
 	ItemVersion  int       `json:"itemVersion,omitempty"`
 	VaultUuid    string    `json:"vaultUuid,omitempty"`
+	VaultName    string    `json:"vaultName,omitempty"`
 	Details      Details   `json:"details,omitempty"`
 	Overview     Overview  `json:"overview,omitempty"`
+	// Account is the shorthand of the 1Password account the item was listed from
+	Account string `json:"account,omitempty"`
+}
+
+type Vault struct {
+	Uuid string `json:"uuid,omitempty"`
+	Name string `json:"name,omitempty"`
 }
 
 type Details struct {
@@ -57,3 +68,15 @@ type URL struct {
 	L string `json:"l,omitempty"`
 	U string `json:"u,omitempty"`
 }
+
+// OTPSecret returns the one-time password secret stored in the item sections
+func (item *Item) OTPSecret() (string, bool) {
+	for _, section := range item.Details.Sections {
+		for _, field := range section.Fields {
+			if strings.HasPrefix(field.N, "TOTP_") || strings.HasPrefix(field.V, "otpauth://") {
+				return field.V, true
+			}
+		}
+	}
+	return "", false
+}
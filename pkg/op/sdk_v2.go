@@ -0,0 +1,132 @@
+package op
+
+import (
+	"strings"
+	"time"
+)
+
+// itemV2 is the item JSON returned by op 2.x
+type itemV2 struct {
+	ID                    string      `json:"id"`
+	Title                 string      `json:"title"`
+	Version               int         `json:"version"`
+	Vault                 vaultV2     `json:"vault"`
+	Category              string      `json:"category"`
+	LastEditedBy          string      `json:"last_edited_by"`
+	CreatedAt             time.Time   `json:"created_at"`
+	UpdatedAt             time.Time   `json:"updated_at"`
+	AdditionalInformation string      `json:"additional_information"`
+	Tags                  []string    `json:"tags"`
+	Sections              []sectionV2 `json:"sections"`
+	Fields                []fieldV2   `json:"fields"`
+	URLs                  []urlV2     `json:"urls"`
+}
+
+type vaultV2 struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type sectionV2 struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+type fieldV2 struct {
+	ID      string     `json:"id"`
+	Section *sectionV2 `json:"section"`
+	Type    string     `json:"type"`
+	Purpose string     `json:"purpose"`
+	Label   string     `json:"label"`
+	Value   string     `json:"value"`
+	Totp    string     `json:"totp"`
+}
+
+type urlV2 struct {
+	Label   string `json:"label"`
+	Primary bool   `json:"primary"`
+	Href    string `json:"href"`
+}
+
+// fieldKindsV2 maps the op 2.x field types to the op 1.x section field kinds
+var fieldKindsV2 = map[string]string{
+	"STRING":     "string",
+	"CONCEALED":  "concealed",
+	"OTP":        "concealed",
+	"EMAIL":      "email",
+	"URL":        "URL",
+	"DATE":       "date",
+	"MONTH_YEAR": "monthYear",
+	"PHONE":      "phone",
+	"MENU":       "menu",
+}
+
+// toItem converts the op 2.x item into the item model shared with op 1.x
+func (item itemV2) toItem() *Item {
+	converted := &Item{
+		Uuid:        item.ID,
+		CreatedAt:   item.CreatedAt,
+		UpdatedAt:   item.UpdatedAt,
+		ChangerUuid: item.LastEditedBy,
+		ItemVersion: item.Version,
+		VaultUuid:   item.Vault.ID,
+		VaultName:   item.Vault.Name,
+		Overview: Overview{
+			Ainfo: item.AdditionalInformation,
+			Tags:  item.Tags,
+			Title: item.Title,
+		},
+	}
+
+	for _, u := range item.URLs {
+		converted.Overview.URLs = append(converted.Overview.URLs, URL{L: u.Label, U: u.Href})
+		if u.Primary || len(converted.Overview.Url) == 0 {
+			converted.Overview.Url = u.Href
+		}
+	}
+
+	// Keep the sections in the order op lists them, then add any only referenced by fields
+	sectionIndex := map[string]int{}
+	addSection := func(s sectionV2) {
+		if _, ok := sectionIndex[s.ID]; ok {
+			return
+		}
+		sectionIndex[s.ID] = len(converted.Details.Sections)
+		converted.Details.Sections = append(converted.Details.Sections, Section{Name: s.ID, Title: s.Label})
+	}
+	for _, s := range item.Sections {
+		addSection(s)
+	}
+
+	for _, f := range item.Fields {
+		switch {
+		case f.Purpose == "NOTES":
+			converted.Details.NotesPlain = f.Value
+		case f.Section == nil || len(f.Purpose) > 0:
+			converted.Details.Fields = append(converted.Details.Fields, Field{
+				Designation: strings.ToLower(f.Purpose),
+				Name:        f.ID,
+				Type:        fieldKindV2(f.Type),
+				Value:       f.Value,
+			})
+		default:
+			addSection(*f.Section)
+			i := sectionIndex[f.Section.ID]
+			converted.Details.Sections[i].Fields = append(converted.Details.Sections[i].Fields, SectionField{
+				K: fieldKindV2(f.Type),
+				N: f.ID,
+				T: f.Label,
+				V: f.Value,
+			})
+		}
+	}
+
+	return converted
+}
+
+func fieldKindV2(fieldType string) string {
+	if kind, ok := fieldKindsV2[fieldType]; ok {
+		return kind
+	}
+	return strings.ToLower(fieldType)
+}
@@ -0,0 +1,86 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EnvServiceAccountToken is the env var op reads a 1Password service account token from
+const EnvServiceAccountToken = "OP_SERVICE_ACCOUNT_TOKEN"
+
+// ErrServiceAccountUnsupported is returned when the installed op can't use service accounts
+var ErrServiceAccountUnsupported = errors.New("1Password service accounts require version 2 of the op command")
+
+// NewServiceAccount returns a config that authenticates with a service account token instead of a session
+func NewServiceAccount(token string) *Config {
+	return &Config{
+		ServiceAccountToken: token,
+	}
+}
+
+// IsServiceAccount reports whether the config authenticates with a service account token
+func (config *Config) IsServiceAccount() bool {
+	return len(config.ServiceAccountToken) > 0
+}
+
+// CheckServiceAccount confirms the token is accepted and can read the given vault names or UUIDs.
+// When no vaults are given the token must be able to read at least one vault.
+func (config *Config) CheckServiceAccount(ctx context.Context, vaults []string) error {
+	_, err := config.checkServiceAccount(ctx, vaults)
+	return err
+}
+
+// checkServiceAccount returns the vaults the service account can read once they include the given vaults
+func (config *Config) checkServiceAccount(ctx context.Context, vaults []string) ([]Vault, error) {
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return nil, errDialect
+	}
+	if _, ok := d.(dialectV2); !ok {
+		return nil, ErrServiceAccountUnsupported
+	}
+
+	available, errListVaults := config.ListVaults(ctx)
+	if errListVaults != nil {
+		return nil, fmt.Errorf("The 1Password service account token was not accepted: %w", errListVaults)
+	}
+	if len(available) == 0 {
+		return nil, errors.New("The 1Password service account token does not have access to any vaults")
+	}
+
+	for _, vault := range vaults {
+		found := false
+		for _, a := range available {
+			if a.Uuid == vault || a.Name == vault {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("The 1Password service account token does not have access to the vault %q, it can read %s", vault, vaultNames(available))
+		}
+	}
+	return available, nil
+}
+
+// wrapServiceAccountError explains a failed lookup in terms of the vaults a service account can read
+func (config *Config) wrapServiceAccountError(ctx context.Context, name string, err error) error {
+	if err == nil || !config.IsServiceAccount() {
+		return err
+	}
+	available, errListVaults := config.ListVaults(ctx)
+	if errListVaults != nil {
+		return err
+	}
+	return fmt.Errorf("Unable to read %q with the 1Password service account, which can only read %s: %w", name, vaultNames(available), err)
+}
+
+func vaultNames(vaults []Vault) string {
+	names := make([]string, 0, len(vaults))
+	for _, vault := range vaults {
+		names = append(names, fmt.Sprintf("%q", vault.Name))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,76 @@
+package op
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOpScript answers like op 2.x and accepts only the "good-token" service account token
+const fakeOpScript = `#!/bin/sh
+case "$1 $2" in
+  "--version ") echo "2.18.0" ;;
+  "vault list")
+    if [ "$OP_SERVICE_ACCOUNT_TOKEN" != "good-token" ]; then
+      echo "[ERROR] invalid service account token" >&2
+      exit 1
+    fi
+    echo '[{"id":"w3ezfgzxsz6ohbeo7ddh4irq4a","name":"AWS"}]'
+    ;;
+  *) exit 1 ;;
+esac
+`
+
+func installFakeOp(t *testing.T, script string) {
+	dir := t.TempDir()
+	// #nosec G306 the fake op must be executable
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "op"), []byte(script), 0700))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCheckServiceAccount(t *testing.T) {
+	installFakeOp(t, fakeOpScript)
+
+	config := NewServiceAccount("good-token")
+	assert.True(t, config.IsServiceAccount())
+	assert.Equal(t, []string{"OP_SERVICE_ACCOUNT_TOKEN=good-token"}, config.GetEnvVars())
+	assert.NoError(t, config.CheckServiceAccount(context.Background(), nil))
+	assert.NoError(t, config.CheckServiceAccount(context.Background(), []string{"AWS", "w3ezfgzxsz6ohbeo7ddh4irq4a"}))
+
+	err := config.CheckServiceAccount(context.Background(), []string{"Private"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `does not have access to the vault "Private"`)
+
+	err = NewServiceAccount("bad-token").CheckServiceAccount(context.Background(), nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "service account token was not accepted")
+}
+
+func TestCheckSessionServiceAccount(t *testing.T) {
+	installFakeOp(t, fakeOpScript)
+	t.Setenv(EnvServiceAccountToken, "good-token")
+	sessionFilename := filepath.Join(t.TempDir(), ".op_session")
+
+	config, err := CheckSession(context.Background(), FileStore{}, sessionFilename)
+	require.NoError(t, err)
+	assert.True(t, config.IsServiceAccount())
+	_, err = os.Stat(sessionFilename)
+	assert.True(t, os.IsNotExist(err), "the session file should not be created")
+
+	// Signing in can't prompt so it reports why the token failed
+	badConfig := NewServiceAccount("bad-token")
+	_, err = EnsureSession(context.Background(), badConfig, sessionFilename)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "service account token was not accepted")
+}
+
+func TestServiceAccountRequiresV2(t *testing.T) {
+	config := NewServiceAccount("good-token")
+	config.dialect = dialectV1{}
+	assert.Equal(t, ErrServiceAccountUnsupported, config.CheckServiceAccount(context.Background(), nil))
+}
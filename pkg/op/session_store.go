@@ -0,0 +1,212 @@
+package op
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/99designs/keyring"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// EnvKeyringFilePassphrase is read before prompting for the passphrase of the encrypted file keyring
+	EnvKeyringFilePassphrase = "AWSLOGIN_KEYRING_FILE_PASSPHRASE"
+
+	keyringServiceName = "awslogin"
+	// catalogKeySuffix is added to the session key to save the item catalog of the session next to it
+	catalogKeySuffix = "_items"
+)
+
+// SessionStore saves the 1Password session between runs.
+// The key is the session file path, which the keyring store reduces to its base name.
+type SessionStore interface {
+	Load(key string) (*Config, error)
+	Save(key string, config *Config) error
+	Remove(key string) error
+	Location(key string) string
+}
+
+// FileStore keeps the session as JSON in a file only readable by the user
+type FileStore struct{}
+
+var _ SessionStore = FileStore{}
+
+func (FileStore) Load(key string) (*Config, error) {
+	return LoadConfig(key)
+}
+
+func (FileStore) Save(key string, config *Config) error {
+	return WriteConfig(key, config)
+}
+
+func (FileStore) Remove(key string) error {
+	err := os.Remove(key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (FileStore) Location(key string) string {
+	return key
+}
+
+// KeyringStore keeps the session in an OS keyring
+type KeyringStore struct {
+	Keyring keyring.Keyring
+}
+
+var (
+	_ SessionStore = (*KeyringStore)(nil)
+	_ CatalogStore = (*KeyringStore)(nil)
+)
+
+// OpenKeyringStore opens the keyring backend, e.g. "keychain", "secret-service" or "file".
+// An empty backend picks the first one available on this OS.
+func OpenKeyringStore(backend string) (*KeyringStore, error) {
+	config := keyring.Config{
+		ServiceName:              keyringServiceName,
+		FileDir:                  "~/.awslogin/keys/",
+		FilePasswordFunc:         fileKeyringPassphrasePrompt,
+		KeychainName:             "login",
+		KeychainTrustApplication: true,
+		LibSecretCollectionName:  keyringServiceName,
+		KWalletAppID:             keyringServiceName,
+		KWalletFolder:            keyringServiceName,
+		WinCredPrefix:            keyringServiceName,
+	}
+	if len(backend) > 0 {
+		config.AllowedBackends = []keyring.BackendType{keyring.BackendType(backend)}
+	}
+	kr, errOpen := keyring.Open(config)
+	if errOpen != nil {
+		return nil, fmt.Errorf("Unable to open the %q keyring: %w", backend, errOpen)
+	}
+	return &KeyringStore{Keyring: kr}, nil
+}
+
+func fileKeyringPassphrasePrompt(message string) (string, error) {
+	if passphrase := os.Getenv(EnvKeyringFilePassphrase); len(passphrase) > 0 {
+		return passphrase, nil
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", message)
+	b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintln(os.Stderr)
+	return string(b), nil
+}
+
+func keyringKey(key string) string {
+	return filepath.Base(key)
+}
+
+func (store *KeyringStore) Load(key string) (*Config, error) {
+	item, errGet := store.Keyring.Get(keyringKey(key))
+	if errors.Is(errGet, keyring.ErrKeyNotFound) {
+		return &Config{}, nil
+	}
+	if errGet != nil {
+		return nil, errGet
+	}
+	var config Config
+	errUnmarshal := json.Unmarshal(item.Data, &config)
+	if errUnmarshal != nil {
+		return nil, fmt.Errorf("Unable to read the keyring item %q: %w", keyringKey(key), errUnmarshal)
+	}
+	return &config, nil
+}
+
+func (store *KeyringStore) Save(key string, config *Config) error {
+	data, errMarshal := json.Marshal(config)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	return store.Keyring.Set(keyring.Item{
+		Key:                       keyringKey(key),
+		Data:                      data,
+		Label:                     fmt.Sprintf("awslogin 1Password session (%s)", keyringKey(key)),
+		Description:               "1Password CLI session token",
+		KeychainNotSynchronizable: true,
+	})
+}
+
+// LoadCatalog returns the item catalog saved next to the session, or nil when none has been saved
+func (store *KeyringStore) LoadCatalog(key string) (*Catalog, error) {
+	item, errGet := store.Keyring.Get(keyringKey(key) + catalogKeySuffix)
+	if errors.Is(errGet, keyring.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if errGet != nil {
+		return nil, errGet
+	}
+	var catalog Catalog
+	errUnmarshal := json.Unmarshal(item.Data, &catalog)
+	if errUnmarshal != nil {
+		return nil, fmt.Errorf("Unable to read the keyring item %q: %w", keyringKey(key)+catalogKeySuffix, errUnmarshal)
+	}
+	return &catalog, nil
+}
+
+// SaveCatalog saves the item catalog next to the session
+func (store *KeyringStore) SaveCatalog(key string, catalog *Catalog) error {
+	data, errMarshal := json.Marshal(catalog)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	return store.Keyring.Set(keyring.Item{
+		Key:                       keyringKey(key) + catalogKeySuffix,
+		Data:                      data,
+		Label:                     fmt.Sprintf("awslogin 1Password items (%s)", keyringKey(key)),
+		Description:               "Cached list of the 1Password AWS items",
+		KeychainNotSynchronizable: true,
+	})
+}
+
+func (store *KeyringStore) Remove(key string) error {
+	err := store.Keyring.Remove(keyringKey(key))
+	if err != nil && !errors.Is(err, keyring.ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (store *KeyringStore) Location(key string) string {
+	return fmt.Sprintf("keyring item %q", keyringKey(key))
+}
+
+// MigrateSessionFile moves a session saved in a plaintext file into the store and removes the file.
+// It reports whether a session was moved.
+func MigrateSessionFile(filename string, store SessionStore) (bool, error) {
+	if _, ok := store.(FileStore); ok {
+		return false, nil
+	}
+	data, errReadFile := ioutil.ReadFile(filepath.Clean(filename))
+	if os.IsNotExist(errReadFile) {
+		return false, nil
+	}
+	if errReadFile != nil {
+		return false, errReadFile
+	}
+	if len(data) > 0 {
+		var config Config
+		errUnmarshal := json.Unmarshal(data, &config)
+		if errUnmarshal != nil {
+			return false, fmt.Errorf("Unable to read JSON file at %q: %w", filename, errUnmarshal)
+		}
+		errSave := store.Save(filename, &config)
+		if errSave != nil {
+			return false, errSave
+		}
+	}
+	errRemove := os.Remove(filename)
+	if errRemove != nil {
+		return false, errRemove
+	}
+	return len(data) > 0, nil
+}
@@ -0,0 +1,92 @@
+package op
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/99designs/keyring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".op_session")
+	store := FileStore{}
+
+	config, err := store.Load(filename)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{}, config)
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err), "loading should not create the session file")
+
+	// An existing world readable file is replaced
+	require.NoError(t, ioutil.WriteFile(filename, []byte("{}"), 0644))
+	require.NoError(t, store.Save(filename, New("OP_SESSION_dds", "token")))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	config, err = store.Load(filename)
+	require.NoError(t, err)
+	assert.Equal(t, "OP_SESSION_dds", config.SessionName)
+	assert.Equal(t, "token", config.SessionToken)
+
+	files, err := ioutil.ReadDir(filepath.Dir(filename))
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "no temporary files should be left behind")
+
+	require.NoError(t, store.Remove(filename))
+	require.NoError(t, store.Remove(filename))
+}
+
+func TestKeyringStore(t *testing.T) {
+	store := &KeyringStore{Keyring: keyring.NewArrayKeyring(nil)}
+
+	config, err := store.Load("/home/user/.op_session")
+	require.NoError(t, err)
+	assert.Equal(t, &Config{}, config)
+
+	require.NoError(t, store.Save("/home/user/.op_session_dds", New("OP_SESSION_dds", "token")))
+	keys, err := store.Keyring.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []string{".op_session_dds"}, keys)
+	assert.Equal(t, `keyring item ".op_session_dds"`, store.Location("/home/user/.op_session_dds"))
+
+	config, err = store.Load("/home/user/.op_session_dds")
+	require.NoError(t, err)
+	assert.Equal(t, "token", config.SessionToken)
+
+	require.NoError(t, store.Remove("/home/user/.op_session_dds"))
+	require.NoError(t, store.Remove("/home/user/.op_session_dds"))
+}
+
+func TestMigrateSessionFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), ".op_session")
+	store := &KeyringStore{Keyring: keyring.NewArrayKeyring(nil)}
+
+	migrated, err := MigrateSessionFile(filename, store)
+	require.NoError(t, err)
+	assert.False(t, migrated)
+
+	require.NoError(t, WriteConfig(filename, New("OP_SESSION_dds", "token")))
+	migrated, err = MigrateSessionFile(filename, store)
+	require.NoError(t, err)
+	assert.True(t, migrated)
+	_, err = os.Stat(filename)
+	assert.True(t, os.IsNotExist(err), "the plaintext session file should be removed")
+
+	config, err := LoadSession(store, filename)
+	require.NoError(t, err)
+	assert.Equal(t, "token", config.SessionToken)
+	assert.Equal(t, store, config.Store)
+
+	// Files are left alone when the file store is in use
+	require.NoError(t, WriteConfig(filename, New("OP_SESSION_dds", "token")))
+	migrated, err = MigrateSessionFile(filename, FileStore{})
+	require.NoError(t, err)
+	assert.False(t, migrated)
+	_, err = os.Stat(filename)
+	assert.NoError(t, err)
+}
@@ -1,57 +1,179 @@
 package op
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"os/exec"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/99designs/aws-vault/v6/prompt"
 )
 
-func Signin(sessionFilename string) (*Config, error) {
+// DefaultSigninAttempts is how many passwords are asked for before signing in fails
+const DefaultSigninAttempts = 3
 
-	opPath, errGetExecPath := GetExecPath()
-	if errGetExecPath != nil {
-		return nil, errGetExecPath
+// Signin asks for the 1Password password and returns the new session, saved to the store under sessionFilename
+func Signin(ctx context.Context, store SessionStore, sessionFilename string) (*Config, error) {
+	config := &Config{Store: store}
+	errSignin := config.Signin(ctx, sessionFilename)
+	if errSignin != nil {
+		return nil, errSignin
+	}
+	return config, nil
+}
+
+// Signin asks for the 1Password password, updates the session of the config and saves it to the session store.
+// A rejected password is asked for again up to the number of signin attempts of the config.
+func (config *Config) Signin(ctx context.Context, sessionFilename string) error {
+	if config.IsServiceAccount() {
+		// A service account can't sign in interactively so report why the token was not accepted
+		return config.CheckServiceAccount(ctx, config.Vaults)
+	}
+
+	d, errDialect := config.getDialect(ctx)
+	if errDialect != nil {
+		return errDialect
 	}
 
-	pass, errTerminalSecretPrompt := prompt.TerminalSecretPrompt("Enter your 1Password password: ")
-	if errTerminalSecretPrompt != nil {
-		return nil, errTerminalSecretPrompt
+	message := "Enter your 1Password password: "
+	if len(config.Account) > 0 {
+		errAddAccount := config.ensureAccountAdded(ctx)
+		if errAddAccount != nil {
+			return errAddAccount
+		}
+		message = fmt.Sprintf("Enter your 1Password password for %q: ", config.Account)
 	}
 
-	command := exec.Command(*opPath, "signin")
-	stdin, errStdinPipe := command.StdinPipe()
-	if errStdinPipe != nil {
-		log.Fatal(errStdinPipe)
+	account, errSigninAccount := config.signinAccount(ctx, d)
+	if errSigninAccount != nil {
+		return errSigninAccount
+	}
+	accountFlag := account.Shorthand
+	if len(accountFlag) == 0 {
+		accountFlag = account.UserUUID
 	}
 
-	go func() {
-		defer stdin.Close()
-		_, errWriteString := io.WriteString(stdin, pass)
-		if errWriteString != nil {
-			log.Fatal(errWriteString)
+	attempts := config.SigninAttempts
+	if attempts < 1 {
+		attempts = DefaultSigninAttempts
+	}
+	var token string
+	for attempt := 1; ; attempt++ {
+		pass, errPassword := config.readPassword(message)
+		if errPassword != nil {
+			return errPassword
+		}
+		var errSignin error
+		token, errSignin = config.signinRaw(ctx, d.signinArgs(accountFlag), pass)
+		if errSignin == nil {
+			break
 		}
-	}()
+		if !isWrongPassword(errSignin) {
+			return errSignin
+		}
+		if attempt >= attempts {
+			return fmt.Errorf("%w after %d attempts: %v", ErrWrongPassword, attempt, errSignin)
+		}
+		fmt.Fprintln(os.Stderr, "The 1Password password was not accepted, try again.")
+	}
+
+	config.mu.Lock()
+	config.SessionName = d.sessionName(*account)
+	config.SessionToken = token
+	config.LastUsed = time.Now()
+
+	store := config.sessionStore()
+	errSave := store.Save(sessionFilename, config)
+	if errSave == nil {
+		config.storeKey, config.storedToken = sessionFilename, token
+	}
+	config.mu.Unlock()
+	if errSave != nil {
+		return errSave
+	}
 
-	out, errOutput := command.Output()
+	fmt.Printf("1Password session saved to: %s\n", store.Location(sessionFilename))
+	return nil
+}
+
+// readPassword asks for the password with the password func of the config, defaulting to a terminal prompt
+func (config *Config) readPassword(message string) (string, error) {
+	if config.Password != nil {
+		return config.Password(message)
+	}
+	return prompt.TerminalSecretPrompt(message)
+}
+
+// signinRaw runs the signin command with the password on stdin and returns the session token it prints
+func (config *Config) signinRaw(ctx context.Context, args []string, pass string) (string, error) {
+	// The timeout only starts once the password has been entered
+	ctx, cancel := context.WithTimeout(ctx, config.timeout())
+	defer cancel()
+	command, errCommand := newCommand(ctx, args, nil)
+	if errCommand != nil {
+		return "", errCommand
+	}
+	command.Stdin = strings.NewReader(pass + "\n")
+
+	out, errOutput := output(command)
 	if errOutput != nil {
-		log.Fatal(errOutput)
+		return "", contextError(ctx, args, errOutput)
+	}
+	token := strings.TrimSpace(string(out))
+	if len(token) == 0 || strings.ContainsAny(token, " \t\r\n=") {
+		return "", errors.New("Unable to read the session token printed by op signin")
 	}
-	// The output appears to be:
-	// export OP_SESSION_dds="_N8UtA6Y-NGyiWycztN9PZbuDA0g-B7xXOkrIGD1E91"
-	opSession := strings.Split(strings.Split(strings.Split(string(out), "\n")[0], " ")[1], "=")
-	sessionName := opSession[0]
-	sessionToken := strings.Trim(opSession[1], "\"")
+	return token, nil
+}
 
-	config := New(sessionName, sessionToken)
-	errWriteConfig := WriteConfig(sessionFilename, config)
-	if errWriteConfig != nil {
-		return nil, errWriteConfig
+// signinAccount returns the account op signs into, whose details name the session variable
+func (config *Config) signinAccount(ctx context.Context, d dialect) (*Account, error) {
+	accounts, errListAccounts := config.ListAccounts(ctx)
+	if errListAccounts != nil {
+		return nil, errListAccounts
 	}
 
-	fmt.Printf("1Password session file saved to: %s\n", sessionFilename)
-	return config, nil
+	shorthand := config.Account
+	if len(shorthand) == 0 {
+		if _, ok := d.(dialectV1); ok {
+			// op 1.x signs into the account used last when none is given
+			opConfig, errReadConfig := readConfigV1()
+			if errReadConfig != nil {
+				return nil, errReadConfig
+			}
+			shorthand = opConfig.LatestSignin
+		} else if len(accounts) == 1 {
+			return &accounts[0], nil
+		}
+	}
+
+	for i, account := range accounts {
+		if len(shorthand) > 0 && (account.Shorthand == shorthand || account.UserUUID == shorthand) {
+			return &accounts[i], nil
+		}
+	}
+	if len(shorthand) == 0 && len(accounts) > 1 {
+		return nil, fmt.Errorf("%w: more than one account has been added to op, choose one with --accounts", ErrAccountNotFound)
+	}
+	if len(shorthand) == 0 {
+		return nil, fmt.Errorf("%w: no account has been added to op on this machine, add one with `op account add`", ErrAccountNotFound)
+	}
+	return nil, fmt.Errorf("%w: %q hasn't been added to op on this machine", ErrAccountNotFound, shorthand)
+}
+
+// isWrongPassword reports whether op signin rejected the password
+func isWrongPassword(err error) bool {
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) {
+		return false
+	}
+	message := strings.ToLower(commandErr.Stderr)
+	for _, part := range []string{"unauthorized", "401", "incorrect", "invalid password", "wrong password", "authentication required"} {
+		if strings.Contains(message, part) {
+			return true
+		}
+	}
+	return false
 }
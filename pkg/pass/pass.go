@@ -0,0 +1,269 @@
+// Package pass reads AWS accounts from a password store managed by pass and its pass-otp extension
+package pass
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+	"github.com/deptofdefense/awslogin/pkg/provider"
+	"github.com/deptofdefense/awslogin/pkg/totp"
+)
+
+// DefaultSubtree is the directory of the password store holding the AWS entries
+const DefaultSubtree = "aws"
+
+// DefaultTimeout is how long pass may take to decrypt an entry, which includes typing the GPG passphrase
+const DefaultTimeout = 2 * time.Minute
+
+// entryExt is the extension pass gives the encrypted entries
+const entryExt = ".gpg"
+
+// Store lists the entries below a subtree of the password store as AWS accounts. The first line of an entry
+// is its password, an otpauth:// line is its one-time password seed as pass-otp keeps it, and every
+// "Key: value" line becomes a field of the settings section. The alias defaults to the name of the entry.
+type Store struct {
+	// Dir is the root of the password store
+	Dir string
+	// Subtree is the directory below Dir holding the AWS entries
+	Subtree string
+	// Section and AliasField are where the login flow reads the fields and the account alias from
+	Section    string
+	AliasField string
+	// Timeout limits each pass command, defaulting to DefaultTimeout
+	Timeout time.Duration
+
+	mu sync.Mutex
+	// decrypted holds the content of the entries already shown, since each pass show may ask for the passphrase
+	decrypted map[string]string
+	// shows joins concurrent decryptions of the same entry
+	shows singleflight.Group
+}
+
+var _ provider.Provider = (*Store)(nil)
+var _ provider.AliasTitler = (*Store)(nil)
+
+// New returns the store with its AWS entries in the subtree of dir
+func New(dir, subtree, section, aliasField string) *Store {
+	return &Store{
+		Dir:        dir,
+		Subtree:    subtree,
+		Section:    section,
+		AliasField: aliasField,
+	}
+}
+
+// DefaultDir returns the password store pass uses, which is PASSWORD_STORE_DIR or ~/.password-store
+func DefaultDir() (string, error) {
+	if dir := os.Getenv("PASSWORD_STORE_DIR"); len(dir) > 0 {
+		return dir, nil
+	}
+	homedir, errUserHomeDir := os.UserHomeDir()
+	if errUserHomeDir != nil {
+		return "", errUserHomeDir
+	}
+	return filepath.Join(homedir, ".password-store"), nil
+}
+
+// entryKind is what the errors call an entry
+const entryKind = "pass entry"
+
+// ListItems lists the entries of the subtree without decrypting them, titled by their path in the subtree.
+// pass has no tags so every entry is listed.
+func (store *Store) ListItems(ctx context.Context, tags string) ([]op.Item, error) {
+	root := filepath.Join(store.Dir, filepath.FromSlash(store.Subtree))
+	items := []op.Item{}
+	errWalk := filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && name != root {
+			// The .git directory and .gpg-id files aren't entries
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), entryExt) {
+			return nil
+		}
+		rel, errRel := filepath.Rel(store.Dir, strings.TrimSuffix(name, entryExt))
+		if errRel != nil {
+			return errRel
+		}
+		items = append(items, op.Item{
+			Uuid:     filepath.ToSlash(rel),
+			Overview: op.Overview{Title: store.title(filepath.ToSlash(rel))},
+		})
+		return nil
+	})
+	if errors.Is(errWalk, fs.ErrNotExist) {
+		return nil, fmt.Errorf("The pass subtree %q does not exist in %s", store.Subtree, store.Dir)
+	}
+	if errWalk != nil {
+		return nil, errWalk
+	}
+	return items, ctx.Err()
+}
+
+// GetItem decrypts the entry with the path or title given as the name
+func (store *Store) GetItem(ctx context.Context, name string) (*op.Item, error) {
+	entry, errResolve := store.resolve(name)
+	if errResolve != nil {
+		return nil, errResolve
+	}
+	content, errDecrypt := store.decrypt(ctx, entry)
+	if errDecrypt != nil {
+		return nil, errDecrypt
+	}
+	return store.parse(entry, content), nil
+}
+
+// GetTotp generates the one-time password from the otpauth:// line of the entry, reusing the entry decrypted
+// by GetItem
+func (store *Store) GetTotp(ctx context.Context, name string) (*string, error) {
+	item, errGetItem := store.GetItem(ctx, name)
+	if errGetItem != nil {
+		return nil, errGetItem
+	}
+	secret, ok := item.OTPSecret()
+	if !ok {
+		return nil, fmt.Errorf("The pass entry %q has no otpauth:// line", item.Uuid)
+	}
+	key, errParse := totp.Parse(secret)
+	if errParse != nil {
+		return nil, fmt.Errorf("Unable to use the one-time password seed of the pass entry %q: %w", item.Uuid, errParse)
+	}
+	code := key.Generate(time.Now())
+	return &code, nil
+}
+
+// AliasTitle returns the title of the entry named after the alias, which is its path in the subtree
+func (store *Store) AliasTitle(alias string) string {
+	return alias
+}
+
+// title returns the path of the entry in the subtree
+func (store *Store) title(entry string) string {
+	if len(store.Subtree) == 0 {
+		return entry
+	}
+	return strings.TrimPrefix(entry, strings.Trim(store.Subtree, "/")+"/")
+}
+
+// resolve returns the entry with the name as its path in the store or in the subtree
+func (store *Store) resolve(name string) (string, error) {
+	for _, entry := range []string{path.Join(store.Subtree, name), name} {
+		entry = path.Clean(entry)
+		if entry == ".." || strings.HasPrefix(entry, "../") || path.IsAbs(entry) {
+			continue
+		}
+		if info, errStat := os.Stat(filepath.Join(store.Dir, filepath.FromSlash(entry)+entryExt)); errStat == nil && !info.IsDir() {
+			return entry, nil
+		}
+	}
+	return "", &provider.NotFoundError{Kind: entryKind, Name: name}
+}
+
+// decrypt returns the content of the entry, running pass once per entry however often and concurrently it is
+// asked for so GPG never prompts twice
+func (store *Store) decrypt(ctx context.Context, entry string) (string, error) {
+	store.mu.Lock()
+	content, ok := store.decrypted[entry]
+	store.mu.Unlock()
+	if ok {
+		return content, nil
+	}
+
+	shown, errDo, _ := store.shows.Do(entry, func() (interface{}, error) {
+		content, errShow := store.show(ctx, entry)
+		if errShow != nil {
+			return nil, errShow
+		}
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		if store.decrypted == nil {
+			store.decrypted = map[string]string{}
+		}
+		store.decrypted[entry] = content
+		return content, nil
+	})
+	if errDo != nil {
+		return "", errDo
+	}
+	return shown.(string), nil
+}
+
+// show runs `pass show` for the entry, killing it once the timeout of the store passes
+func (store *Store) show(ctx context.Context, entry string) (string, error) {
+	timeout := store.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// pass needs the GPG agent and terminal variables so the whole environment is passed on
+	cmd := exec.CommandContext(ctx, "pass", "show", entry)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PASSWORD_STORE_DIR=%s", store.Dir))
+	out, errOutput := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("pass show %s did not finish: %w", entry, ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(errOutput, &exitErr) {
+		stderr := strings.TrimSpace(string(exitErr.Stderr))
+		if strings.Contains(stderr, "is not in the password store") {
+			return "", &provider.NotFoundError{Kind: entryKind, Name: entry}
+		}
+		if len(stderr) > 0 {
+			return "", fmt.Errorf("Unable to read the pass entry %q: %s", entry, stderr)
+		}
+	}
+	if errOutput != nil {
+		return "", fmt.Errorf("Unable to read the pass entry %q: %w", entry, errOutput)
+	}
+	return string(out), nil
+}
+
+// parse turns the decrypted entry into an item with its fields in the settings section
+func (store *Store) parse(entry, content string) *op.Item {
+	section := op.Section{Name: "pass", Title: store.Section}
+	hasAlias := false
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "otpauth://"):
+			// `pass otp insert` makes the seed the first line of an entry of its own
+			section.Fields = append(section.Fields, op.SectionField{K: "concealed", N: "TOTP_pass", T: "otpauth", V: line})
+		case first:
+			// The password isn't needed to log in
+		case strings.Contains(line, ":"):
+			parts := strings.SplitN(line, ":", 2)
+			title, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			hasAlias = hasAlias || title == store.AliasField
+			section.Fields = append(section.Fields, op.SectionField{K: "string", T: title, V: value})
+		}
+	}
+	if !hasAlias && len(store.AliasField) > 0 {
+		section.Fields = append(section.Fields, op.SectionField{K: "string", T: store.AliasField, V: path.Base(entry)})
+	}
+	return &op.Item{
+		Uuid:     entry,
+		Overview: op.Overview{Title: store.title(entry)},
+		Details:  op.Details{Sections: []op.Section{section}},
+	}
+}
@@ -0,0 +1,139 @@
+package pass
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// fakePassScript prints the entries of the test store, which are kept unencrypted, and logs each entry shown
+const fakePassScript = `#!/bin/sh
+if [ "$1" != "show" ]; then exit 1; fi
+echo "$2" >> "$PASSWORD_STORE_DIR/.shows"
+if [ ! -f "$PASSWORD_STORE_DIR/$2.gpg" ]; then
+  echo "Error: $2 is not in the password store." >&2
+  exit 1
+fi
+cat "$PASSWORD_STORE_DIR/$2.gpg"
+`
+
+const testSeed = "otpauth://totp/AWS:alpha?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&issuer=AWS"
+
+// newTestStore installs the fake pass and returns a store holding the given entries
+func newTestStore(t *testing.T, entries map[string]string) *Store {
+	bin := t.TempDir()
+	// #nosec G306 the fake pass must be executable
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bin, "pass"), []byte(fakePassScript), 0700))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := t.TempDir()
+	for entry, content := range entries {
+		name := filepath.Join(dir, filepath.FromSlash(entry)+entryExt)
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0700))
+		require.NoError(t, ioutil.WriteFile(name, []byte(content), 0600))
+	}
+	return New(dir, DefaultSubtree, "ACCOUNT_INFO", "ACCOUNT_ALIAS")
+}
+
+func TestListItems(t *testing.T) {
+	store := newTestStore(t, map[string]string{
+		"aws/alpha":         "password\n" + testSeed + "\n",
+		"aws/gov/beta":      "password\n",
+		"aws/.git/config":   "",
+		"personal/shopping": "password\n",
+	})
+
+	items, err := store.ListItems(context.Background(), "aws")
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "aws/alpha", items[0].Uuid)
+	assert.Equal(t, "alpha", items[0].Overview.Title)
+	assert.Equal(t, "aws/gov/beta", items[1].Uuid)
+	assert.Equal(t, "gov/beta", items[1].Overview.Title)
+
+	store.Subtree = "missing"
+	_, err = store.ListItems(context.Background(), "aws")
+	assert.EqualError(t, err, `The pass subtree "missing" does not exist in `+store.Dir)
+}
+
+func TestGetItem(t *testing.T) {
+	store := newTestStore(t, map[string]string{
+		"aws/alpha": "password\n" + testSeed + "\nACCOUNT_ALIAS: alpha-prod\nREGION: us-gov-west-1\n",
+		"aws/beta":  testSeed + "\n",
+	})
+
+	item, err := store.GetItem(context.Background(), "alpha")
+	require.NoError(t, err)
+	assert.Equal(t, "aws/alpha", item.Uuid)
+	require.Len(t, item.Details.Sections, 1)
+	assert.Equal(t, "ACCOUNT_INFO", item.Details.Sections[0].Title)
+	assert.Equal(t, []op.SectionField{
+		{K: "concealed", N: "TOTP_pass", T: "otpauth", V: testSeed},
+		{K: "string", T: "ACCOUNT_ALIAS", V: "alpha-prod"},
+		{K: "string", T: "REGION", V: "us-gov-west-1"},
+	}, item.Details.Sections[0].Fields)
+
+	// An entry made by pass-otp starts with its seed and takes its alias from its name
+	item, err = store.GetItem(context.Background(), "aws/beta")
+	require.NoError(t, err)
+	secret, ok := item.OTPSecret()
+	assert.True(t, ok)
+	assert.Equal(t, testSeed, secret)
+	assert.Contains(t, item.Details.Sections[0].Fields, op.SectionField{K: "string", T: "ACCOUNT_ALIAS", V: "beta"})
+}
+
+func TestGetItemNotFound(t *testing.T) {
+	store := newTestStore(t, map[string]string{"aws/alpha": "password\n"})
+
+	for _, name := range []string{"gamma", "../../outside", "/etc/passwd"} {
+		_, err := store.GetItem(context.Background(), name)
+		assert.True(t, errors.Is(err, op.ErrItemNotFound), name)
+	}
+}
+
+func TestGetTotp(t *testing.T) {
+	store := newTestStore(t, map[string]string{
+		"aws/alpha": "password\n" + testSeed + "\n",
+		"aws/beta":  "password\n",
+	})
+
+	code, err := store.GetTotp(context.Background(), "alpha")
+	require.NoError(t, err)
+	assert.Len(t, *code, 6)
+
+	_, err = store.GetTotp(context.Background(), "beta")
+	assert.EqualError(t, err, `The pass entry "aws/beta" has no otpauth:// line`)
+}
+
+func TestDecryptsOnce(t *testing.T) {
+	store := newTestStore(t, map[string]string{
+		"aws/alpha": "password\n" + testSeed + "\n",
+	})
+
+	// The login flow fetches the item and its one-time password at the same time
+	var group errgroup.Group
+	group.Go(func() error {
+		_, err := store.GetItem(context.Background(), "alpha")
+		return err
+	})
+	group.Go(func() error {
+		_, err := store.GetTotp(context.Background(), "alpha")
+		return err
+	})
+	require.NoError(t, group.Wait())
+	_, err := store.GetTotp(context.Background(), "alpha")
+	require.NoError(t, err)
+
+	shows, err := ioutil.ReadFile(filepath.Join(store.Dir, ".shows"))
+	require.NoError(t, err)
+	assert.Equal(t, "aws/alpha\n", string(shows))
+}
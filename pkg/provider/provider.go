@@ -0,0 +1,58 @@
+// Package provider defines the sources awslogin can read AWS accounts and their one-time passwords from
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/deptofdefense/awslogin/pkg/op"
+)
+
+// The names of the providers given to --provider
+const (
+	NameOnePassword = "op"
+	NamePass        = "pass"
+	NameKeePass     = "keepass"
+	NameBitwarden   = "bw"
+	NameVault       = "vault"
+	NameExternal    = "external"
+)
+
+// Names lists every provider in the order they are documented
+var Names = []string{NameOnePassword, NamePass, NameKeePass, NameBitwarden, NameVault, NameExternal}
+
+// Provider lists the AWS accounts, returns the metadata of each and generates its one-time passwords.
+// Accounts are returned as 1Password items so every provider fits the same account selection, where the
+// metadata is the fields of the settings section. An account that doesn't exist is an op.ErrItemNotFound.
+type Provider interface {
+	// ListItems lists the accounts, which may be missing their sections until fetched with GetItem
+	ListItems(ctx context.Context, tags string) ([]op.Item, error)
+	// GetItem returns the account with its sections, found by UUID or title
+	GetItem(ctx context.Context, name string) (*op.Item, error)
+	// GetTotp returns the current one-time password of the account
+	GetTotp(ctx context.Context, name string) (*string, error)
+}
+
+// The 1Password client is the original provider
+var _ Provider = op.Client(nil)
+
+// AliasTitler is implemented by providers that don't title the item of an account "AWS <alias>"
+type AliasTitler interface {
+	AliasTitle(alias string) string
+}
+
+// NotFoundError is returned by the providers for an account that doesn't exist
+type NotFoundError struct {
+	// Kind is what the provider calls an account, e.g. "pass entry"
+	Kind string
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("The %s %q was not found", e.Kind, e.Name)
+}
+
+// Is lets the login flow treat a missing account like a missing 1Password item
+func (e *NotFoundError) Is(target error) bool {
+	return target == op.ErrItemNotFound
+}
@@ -0,0 +1,132 @@
+// Package totp generates time-based one-time passwords from otpauth:// keys.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505 SHA1 is the default algorithm of RFC 6238
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDigits = 6
+	defaultPeriod = 30 * time.Second
+)
+
+// Algorithm is the HMAC hash named by the otpauth algorithm parameter
+type Algorithm string
+
+// The algorithms allowed by RFC 6238
+const (
+	SHA1   Algorithm = "SHA1"
+	SHA256 Algorithm = "SHA256"
+	SHA512 Algorithm = "SHA512"
+)
+
+var algorithms = map[Algorithm]func() hash.Hash{
+	SHA1:   sha1.New,
+	SHA256: sha256.New,
+	SHA512: sha512.New,
+}
+
+// Key holds the parameters needed to generate a one-time password
+type Key struct {
+	Secret    []byte
+	Algorithm Algorithm
+	Digits    int
+	Period    time.Duration
+}
+
+// Parse reads an otpauth:// URI or a bare base32 secret
+func Parse(value string) (*Key, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "otpauth://") {
+		return newKey(value)
+	}
+
+	u, errParse := url.Parse(value)
+	if errParse != nil {
+		return nil, fmt.Errorf("Unable to parse otpauth URI: %w", errParse)
+	}
+	if u.Host != "totp" {
+		return nil, fmt.Errorf("Unsupported otpauth type %q", u.Host)
+	}
+
+	q := u.Query()
+	key, errNewKey := newKey(q.Get("secret"))
+	if errNewKey != nil {
+		return nil, errNewKey
+	}
+	if algorithm := q.Get("algorithm"); len(algorithm) > 0 {
+		a := Algorithm(strings.ToUpper(algorithm))
+		if _, ok := algorithms[a]; !ok {
+			return nil, fmt.Errorf("Unsupported otpauth algorithm %q", algorithm)
+		}
+		key.Algorithm = a
+	}
+	if digits := q.Get("digits"); len(digits) > 0 {
+		d, errAtoi := strconv.Atoi(digits)
+		if errAtoi != nil || d < 1 || d > 10 {
+			return nil, fmt.Errorf("Invalid otpauth digits %q", digits)
+		}
+		key.Digits = d
+	}
+	if period := q.Get("period"); len(period) > 0 {
+		p, errAtoi := strconv.Atoi(period)
+		if errAtoi != nil || p < 1 {
+			return nil, fmt.Errorf("Invalid otpauth period %q", period)
+		}
+		key.Period = time.Duration(p) * time.Second
+	}
+	return key, nil
+}
+
+func newKey(secret string) (*Key, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("The one-time password secret is empty")
+	}
+	decoded, errDecode := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if errDecode != nil {
+		return nil, fmt.Errorf("Unable to decode the one-time password secret: %w", errDecode)
+	}
+	return &Key{
+		Secret:    decoded,
+		Algorithm: SHA1,
+		Digits:    defaultDigits,
+		Period:    defaultPeriod,
+	}, nil
+}
+
+// Generate returns the one-time password for the time step containing t
+func (key *Key) Generate(t time.Time) string {
+	counter := uint64(t.Unix() / int64(key.Period/time.Second))
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	newHash, ok := algorithms[key.Algorithm]
+	if !ok {
+		newHash = sha1.New
+	}
+	mac := hmac.New(newHash, key.Secret)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation as described in RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	code := uint64(binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff)
+
+	mod := uint64(1)
+	for i := 0; i < key.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", key.Digits, code%mod)
+}
@@ -0,0 +1,115 @@
+package totp
+
+import (
+	"encoding/base32"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The seeds of the RFC 6238 appendix B test vectors
+var rfcSeeds = map[Algorithm]string{
+	SHA1:   "12345678901234567890",
+	SHA256: "12345678901234567890123456789012",
+	SHA512: "1234567890123456789012345678901234567890123456789012345678901234",
+}
+
+func TestGenerateRFC6238(t *testing.T) {
+	vectors := []struct {
+		unix      int64
+		algorithm Algorithm
+		code      string
+	}{
+		{59, SHA1, "94287082"},
+		{59, SHA256, "46119246"},
+		{59, SHA512, "90693936"},
+		{1111111109, SHA1, "07081804"},
+		{1111111109, SHA256, "68084774"},
+		{1111111109, SHA512, "25091201"},
+		{1111111111, SHA1, "14050471"},
+		{1111111111, SHA256, "67062674"},
+		{1111111111, SHA512, "99943326"},
+		{1234567890, SHA1, "89005924"},
+		{1234567890, SHA256, "91819424"},
+		{1234567890, SHA512, "93441116"},
+		{2000000000, SHA1, "69279037"},
+		{2000000000, SHA256, "90698825"},
+		{2000000000, SHA512, "38618901"},
+		{20000000000, SHA1, "65353130"},
+		{20000000000, SHA256, "77737706"},
+		{20000000000, SHA512, "47863826"},
+	}
+	for _, v := range vectors {
+		secret := base32.StdEncoding.EncodeToString([]byte(rfcSeeds[v.algorithm]))
+		uri := fmt.Sprintf("otpauth://totp/RFC?secret=%s&algorithm=%s&digits=8&period=30", secret, v.algorithm)
+		key, err := Parse(uri)
+		require.NoError(t, err)
+		assert.Equal(t, v.code, key.Generate(time.Unix(v.unix, 0)), "%s at %d", v.algorithm, v.unix)
+	}
+}
+
+func TestParse(t *testing.T) {
+	key, err := Parse("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	require.NoError(t, err)
+	assert.Equal(t, SHA1, key.Algorithm)
+	assert.Equal(t, 6, key.Digits)
+	assert.Equal(t, 30*time.Second, key.Period)
+	assert.Equal(t, "287082", key.Generate(time.Unix(59, 0)))
+
+	key, err = Parse("otpauth://totp/AWS?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&algorithm=sha256&digits=7&period=60")
+	require.NoError(t, err)
+	assert.Equal(t, SHA256, key.Algorithm)
+	assert.Equal(t, 7, key.Digits)
+	assert.Equal(t, time.Minute, key.Period)
+
+	for _, invalid := range []string{
+		"",
+		"not base32!",
+		"otpauth://hotp/AWS?secret=GEZDGNBV",
+		"otpauth://totp/AWS?secret=GEZDGNBV&algorithm=MD5",
+		"otpauth://totp/AWS?secret=GEZDGNBV&digits=0",
+		"otpauth://totp/AWS?secret=GEZDGNBV&period=-30",
+	} {
+		_, err := Parse(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseBase32Padding(t *testing.T) {
+	// Padded, unpadded and lowercase secrets are the same key
+	for _, secret := range []string{"GEZDGNBVGY3TQOJQ", "GEZDGNBVGY3TQOJQ======", "gezdgnbvgy3tqojq", "MFRGG===", "MFRGG"} {
+		key, err := Parse(secret)
+		require.NoError(t, err, secret)
+		assert.NotEmpty(t, key.Secret, secret)
+	}
+	padded, err := Parse("MFRGG===")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abc"), padded.Secret)
+	unpadded, err := Parse("otpauth://totp/AWS?secret=MFRGG")
+	require.NoError(t, err)
+	assert.Equal(t, padded.Secret, unpadded.Secret)
+}
+
+func TestGenerateDigitsAndPeriod(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte(rfcSeeds[SHA1]))
+
+	// The low digits of the RFC 6238 SHA1 code at 59s
+	key, err := Parse("otpauth://totp/AWS?secret=" + secret + "&digits=8")
+	require.NoError(t, err)
+	assert.Equal(t, "94287082", key.Generate(time.Unix(59, 0)))
+	key.Digits = 6
+	assert.Equal(t, "287082", key.Generate(time.Unix(59, 0)))
+
+	// A code holds for its whole period and changes with the next one
+	key, err = Parse("otpauth://totp/AWS?secret=" + secret + "&period=60")
+	require.NoError(t, err)
+	assert.Equal(t, key.Generate(time.Unix(60, 0)), key.Generate(time.Unix(119, 0)))
+	assert.NotEqual(t, key.Generate(time.Unix(119, 0)), key.Generate(time.Unix(120, 0)))
+	// At 60s per step the counter at 118s is the one of 59s at 30s per step
+	thirty, err := Parse(secret)
+	require.NoError(t, err)
+	assert.Equal(t, thirty.Generate(time.Unix(59, 0)), key.Generate(time.Unix(118, 0)))
+}